@@ -0,0 +1,175 @@
+package kubetoken
+
+import (
+	"errors"
+	"net/http"
+)
+
+// RoleProvider retrieves the roles available to a user.
+type RoleProvider interface {
+	FetchRolesForUser(user string) ([]string, error)
+}
+
+// RoleValidator validates a user is permitted to assume a role.
+type RoleValidator interface {
+	ValidateRoleForUser(user, role string) error
+}
+
+// Identity is an authenticated user, and the source of their roles.
+type Identity struct {
+	User string
+	RoleProvider
+	RoleValidator
+}
+
+// Authenticator authenticates the credentials presented with a request.
+type Authenticator interface {
+	// Authenticate returns the Identity of the user making req. If req
+	// carries no credentials the Authenticator understands, it returns
+	// ErrNoCredentials.
+	Authenticate(req *http.Request) (*Identity, error)
+}
+
+// UserFinder finds users without their credentials, so that their
+// roles may be validated again, for example when a certificate is
+// renewed.
+type UserFinder interface {
+	// FindUser returns the Identity of user. If there is no such user,
+	// it returns ErrInvalidCredentials.
+	FindUser(user string) (*Identity, error)
+}
+
+var (
+	// ErrNoCredentials is returned by an Authenticator if a request
+	// carries no credentials it understands.
+	ErrNoCredentials = errors.New("no credentials")
+
+	// ErrInvalidCredentials is returned by an Authenticator if the
+	// credentials carried by a request are invalid.
+	ErrInvalidCredentials = errors.New("invalid credentials")
+)
+
+// Authenticators is an Authenticator which tries each of its members
+// in turn until one finds credentials it understands.
+type Authenticators []Authenticator
+
+func (a Authenticators) Authenticate(req *http.Request) (*Identity, error) {
+	for _, auth := range a {
+		id, err := auth.Authenticate(req)
+		if err == ErrNoCredentials {
+			continue
+		}
+		return id, err
+	}
+	return nil, ErrNoCredentials
+}
+
+// FindUser returns the Identity of user from the first member which is
+// a UserFinder and knows of them.
+func (a Authenticators) FindUser(user string) (*Identity, error) {
+	found := false
+	for _, auth := range a {
+		f, ok := auth.(UserFinder)
+		if !ok {
+			continue
+		}
+		found = true
+		id, err := f.FindUser(user)
+		if err == ErrInvalidCredentials {
+			continue
+		}
+		return id, err
+	}
+	if !found {
+		return nil, errors.New("no authentication backend can find users")
+	}
+	return nil, ErrInvalidCredentials
+}
+
+// ADAuthenticator authenticates requests carrying HTTP Basic credentials
+// by binding to Active Directory as the user. The user's roles are read
+// from Active Directory.
+type ADAuthenticator struct {
+	Pool *LDAPPool
+
+	// Search, if not nil, is used to find users' DNs in place of
+	// constructing them from their username.
+	Search *UserSearch
+
+	// Directory is the layout of the directory.
+	Directory Directory
+}
+
+func (a *ADAuthenticator) Authenticate(req *http.Request) (*Identity, error) {
+	dir := a.Directory.WithDefaults()
+	lookup := a.Search.lookup(a.Pool, dir, dir.userdn, "sAMAccountName", "(objectCategory=Person)")
+	user, dn, bind, err := authenticateBind(a.Pool, req, lookup)
+	if err != nil {
+		return nil, err
+	}
+	return &Identity{
+		User:          user,
+		RoleProvider:  &ADRoleProvider{Bind: bind, UserDN: dn, Directory: dir},
+		RoleValidator: &ADRoleValidater{Bind: bind, UserDN: dn, Directory: dir},
+	}, nil
+}
+
+// FindUser returns the Identity of user, whose roles are read as the
+// LDAPPool's service account.
+func (a *ADAuthenticator) FindUser(user string) (*Identity, error) {
+	dir := a.Directory.WithDefaults()
+	lookup := a.Search.byName().lookup(a.Pool, dir, dir.userdn, "sAMAccountName", "(objectCategory=Person)")
+	dn, user, err := findUser(a.Pool, lookup, user)
+	if err != nil {
+		return nil, err
+	}
+	return &Identity{
+		User:          user,
+		RoleProvider:  &ADRoleProvider{Bind: a.Pool.Conn, UserDN: dn, Directory: dir},
+		RoleValidator: &ADRoleValidater{Bind: a.Pool.Conn, UserDN: dn, Directory: dir},
+	}, nil
+}
+
+// findUser returns the DN and username lookup returns for user, which
+// requires pool to have a service account.
+func findUser(pool *LDAPPool, lookup func(string) (string, string, error), user string) (string, string, error) {
+	if pool.BindDN == "" {
+		return "", "", errors.New("finding users requires a service account")
+	}
+	return lookup(user)
+}
+
+// authenticateBind verifies the HTTP Basic credentials carried by req by
+// binding to pool as the DN lookup returns for the login name. It
+// returns the username and DN lookup returned, and a function which
+// connects to pool for searches on the user's behalf.
+func authenticateBind(pool *LDAPPool, req *http.Request, lookup func(string) (string, string, error)) (string, string, func() (LDAPConn, error), error) {
+	login, pass, ok := req.BasicAuth()
+	if !ok {
+		return "", "", nil, ErrNoCredentials
+	}
+	// an empty password is an unauthenticated bind, which succeeds.
+	if login == "" || pass == "" {
+		return "", "", nil, ErrInvalidCredentials
+	}
+	dn, user, err := lookup(login)
+	if err != nil {
+		return "", "", nil, err
+	}
+	if err := pool.Verify(req.Context(), dn, pass); err != nil {
+		if isInvalidCredentials(err) {
+			return "", "", nil, ErrInvalidCredentials
+		}
+		return "", "", nil, err
+	}
+
+	// the password has been verified, searches may now use the
+	// service account if there is one.
+	bind := func() (LDAPConn, error) {
+		if pool.BindDN != "" {
+			return pool.Conn()
+		}
+		return pool.BindAs(req.Context(), dn, pass)
+	}
+	return user, dn, bind, nil
+}
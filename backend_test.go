@@ -0,0 +1,176 @@
+package kubetoken
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	oidc "github.com/coreos/go-oidc"
+	jose "gopkg.in/square/go-jose.v2"
+)
+
+func TestADAuthenticator(t *testing.T) {
+	d := newFakeDirectory(t)
+	defer d.Close()
+	a := &ADAuthenticator{
+		Pool: &LDAPPool{
+			Hosts:     []string{d.Addr()},
+			LDAPCreds: LDAPCreds{Mode: Plain},
+		},
+	}
+
+	tests := []struct {
+		user, pass string
+		basic      bool
+		err        error
+	}{
+		{user: "dcheney", pass: "secret", basic: true},
+		{user: "dcheney", pass: "wrong", basic: true, err: ErrInvalidCredentials},
+		{user: "dcheney", pass: "", basic: true, err: ErrInvalidCredentials},
+		{err: ErrNoCredentials},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/api/v1/roles", nil)
+		if tt.basic {
+			req.SetBasicAuth(tt.user, tt.pass)
+		}
+		id, err := a.Authenticate(req)
+		if err != tt.err {
+			t.Errorf("%s/%s: got err %v, want %v", tt.user, tt.pass, err, tt.err)
+			continue
+		}
+		if err == nil && id.User != tt.user {
+			t.Errorf("%s/%s: got user %q", tt.user, tt.pass, id.User)
+		}
+	}
+}
+
+// testKeySet verifies JWTs signed by a single key.
+type testKeySet struct {
+	key *rsa.PublicKey
+}
+
+func (k *testKeySet) VerifySignature(ctx context.Context, jwt string) ([]byte, error) {
+	jws, err := jose.ParseSigned(jwt)
+	if err != nil {
+		return nil, err
+	}
+	return jws.Verify(k.key)
+}
+
+func TestOIDCAuthenticator(t *testing.T) {
+	const issuer = "https://idp.example.com"
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: key}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := func(claims map[string]interface{}) string {
+		payload, err := json.Marshal(claims)
+		if err != nil {
+			t.Fatal(err)
+		}
+		jws, err := signer.Sign(payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, err := jws.CompactSerialize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	claims := func(aud string, groups interface{}) map[string]interface{} {
+		return map[string]interface{}{
+			"iss":                issuer,
+			"aud":                aud,
+			"sub":                "00u1234",
+			"preferred_username": "dcheney",
+			"exp":                time.Now().Add(time.Hour).Unix(),
+			"iat":                time.Now().Unix(),
+			"groups":             groups,
+		}
+	}
+
+	a := &OIDCAuthenticator{
+		Verifier:      oidc.NewVerifier(issuer, &testKeySet{&key.PublicKey}, &oidc.Config{ClientID: "kubetoken"}),
+		UsernameClaim: "preferred_username",
+		Directory:     Directory{SearchGroups: "kube"},
+	}
+	authenticate := func(token string) (*Identity, error) {
+		req := httptest.NewRequest("GET", "/api/v1/roles", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		return a.Authenticate(req)
+	}
+
+	id, err := authenticate(token(claims("kubetoken", []string{"kube-example-web-dev-dl-dev", "engineering"})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id.User != "dcheney" {
+		t.Errorf("got user %q, want dcheney", id.User)
+	}
+	roles, err := id.FetchRolesForUser(id.User)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"kube-example-web-dev-dl-dev"}; !reflect.DeepEqual(roles, want) {
+		t.Errorf("got roles %v, want %v", roles, want)
+	}
+	if err := id.ValidateRoleForUser(id.User, "engineering"); err != nil {
+		t.Errorf("expected engineering membership to validate: %v", err)
+	}
+	if err := id.ValidateRoleForUser(id.User, "kube-example-web-prod-dl-prod"); err == nil {
+		t.Errorf("expected kube-example-web-prod-dl-prod membership not to validate")
+	}
+
+	if _, err := authenticate(token(claims("other-client", nil))); err != ErrInvalidCredentials {
+		t.Errorf("token for another audience: got err %v, want %v", err, ErrInvalidCredentials)
+	}
+	if _, err := authenticate("not-a-token"); err != ErrInvalidCredentials {
+		t.Errorf("malformed token: got err %v, want %v", err, ErrInvalidCredentials)
+	}
+
+	req := httptest.NewRequest("GET", "/api/v1/roles", nil)
+	req.SetBasicAuth("dcheney", "secret")
+	if _, err := a.Authenticate(req); err != ErrNoCredentials {
+		t.Errorf("basic auth: got err %v, want %v", err, ErrNoCredentials)
+	}
+}
+
+func TestAuthenticators(t *testing.T) {
+	d := newFakeDirectory(t)
+	defer d.Close()
+	ad := &ADAuthenticator{
+		Pool: &LDAPPool{Hosts: []string{d.Addr()}, LDAPCreds: LDAPCreds{Mode: Plain}},
+	}
+	oidc := &OIDCAuthenticator{}
+	auth := Authenticators{oidc, ad}
+
+	req := httptest.NewRequest("GET", "/api/v1/roles", nil)
+	req.SetBasicAuth("dcheney", "secret")
+	if id, err := auth.Authenticate(req); err != nil || id.User != "dcheney" {
+		t.Fatalf("got %v, %v; want dcheney authenticated by AD", id, err)
+	}
+	req = httptest.NewRequest("GET", "/api/v1/roles", nil)
+	if _, err := auth.Authenticate(req); err != ErrNoCredentials {
+		t.Fatalf("got err %v, want %v", err, ErrNoCredentials)
+	}
+
+	// finding users requires a backend which can, with a service
+	// account.
+	if _, err := auth.FindUser("dcheney"); err == nil || err == ErrInvalidCredentials {
+		t.Errorf("find without a service account: got err %v", err)
+	}
+	if _, err := (Authenticators{oidc}).FindUser("dcheney"); err == nil {
+		t.Errorf("expected find without a UserFinder to fail")
+	}
+}
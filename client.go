@@ -1,5 +1,14 @@
 package kubetoken
 
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+)
+
 type CertificateResponse struct {
 	Username    string            `json:"username"`
 	Role        string            `json:"role"`
@@ -9,6 +18,14 @@ type CertificateResponse struct {
 	Environment string            `json:"environment"`
 	Namespace   string            `json:"namespace"`
 	Contexts    []Context         `json:"contexts"`
+
+	// TTL is the lifetime granted to the certificate, after clamping
+	// the requested lifetime to the policy for the role.
+	TTL string `json:"ttl,omitempty"`
+
+	// Expires is the time at which the certificate ceases to be valid,
+	// or nil if the server predates it.
+	Expires *time.Time `json:"expires,omitempty"`
 }
 
 type Context struct {
@@ -16,3 +33,201 @@ type Context struct {
 	Clusters map[string]string `json:"clusters"`
 }
 
+// DiscoveryPath is the path at which kubetokend serves its Discovery
+// document.
+const DiscoveryPath = "/.well-known/kubetoken"
+
+// Authentication methods listed in Discovery.AuthMethods.
+const (
+	AuthBasic   = "basic"   // HTTP Basic username and password
+	AuthBearer  = "bearer"  // OpenID Connect ID token
+	AuthSession = "session" // Session token, see SessionScheme
+)
+
+// SessionScheme is the Authorization scheme with which a Session token
+// is presented.
+const SessionScheme = "Kubetoken-Session"
+
+// Discovery describes a kubetokend server to its clients, so that a
+// client need not be built for a particular server.
+type Discovery struct {
+	// APIVersion is the version of the API, for example "v1".
+	APIVersion string `json:"apiversion"`
+
+	// Version is the version of kubetokend.
+	Version string `json:"version"`
+
+	// MinClientVersion, if set, is the oldest version of the kubetoken
+	// cli which the server supports.
+	MinClientVersion string `json:"minclientversion,omitempty"`
+
+	// AuthMethods are the ways in which clients may authenticate.
+	AuthMethods []string `json:"authmethods"`
+
+	// MFA is the default MFA provider, for example "duo", or empty if
+	// none is configured. Whether a second factor is required, and by
+	// which provider, depends on the environment and role.
+	MFA string `json:"mfa,omitempty"`
+
+	// KeyTypes are the public key algorithms accepted in CSRs, for
+	// example "rsa".
+	KeyTypes []string `json:"keytypes"`
+
+	// MaxTTL is the longest lifetime granted to certificates in any
+	// environment; the policy for a role may be shorter.
+	MaxTTL string `json:"maxttl"`
+
+	Endpoints Endpoints `json:"endpoints"`
+}
+
+// Endpoints are the paths of the API.
+type Endpoints struct {
+	Roles   string `json:"roles"`
+	SignCSR string `json:"signcsr"`
+	Revoke  string `json:"revoke"`
+
+	// MFA is the path under which MFA challenges are answered; see
+	// MFAChallenge.
+	MFA string `json:"mfa,omitempty"`
+
+	// TOTP is the path at which users enroll for TOTP, if supported;
+	// see TOTPEnrollRequest.
+	TOTP string `json:"totp,omitempty"`
+	// Session is the path at which sessions are started with POST, and
+	// ended with DELETE, if supported; see Session.
+	Session string `json:"session,omitempty"`
+	// Renew is the path at which certificates are renewed, if
+	// supported; see RenewCertificateHeader.
+	Renew string `json:"renew,omitempty"`
+}
+
+// Renewal headers. A certificate issued by kubetokend is renewed by
+// POSTing a CSR, for the same user and role, to the renew endpoint,
+// with the certificate presented as the TLS client certificate, or in
+// RenewCertificateHeader, base64 encoded. In the latter case the client
+// proves it holds the certificate's private key by setting
+// RenewDateHeader to the current time, in RFC 3339 format, and
+// RenewSignatureHeader to the base64 encoded signature, by that key, of
+// the RenewProof of the date and CSR.
+const (
+	RenewCertificateHeader = "X-Kubetoken-Certificate"
+	RenewDateHeader        = "X-Kubetoken-Date"
+	RenewSignatureHeader   = "X-Kubetoken-Signature"
+)
+
+// RenewProof returns the message signed to prove possession of a
+// certificate's private key when renewing it with csr at date. RSA keys
+// sign its SHA-256 digest with PKCS #1 v1.5, ECDSA keys sign its SHA-256
+// digest, and Ed25519 keys sign the message itself.
+func RenewProof(date string, csr []byte) []byte {
+	sum := sha256.Sum256(csr)
+	return []byte("kubetoken-renew\n" + date + "\n" + hex.EncodeToString(sum[:]))
+}
+
+// SignRenewProof signs the RenewProof of date and csr with key.
+func SignRenewProof(key crypto.Signer, date string, csr []byte) ([]byte, error) {
+	proof := RenewProof(date, csr)
+	if _, ok := key.Public().(ed25519.PublicKey); ok {
+		return key.Sign(rand.Reader, proof, crypto.Hash(0))
+	}
+	digest := sha256.Sum256(proof)
+	return key.Sign(rand.Reader, digest[:], crypto.SHA256)
+}
+
+// MFAHeader is the request header with which clients take part in MFA
+// challenges. A client which can answer a challenge sets it to
+// MFARequestChallenge when submitting a CSR. If a second factor is
+// required the server replies 401 Unauthorized, with a WWW-Authenticate
+// header of the MFAScheme and an MFAChallenge as the body. Once the
+// challenge has been answered, the client submits the same CSR again
+// with MFAHeader set to the challenge's transaction ID.
+const (
+	MFAHeader           = "X-Kubetoken-MFA"
+	MFARequestChallenge = "challenge"
+	MFAScheme           = "Kubetoken-MFA"
+)
+
+// Methods with which an MFAChallenge may be answered.
+const (
+	MFAPush     = "push"     // approve a push notification on a registered device
+	MFAPasscode = "passcode" // enter a one time passcode
+	MFAPhone    = "phone"    // answer a phone call
+)
+
+// MFA transaction statuses.
+const (
+	MFAPending = "pending"
+	MFAAllow   = "allow"
+	MFADeny    = "deny"
+)
+
+// MFAChallenge asks a client for a second factor.
+type MFAChallenge struct {
+	// Transaction identifies the challenge; it is a secret known only
+	// to the client.
+	Transaction string `json:"transaction"`
+
+	// Provider is the MFA provider, for example "duo".
+	Provider string `json:"provider"`
+
+	// Methods are the ways in which the challenge may be answered.
+	Methods []string `json:"methods"`
+
+	// Expires is the time by which the challenge must be answered and
+	// the CSR submitted again.
+	Expires time.Time `json:"expires"`
+}
+
+// MFAAnswer answers an MFAChallenge. It is POSTed to the MFA endpoint
+// followed by the transaction ID.
+type MFAAnswer struct {
+	Method   string `json:"method"`
+	Passcode string `json:"passcode,omitempty"` // for MFAPasscode only
+}
+
+// MFAStatus is the state of an MFA transaction, returned when it is
+// answered and polled with GET until no longer MFAPending.
+type MFAStatus struct {
+	Status  string `json:"status"`
+	Message string `json:"message,omitempty"`
+}
+
+// TOTPEnrollRequest is the body of a request to enroll for TOTP, which
+// returns a TOTPEnrollment.
+type TOTPEnrollRequest struct {
+	// User is the user to enroll, if not the requester; administrators
+	// only.
+	User string `json:"user,omitempty"`
+
+	// Passcode is a passcode from the requester's current secret, which
+	// is required to replace it.
+	Passcode string `json:"passcode,omitempty"`
+}
+
+// TOTPEnrollment is a TOTP secret for a user to add to their
+// authenticator app.
+type TOTPEnrollment struct {
+	User   string `json:"user"`
+	Secret string `json:"secret"` // base32 encoded
+	URI    string `json:"uri"`    // otpauth:// URI, for QR codes
+}
+
+// Session is a short lived token, issued once a user has given their
+// password, and any second factor, which authenticates later requests
+// in place of them until it expires or is revoked. Sessions are started
+// by POSTing to the session endpoint, taking part in any MFA challenge
+// as when submitting a CSR.
+type Session struct {
+	User    string    `json:"user"`
+	Token   string    `json:"token"`
+	Expires time.Time `json:"expires"`
+}
+
+// SessionRevokeRequest is the body of a DELETE request to the session
+// endpoint. With no body, the session presented is ended, or if the
+// request is authenticated otherwise, all of the user's sessions are.
+type SessionRevokeRequest struct {
+	// User is the user whose sessions are revoked, if not the
+	// requester; administrators only.
+	User string `json:"user,omitempty"`
+}
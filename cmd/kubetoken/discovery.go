@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/atlassian/kubetoken"
+	"github.com/atlassian/kubetoken/internal/cert"
+)
+
+// legacyDiscovery describes a kubetokend which predates the discovery
+// document.
+var legacyDiscovery = kubetoken.Discovery{
+	APIVersion: "v1",
+	KeyTypes:   []string{cert.RSA},
+	Endpoints: kubetoken.Endpoints{
+		Roles:   "/api/v1/roles",
+		SignCSR: "/api/v1/signcsr",
+		Revoke:  "/api/v1/revoke",
+	},
+}
+
+// fetchDiscovery returns the discovery document of the kubetokend at
+// host, or legacyDiscovery if it does not serve one.
+func fetchDiscovery(host string) (*kubetoken.Discovery, error) {
+	resp, err := http.Get(host + kubetoken.DiscoveryPath)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case 200:
+		var d kubetoken.Discovery
+		if err := json.NewDecoder(resp.Body).Decode(&d); err != nil {
+			return nil, fmt.Errorf("decoding %s: %v", kubetoken.DiscoveryPath, err)
+		}
+		return &d, nil
+	case 404:
+		d := legacyDiscovery
+		return &d, nil
+	default:
+		return nil, fmt.Errorf("unexpected status code fetching %s: %v", kubetoken.DiscoveryPath, resp.Status)
+	}
+}
+
+// negotiate checks this client can use the server described by d with
+// creds, falling back to rsa keys if the server does not accept
+// keyType, and warns if the requested ttl exceeds the server's limit.
+func negotiate(d *kubetoken.Discovery, creds *credentials, ttl time.Duration, keyType *string) error {
+	if d.APIVersion != "v1" {
+		return fmt.Errorf("kubetokend api version %q is not supported by this client; please upgrade", d.APIVersion)
+	}
+	if d.MinClientVersion != "" && compareVersions(kubetoken.Version, d.MinClientVersion) < 0 {
+		return fmt.Errorf("kubetoken %s is older than the oldest version supported by kubetokend, %s; please upgrade", kubetoken.Version, d.MinClientVersion)
+	}
+	// legacy servers do not list their authentication methods.
+	if len(d.AuthMethods) > 0 {
+		method := kubetoken.AuthBasic
+		if creds.token != "" {
+			method = kubetoken.AuthBearer
+		}
+		if !contains(d.AuthMethods, method) {
+			return fmt.Errorf("kubetokend does not accept %s authentication, only %s", method, strings.Join(d.AuthMethods, ", "))
+		}
+	}
+	if !contains(d.KeyTypes, *keyType) {
+		// servers which predate other key types accept only rsa.
+		if !contains(d.KeyTypes, cert.RSA) {
+			return fmt.Errorf("kubetokend does not accept %s keys, only %s", *keyType, strings.Join(d.KeyTypes, ", "))
+		}
+		if *verbose {
+			fmt.Fprintf(os.Stderr, "kubetokend does not accept %s keys, using %s\n", *keyType, cert.RSA)
+		}
+		*keyType = cert.RSA
+	}
+	if ttl > 0 && d.MaxTTL != "" {
+		max, err := time.ParseDuration(d.MaxTTL)
+		if err == nil && max > 0 && ttl > max {
+			fmt.Fprintf(os.Stderr, "warning: requested ttl %v exceeds the server maximum of %v\n", ttl, max)
+		}
+	}
+	return nil
+}
+
+// compareVersions compares versions of the form v1.2.3, returning -1,
+// 0, or 1 if a is older than, the same as, or newer than b. Versions
+// which cannot be parsed, such as development builds, compare as equal
+// to any other version.
+func compareVersions(a, b string) int {
+	pa, ok := parseVersion(a)
+	if !ok {
+		return 0
+	}
+	pb, ok := parseVersion(b)
+	if !ok {
+		return 0
+	}
+	for i := range pa {
+		switch {
+		case pa[i] < pb[i]:
+			return -1
+		case pa[i] > pb[i]:
+			return 1
+		}
+	}
+	return 0
+}
+
+func parseVersion(v string) ([3]int, bool) {
+	var p [3]int
+	v = strings.TrimPrefix(v, "v")
+	// ignore any pre-release or build suffix.
+	if i := strings.IndexAny(v, "-+"); i >= 0 {
+		v = v[:i]
+	}
+	fields := strings.Split(v, ".")
+	if len(fields) == 0 || len(fields) > 3 {
+		return p, false
+	}
+	for i, f := range fields {
+		n, err := strconv.Atoi(f)
+		if err != nil || n < 0 {
+			return p, false
+		}
+		p[i] = n
+	}
+	return p, true
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
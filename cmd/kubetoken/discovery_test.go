@@ -0,0 +1,65 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/atlassian/kubetoken"
+	"github.com/atlassian/kubetoken/internal/cert"
+)
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"v1.2.3", "v1.2.3", 0},
+		{"v1.2.3", "v1.2.4", -1},
+		{"v1.10.0", "v1.9.9", 1},
+		{"v2", "v1.9.9", 1},
+		{"1.2.3", "v1.2.3", 0},
+		{"v1.2.3-rc1", "v1.2.3", 0},
+		{"unknown", "v1.2.3", 0},
+		{"v1.2.3", "latest", 0},
+	}
+	for _, tt := range tests {
+		if got := compareVersions(tt.a, tt.b); got != tt.want {
+			t.Errorf("compareVersions(%q, %q): got %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	d := kubetoken.Discovery{
+		APIVersion:  "v1",
+		AuthMethods: []string{kubetoken.AuthBearer},
+		KeyTypes:    []string{"rsa"},
+		MaxTTL:      "6h",
+	}
+	tests := []struct {
+		d       kubetoken.Discovery
+		creds   credentials
+		keyType string
+		ok      bool
+		want    string // key type negotiated
+	}{
+		{d: d, creds: credentials{token: "token"}, keyType: cert.RSA, ok: true, want: cert.RSA},
+		{d: d, creds: credentials{user: "dcheney", pass: "secret"}, keyType: cert.RSA, ok: false},
+		{d: legacyDiscovery, creds: credentials{user: "dcheney", pass: "secret"}, keyType: cert.ECDSA, ok: true, want: cert.RSA},
+		{d: kubetoken.Discovery{APIVersion: "v2", KeyTypes: []string{"rsa"}}, keyType: cert.RSA, ok: false},
+		{d: kubetoken.Discovery{APIVersion: "v1", KeyTypes: []string{"ecdsa"}}, keyType: cert.ECDSA, ok: true, want: cert.ECDSA},
+		{d: kubetoken.Discovery{APIVersion: "v1", KeyTypes: []string{"ecdsa", "rsa"}}, keyType: cert.Ed25519, ok: true, want: cert.RSA},
+		{d: kubetoken.Discovery{APIVersion: "v1", KeyTypes: []string{"ecdsa"}}, keyType: cert.RSA, ok: false},
+	}
+	for i, tt := range tests {
+		keyType := tt.keyType
+		err := negotiate(&tt.d, &tt.creds, time.Hour, &keyType)
+		if (err == nil) != tt.ok {
+			t.Errorf("%d: got err %v, want ok %v", i, err, tt.ok)
+			continue
+		}
+		if err == nil && keyType != tt.want {
+			t.Errorf("%d: got key type %q, want %q", i, keyType, tt.want)
+		}
+	}
+}
@@ -14,7 +14,9 @@ import (
 	"regexp"
 	"runtime"
 	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"gopkg.in/alecthomas/kingpin.v2"
 
@@ -24,6 +26,7 @@ import (
 )
 
 // this value can be overwritten by -ldflags="-X main.kubetokend=$URL"
+// or at runtime with $KUBETOKEN_HOST.
 var kubetokend = "https://kubetoken.example.com"
 
 var (
@@ -63,29 +66,165 @@ func main() {
 		version      = kingpin.Flag("version", "print version string and exit.").Bool()
 		filter       = kingpin.Flag("filter", "only show roles which matches supplied regex.").Short('f').String()
 		namespace    = kingpin.Flag("namespace", "override namespace.").Short('n').String()
-		host         = kingpin.Flag("host", "kubetokend hostname.").Short('h').Default(kubetokend).String()
+		host         = kingpin.Flag("host", "kubetokend hostname.").Short('h').Default(os.Getenv("KUBETOKEN_HOST")).String()
 		pass         = kingpin.Flag("password", "password.").Short('P').Default(os.Getenv("KUBETOKEN_PW")).String()
 		passPrompt   = kingpin.Flag("password-prompt", "prompt for password (replaces current password in keyring)").Bool()
 		skipKeyring  = kingpin.Flag("skip-keyring", "skip usage of the keyring").Bool()
+		token        = kingpin.Flag("token", "OpenID Connect ID token, used in place of a password.").Default(os.Getenv("KUBETOKEN_TOKEN")).String()
+		tokenFile    = kingpin.Flag("token-file", "file containing an OpenID Connect ID token, used in place of a password.").String()
+		ttl          = kingpin.Flag("ttl", "requested certificate lifetime, subject to server policy.").Duration()
+		keyType      = kingpin.Flag("keytype", "type of key to generate; ecdsa, ed25519, or rsa. Servers which accept only rsa are sent rsa keys.").Default(cert.ECDSA).Enum(cert.ECDSA, cert.Ed25519, cert.RSA)
+		mfaMethod    = kingpin.Flag("mfa-method", "second factor to use when one is required; push, passcode, or phone.").Default(os.Getenv("KUBETOKEN_MFA_METHOD")).String()
+		passcode     = kingpin.Flag("passcode", "one time passcode to use when a second factor is required.").String()
+		noSession    = kingpin.Flag("no-session", "authenticate each request with the password, rather than a session.").Bool()
+		logout       = kingpin.Flag("logout", "end your cached session, or if there is none or with --password-prompt, all of your sessions, and exit.").Bool()
+		renew        = kingpin.Flag("renew", "renew an unexpired certificate without a password, within the server's session limit.").Bool()
+		totpEnroll   = kingpin.Flag("totp-enroll", "enroll for TOTP and print the secret to add to an authenticator app; replacing a secret requires --passcode.").Bool()
 		keyWordsList = KeyWordsList(kingpin.Arg("keywords", "key words(NOT regex like filter) list used to filter roles. If keywords and filter are used at the same time, both of them need to pass."))
 	)
 	kingpin.Parse()
 
+	if *host == "" {
+		*host = kubetokend
+	}
+
 	if *version {
 		compareVersionsAndExit(*host)
 	}
 
 	checkKubectlOrExit()
 
-	// Retrieve the password
-	if *pass == "" {
-		*pass = getPassword(*user, *passPrompt, *skipKeyring)
+	creds := credentials{user: *user, token: *token}
+	if *tokenFile != "" {
+		b, err := ioutil.ReadFile(*tokenFile)
+		check(err)
+		creds.token = strings.TrimSpace(string(b))
 	}
 
-	// fetch available roles to check the staffid password
-	// provided
-	roles, err := fetchRoles(*host, *user, *pass)
+	// learn what the server supports before prompting for a password
+	// it may not accept.
+	discovery, err := fetchDiscovery(*host)
 	check(err)
+	check(negotiate(discovery, &creds, *ttl, keyType))
+
+	if *renew {
+		if discovery.Endpoints.Renew == "" {
+			fatalf("%s does not support renewal", *host)
+		}
+		certs, err := renewableCerts(*kubeconfig, *user)
+		check(err)
+		var roles []string
+		for role := range certs {
+			roles = append(roles, role)
+		}
+		roles, err = filterRoles(roles, *filter, *keyWordsList)
+		check(err)
+		sort.Strings(roles)
+		var role string
+		switch len(roles) {
+		case 0:
+			fatalf("no unexpired certificate to renew; run kubetoken without --renew to log in")
+		case 1:
+			role = roles[0]
+			fmt.Printf("Auto selecting matching role: %s\n", role)
+		default:
+			role, err = chooseRole(roles)
+			check(err)
+		}
+		// the renewal is for the user the certificate was issued to.
+		renewing := certs[role]
+		csr, privkey, err := cert.NewCSR(renewing.user, role, *keyType)
+		check(err)
+		uri := *host + discovery.Endpoints.Renew
+		if *ttl > 0 {
+			uri += "?ttl=" + url.QueryEscape(ttl.String())
+		}
+		result, err := renewCertificate(uri, renewing.path, csr)
+		check(err)
+		result.Files[fmt.Sprintf("%s-key.pem", result.Username)] = privkey
+		check(processCertificateResponse(*kubeconfig, result, *namespace))
+		if result.Expires != nil {
+			fmt.Printf("Credentials for %s expire at %s\n", result.Role, result.Expires.Local().Format(time.RFC1123))
+		}
+		os.Exit(0)
+	}
+
+	mfa := &mfaOptions{
+		endpoint: *host + discovery.Endpoints.MFA,
+		method:   *mfaMethod,
+		passcode: *passcode,
+	}
+	if discovery.Endpoints.MFA == "" {
+		mfa.endpoint = *host + "/api/v1/mfa"
+	}
+
+	// a session, once started, stands in for the password and second
+	// factor until it expires. Enrolling for TOTP must not wait on a
+	// second factor the user may not yet have.
+	useSession := discovery.Endpoints.Session != "" && !*noSession && !*totpEnroll
+	if *logout && discovery.Endpoints.Session == "" {
+		fatalf("%s does not support sessions", *host)
+	}
+	cached := false
+	if useSession && !*passPrompt && !*skipKeyring {
+		if s := cachedSession(*host, *user); s != nil {
+			creds.session = s.Token
+			cached = true
+		}
+	}
+	login := func() {
+		// Retrieve the password
+		if creds.token == "" {
+			if *pass == "" {
+				*pass = getPassword(*user, *passPrompt, *skipKeyring)
+			}
+			creds.pass = *pass
+		}
+		if useSession && !*logout {
+			s, err := startSession(*host+discovery.Endpoints.Session, &creds, mfa)
+			check(err)
+			creds.session = s.Token
+			if !*skipKeyring {
+				cacheSession(*host, *user, s)
+			}
+		}
+	}
+	if creds.session == "" {
+		login()
+	}
+
+	if *logout {
+		forgetSession(*host, *user)
+		check(endSession(*host+discovery.Endpoints.Session, &creds))
+		os.Exit(0)
+	}
+
+	if *totpEnroll {
+		if discovery.Endpoints.TOTP == "" {
+			fatalf("%s does not support TOTP", *host)
+		}
+		e, err := enrollTOTP(*host+discovery.Endpoints.TOTP, &creds, *passcode)
+		check(err)
+		fmt.Printf("Add this secret to your authenticator app for %s:\n\n\t%s\n\nor open, or make a QR code of,\n\n\t%s\n", e.User, e.Secret, e.URI)
+		os.Exit(0)
+	}
+
+	// fetch available roles to check the credentials provided. The
+	// server reports the username, which for a token, or a login with
+	// an email address, may differ from the local one.
+	remoteUser, roles, err := fetchRoles(*host+discovery.Endpoints.Roles, &creds)
+	if err == errUnauthorized && cached {
+		// the session was revoked, or the server's signing key
+		// replaced, so start another.
+		forgetSession(*host, *user)
+		creds.session = ""
+		login()
+		remoteUser, roles, err = fetchRoles(*host+discovery.Endpoints.Roles, &creds)
+	}
+	check(err)
+	if remoteUser != "" {
+		*user = remoteUser
+	}
 
 	roles, err = filterRoles(roles, *filter, *keyWordsList)
 	check(err)
@@ -105,12 +244,15 @@ func main() {
 	}
 
 	// now we know our name, and the role, generate a csr
-	csr, privkey, err := cert.NewCSR(*user, role)
+	csr, privkey, err := cert.NewCSR(*user, role, *keyType)
 	check(err)
 
 	// send certificate to kubetoken for validation and signature
-	uri := *host + "/api/v1/signcsr"
-	result, err := submitCSR(uri, *user, *pass, csr)
+	uri := *host + discovery.Endpoints.SignCSR
+	if *ttl > 0 {
+		uri += "?ttl=" + url.QueryEscape(ttl.String())
+	}
+	result, err := submitCSR(uri, &creds, csr, mfa)
 	check(err)
 
 	// because we send a CSR to kubetokend, only we know the private key.
@@ -120,50 +262,97 @@ func main() {
 
 	err = processCertificateResponse(*kubeconfig, result, *namespace)
 	check(err)
+
+	if result.Expires != nil {
+		fmt.Printf("Credentials for %s expire at %s\n", result.Role, result.Expires.Local().Format(time.RFC1123))
+	}
+}
+
+// credentials authenticate requests to kubetokend.
+type credentials struct {
+	user, pass string
+	token      string // if set, used in place of user and pass
+	session    string // if set, used in place of all of the above
 }
 
-func fetchRoles(host, user, pass string) ([]string, error) {
+func (c *credentials) authorize(req *http.Request) {
+	if c.session != "" {
+		req.Header.Set("Authorization", kubetoken.SessionScheme+" "+c.session)
+		return
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+		return
+	}
+	req.SetBasicAuth(c.user, c.pass)
+}
+
+// errUnauthorized is returned by fetchRoles if the credentials are not
+// accepted.
+var errUnauthorized = errors.New("remote server replied: 401 Unauthorized")
+
+// fetchRoles returns the authenticated username and their available roles.
+func fetchRoles(uri string, creds *credentials) (string, []string, error) {
 	// fetch available roles for user from kubetokend
-	req, err := http.NewRequest("GET", host+"/api/v1/roles", nil)
+	req, err := http.NewRequest("GET", uri, nil)
 	if err != nil {
-		return nil, err
+		return "", nil, err
 	}
 
-	req.SetBasicAuth(user, pass)
+	creds.authorize(req)
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
-		return nil, err
+		return "", nil, err
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode == 401 {
+		return "", nil, errUnauthorized
+	}
 	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("remote server replied: %v", resp.Status)
+		return "", nil, fmt.Errorf("remote server replied: %v", resp.Status)
 	}
 	dec := json.NewDecoder(resp.Body)
 	var v struct {
+		User  string   `json:"user"`
 		Roles []string `json:"roles"`
 	}
 	if err := dec.Decode(&v); err != nil {
+		return "", nil, err
+	}
+	return v.User, v.Roles, nil
+}
+
+// submitCSR submits csr to uri, answering an MFA challenge with mfa if
+// one is issued.
+func submitCSR(uri string, creds *credentials, csr []byte, mfa *mfaOptions) (*kubetoken.CertificateResponse, error) {
+	resp, err := post(uri, creds, csr, mfa, kubetoken.MFARequestChallenge)
+	if err != nil {
 		return nil, err
 	}
-	return v.Roles, nil
+	defer resp.Body.Close()
+	return decodeResponseBody(resp.Body)
 }
 
-func submitCSR(uri string, user, pass string, csr []byte) (*kubetoken.CertificateResponse, error) {
-	req, err := http.NewRequest("POST", uri, bytes.NewReader(csr))
+// post posts body to uri, answering an MFA challenge with mfa if one is
+// issued, and returns the 200 response. txid is sent in the
+// kubetoken.MFAHeader.
+func post(uri string, creds *credentials, body []byte, mfa *mfaOptions, txid string) (*http.Response, error) {
+	req, err := http.NewRequest("POST", uri, bytes.NewReader(body))
 	if err != nil {
 		return nil, err
 	}
-	req.SetBasicAuth(user, pass)
+	creds.authorize(req)
+	req.Header.Set(kubetoken.MFAHeader, txid)
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
 	switch resp.StatusCode {
 	case 200:
-		return decodeResponseBody(resp.Body)
+		return resp, nil
 	case 399:
+		resp.Body.Close()
 		// this is a special case where the client should be redirected to duo auth endpoint
 		u, err := url.Parse(uri)
 		if err != nil {
@@ -171,8 +360,23 @@ func submitCSR(uri string, user, pass string, csr []byte) (*kubetoken.Certificat
 		}
 		uri = fmt.Sprintf("%s://%s%s", u.Scheme, u.Host, resp.Header.Get("Location"))
 		fmt.Println("Awaiting DUO Auth.")
-		return submitCSR(uri, user, pass, csr)
+		return post(uri, creds, body, mfa, txid)
+	case 401:
+		defer resp.Body.Close()
+		if !strings.HasPrefix(resp.Header.Get("WWW-Authenticate"), kubetoken.MFAScheme) {
+			body, _ := ioutil.ReadAll(resp.Body)
+			return nil, errors.Errorf("expected 200, got %v\n%s", resp.Status, body)
+		}
+		var c kubetoken.MFAChallenge
+		if err := json.NewDecoder(resp.Body).Decode(&c); err != nil {
+			return nil, err
+		}
+		if err := mfa.answer(&c); err != nil {
+			return nil, err
+		}
+		return post(uri, creds, body, mfa, c.Transaction)
 	default:
+		defer resp.Body.Close()
 		body, _ := ioutil.ReadAll(resp.Body)
 		return nil, errors.Errorf("expected 200, got %v\n%s", resp.Status, body)
 	}
@@ -259,17 +463,38 @@ func processCertificateResponse(kubeconfig string, result *kubetoken.Certificate
 	}
 
 	defaultCtx := "\xff" // see explanation below
-	for _, ctx := range result.Contexts {
+	for i, ctx := range result.Contexts {
+		// the clusters of each context may trust a different CA, so
+		// each has its own certificate, sharing the key. The first
+		// context's is kept where older versions put it.
+		ctxdir, ctxcredentials, certfile := certsdir, credentials, usercertfile
+		if i > 0 {
+			ctxdir = filepath.Join(certsdir, strconv.Itoa(i))
+			ctxcredentials = fmt.Sprintf("%s/%d", credentials, i)
+			certfile = filepath.Join(ctxdir, usercert)
+			crt, ok := ctx.Files[usercert]
+			if !ok {
+				// older servers send one certificate for all contexts.
+				crt = result.Files[usercert]
+			}
+			if err := writeFile(certfile, crt); err != nil {
+				return err
+			}
+		}
 		if err := run("kubectl",
 			"--kubeconfig", kubeconfig,
 			"config",
-			"set-credentials", credentials,
+			"set-credentials", ctxcredentials,
 			"--client-key", userkeyfile,
-			"--client-certificate", usercertfile); err != nil {
+			"--client-certificate", certfile); err != nil {
 			return err
 		}
-		cafile := filepath.Join(certsdir, result.Environment, "ca.pem")
-		if err := writeFile(cafile, result.Files["ca.pem"]); err != nil {
+		ca, ok := ctx.Files["ca.pem"]
+		if !ok {
+			ca = result.Files["ca.pem"]
+		}
+		cafile := filepath.Join(ctxdir, result.Environment, "ca.pem")
+		if err := writeFile(cafile, ca); err != nil {
 			return err
 		}
 
@@ -294,7 +519,7 @@ func processCertificateResponse(kubeconfig string, result *kubetoken.Certificate
 				"config",
 				"set-context", context,
 				"--cluster", cluster,
-				"--user", credentials,
+				"--user", ctxcredentials,
 				"--namespace", namespace); err != nil {
 				return err
 			}
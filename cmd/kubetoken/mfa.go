@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/atlassian/kubetoken"
+	"github.com/howeyc/gopass"
+	"github.com/pkg/errors"
+)
+
+// mfaPollInterval is the interval at which a pending MFA transaction is
+// polled.
+const mfaPollInterval = 2 * time.Second
+
+// mfaOptions are the user's choices for answering MFA challenges.
+type mfaOptions struct {
+	endpoint string // URL of the server's MFA endpoint
+	method   string // preferred method, kubetoken.MFAPush by default
+	passcode string // if set, answer with this passcode
+}
+
+// chooseMethod returns the method with which to answer c.
+func (o *mfaOptions) chooseMethod(c *kubetoken.MFAChallenge) (string, error) {
+	method := o.method
+	if o.passcode != "" {
+		method = kubetoken.MFAPasscode
+	}
+	if method == "" {
+		method = kubetoken.MFAPush
+	}
+	if contains(c.Methods, method) {
+		return method, nil
+	}
+	if o.method == "" && o.passcode == "" && len(c.Methods) == 1 {
+		return c.Methods[0], nil
+	}
+	return "", fmt.Errorf("%s does not support MFA method %q, use --mfa-method to choose one of %s", c.Provider, method, strings.Join(c.Methods, ", "))
+}
+
+// answer answers c, and waits until the server has verified the answer.
+func (o *mfaOptions) answer(c *kubetoken.MFAChallenge) error {
+	method, err := o.chooseMethod(c)
+	if err != nil {
+		return err
+	}
+	provider := strings.ToUpper(c.Provider)
+	uri := o.endpoint + "/" + c.Transaction
+	if method != kubetoken.MFAPasscode {
+		if method == kubetoken.MFAPhone {
+			fmt.Printf("Awaiting %s phone call.\n", provider)
+		} else {
+			fmt.Printf("Awaiting %s Auth.\n", provider)
+		}
+		status, err := postMFAAnswer(uri, kubetoken.MFAAnswer{Method: method})
+		if err != nil {
+			return err
+		}
+		for status.Status == kubetoken.MFAPending {
+			if time.Now().After(c.Expires) {
+				return fmt.Errorf("%s authentication timed out", provider)
+			}
+			time.Sleep(mfaPollInterval)
+			if status, err = getMFAStatus(uri); err != nil {
+				return err
+			}
+		}
+		return mfaResult(provider, status)
+	}
+
+	passcode := o.passcode
+	for {
+		if passcode == "" {
+			pw, err := gopass.GetPasswdPrompt(fmt.Sprintf("%s passcode: ", provider), true, os.Stdin, os.Stdout)
+			if err != nil {
+				return err
+			}
+			passcode = string(pw)
+		}
+		status, err := postMFAAnswer(uri, kubetoken.MFAAnswer{Method: method, Passcode: passcode})
+		if err != nil {
+			return err
+		}
+		// prompt again for a mistyped passcode, unless it was
+		// supplied with --passcode.
+		if status.Status == kubetoken.MFAPending && o.passcode == "" {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", provider, status.Message)
+			passcode = ""
+			continue
+		}
+		return mfaResult(provider, status)
+	}
+}
+
+func mfaResult(provider string, status *kubetoken.MFAStatus) error {
+	if status.Status != kubetoken.MFAAllow {
+		return fmt.Errorf("%s authentication denied: %s", provider, status.Message)
+	}
+	return nil
+}
+
+func postMFAAnswer(uri string, answer kubetoken.MFAAnswer) (*kubetoken.MFAStatus, error) {
+	body, err := json.Marshal(answer)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.Post(uri, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	return decodeMFAStatus(resp)
+}
+
+func getMFAStatus(uri string) (*kubetoken.MFAStatus, error) {
+	resp, err := http.Get(uri)
+	if err != nil {
+		return nil, err
+	}
+	return decodeMFAStatus(resp)
+}
+
+// decodeMFAStatus decodes the status in resp. An incorrect passcode is
+// reported with a status, and a 403.
+func decodeMFAStatus(resp *http.Response) (*kubetoken.MFAStatus, error) {
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case 200, 202, 403:
+		var status kubetoken.MFAStatus
+		if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+			return nil, err
+		}
+		return &status, nil
+	default:
+		body, _ := ioutil.ReadAll(resp.Body)
+		return nil, errors.Errorf("expected 200, got %v\n%s", resp.Status, body)
+	}
+}
+
+// enrollTOTP enrolls the user authenticated by creds for TOTP at uri,
+// returning the secret to add to their authenticator app. passcode,
+// from their current secret, is required to replace it.
+func enrollTOTP(uri string, creds *credentials, passcode string) (*kubetoken.TOTPEnrollment, error) {
+	body, err := json.Marshal(kubetoken.TOTPEnrollRequest{Passcode: passcode})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", uri, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	creds.authorize(req)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return nil, errors.Errorf("expected 200, got %v\n%s", resp.Status, body)
+	}
+	var e kubetoken.TOTPEnrollment
+	err = json.NewDecoder(resp.Body).Decode(&e)
+	return &e, err
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/atlassian/kubetoken"
+)
+
+func TestChooseMethod(t *testing.T) {
+	duo := &kubetoken.MFAChallenge{Provider: "duo", Methods: []string{kubetoken.MFAPush, kubetoken.MFAPasscode, kubetoken.MFAPhone}}
+	totp := &kubetoken.MFAChallenge{Provider: "totp", Methods: []string{kubetoken.MFAPasscode}}
+	tests := []struct {
+		opts mfaOptions
+		c    *kubetoken.MFAChallenge
+		want string // empty if an error is expected
+	}{
+		{opts: mfaOptions{}, c: duo, want: kubetoken.MFAPush},
+		{opts: mfaOptions{method: kubetoken.MFAPhone}, c: duo, want: kubetoken.MFAPhone},
+		{opts: mfaOptions{passcode: "123456"}, c: duo, want: kubetoken.MFAPasscode},
+		{opts: mfaOptions{}, c: totp, want: kubetoken.MFAPasscode},
+		{opts: mfaOptions{method: kubetoken.MFAPush}, c: totp},
+	}
+	for i, tt := range tests {
+		got, err := tt.opts.chooseMethod(tt.c)
+		if got != tt.want || (err == nil) != (tt.want != "") {
+			t.Errorf("%d: got %q, %v, want %q", i, got, err, tt.want)
+		}
+	}
+}
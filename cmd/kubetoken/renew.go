@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/atlassian/kubetoken"
+	"github.com/pkg/errors"
+)
+
+// renewable is an unexpired certificate which may be renewed.
+type renewable struct {
+	path string
+	user string // the certificate's common name
+}
+
+// renewableCerts returns, by role, the unexpired certificates beside
+// kubeconfig. Certificates are found by their subject rather than the
+// local user name, which may differ from the user they were issued to;
+// should a role hold certificates for several users, that of user is
+// preferred.
+func renewableCerts(kubeconfig, user string) (map[string]renewable, error) {
+	paths, err := filepath.Glob(filepath.Join(filepath.Dir(kubeconfig), "certs", "*", "*.pem"))
+	if err != nil {
+		return nil, err
+	}
+	certs := make(map[string]renewable)
+	for _, path := range paths {
+		if strings.HasSuffix(path, "-key.pem") {
+			continue
+		}
+		crt, err := tls.LoadX509KeyPair(path, keyFile(path))
+		if err != nil {
+			continue
+		}
+		leaf, err := x509.ParseCertificate(crt.Certificate[0])
+		if err != nil || time.Now().After(leaf.NotAfter) {
+			continue
+		}
+		role := filepath.Base(filepath.Dir(path))
+		if c, ok := certs[role]; ok && c.user == user {
+			continue
+		}
+		certs[role] = renewable{path: path, user: leaf.Subject.CommonName}
+	}
+	return certs, nil
+}
+
+// keyFile returns the path of the private key of the certificate at
+// path.
+func keyFile(path string) string {
+	return path[:len(path)-len(".pem")] + "-key.pem"
+}
+
+// renewCertificate posts csr to uri, proving possession of the
+// certificate at certfile by presenting it as the TLS client
+// certificate and signing the request with its key.
+func renewCertificate(uri, certfile string, csr []byte) (*kubetoken.CertificateResponse, error) {
+	crt, err := tls.LoadX509KeyPair(certfile, keyFile(certfile))
+	if err != nil {
+		return nil, err
+	}
+	key, ok := crt.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, errors.Errorf("%s: unsupported key type %T", certfile, crt.PrivateKey)
+	}
+	date := time.Now().UTC().Format(time.RFC3339)
+	sig, err := kubetoken.SignRenewProof(key, date, csr)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("POST", uri, bytes.NewReader(csr))
+	if err != nil {
+		return nil, err
+	}
+	// the server may not ask for client certificates, or may sit behind
+	// a proxy which terminates TLS, so the proof is sent in the headers
+	// as well.
+	req.Header.Set(kubetoken.RenewCertificateHeader, base64.StdEncoding.EncodeToString(crt.Certificate[0]))
+	req.Header.Set(kubetoken.RenewDateHeader, date)
+	req.Header.Set(kubetoken.RenewSignatureHeader, base64.StdEncoding.EncodeToString(sig))
+	client := &http.Client{
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{Certificates: []tls.Certificate{crt}},
+		},
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return nil, errors.Errorf("expected 200, got %v\n%s", resp.Status, body)
+	}
+	return decodeResponseBody(resp.Body)
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/atlassian/kubetoken/internal/cert"
+)
+
+func TestRenewableCerts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "renew_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	write := func(role, name, cn string, expiry time.Time) string {
+		certPEM, keyPEM, err := cert.NewCA(cn, expiry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		certsdir := filepath.Join(dir, "certs", role)
+		if err := os.MkdirAll(certsdir, 0700); err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(certsdir, name+".pem")
+		if err := ioutil.WriteFile(path, certPEM, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(keyFile(path), keyPEM, 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	valid := time.Now().Add(time.Hour)
+	dev := write("kube-example-web-dev-dl-dev", "dcheney", "dcheney", valid)
+	// certificates are found by their subject, not the local user.
+	prod := write("kube-example-web-prod-dl-prod", "dave", "dave", valid)
+	write("kube-example-web-stg-dl-stg", "dcheney", "dcheney", time.Now().Add(-time.Hour))
+	// files without a key, such as the cluster's CA, are ignored.
+	if err := ioutil.WriteFile(filepath.Join(dir, "certs", "kube-example-web-dev-dl-dev", "ca.pem"), []byte("ca"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := renewableCerts(filepath.Join(dir, "config"), "dcheney")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]renewable{
+		"kube-example-web-dev-dl-dev":   {path: dev, user: "dcheney"},
+		"kube-example-web-prod-dl-prod": {path: prod, user: "dave"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
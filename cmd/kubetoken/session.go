@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/atlassian/kubetoken"
+	"github.com/pkg/errors"
+	"github.com/zalando/go-keyring"
+)
+
+// sessionKeyringService is the keyring service under which sessions are
+// cached, by user and host.
+const sessionKeyringService = "kubetoken-session"
+
+// sessionMargin is the remaining lifetime below which a cached session
+// is not used, so that it does not expire part way through a run.
+const sessionMargin = time.Minute
+
+func sessionAccount(host, user string) string {
+	return user + "@" + host
+}
+
+// cachedSession returns the session for user at host from the keyring,
+// or nil if there is none or it is about to expire.
+func cachedSession(host, user string) *kubetoken.Session {
+	v, err := keyring.Get(sessionKeyringService, sessionAccount(host, user))
+	if err != nil {
+		if *verbose && err != keyring.ErrNotFound {
+			fmt.Printf("Warning: error whilst getting session from keyring: %v\n", err)
+		}
+		return nil
+	}
+	var s kubetoken.Session
+	if err := json.Unmarshal([]byte(v), &s); err != nil || time.Until(s.Expires) < sessionMargin {
+		return nil
+	}
+	return &s
+}
+
+// cacheSession stores s for user at host in the keyring.
+func cacheSession(host, user string, s *kubetoken.Session) {
+	v, err := json.Marshal(s)
+	if err == nil {
+		err = keyring.Set(sessionKeyringService, sessionAccount(host, user), string(v))
+	}
+	if *verbose && err != nil {
+		fmt.Printf("Warning: error whilst setting session in keyring: %v\n", err)
+	}
+}
+
+// forgetSession removes any session for user at host from the keyring.
+func forgetSession(host, user string) {
+	err := keyring.Delete(sessionKeyringService, sessionAccount(host, user))
+	if *verbose && err != nil && err != keyring.ErrNotFound {
+		fmt.Printf("Warning: error whilst deleting session from keyring: %v\n", err)
+	}
+}
+
+// startSession starts a session at uri, answering an MFA challenge with
+// mfa if one is issued.
+func startSession(uri string, creds *credentials, mfa *mfaOptions) (*kubetoken.Session, error) {
+	resp, err := post(uri, creds, nil, mfa, kubetoken.MFARequestChallenge)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var s kubetoken.Session
+	err = json.NewDecoder(resp.Body).Decode(&s)
+	return &s, err
+}
+
+// endSession ends the session with which creds authenticate at uri, or
+// if they are not a session, all of the user's sessions.
+func endSession(uri string, creds *credentials) error {
+	body, err := json.Marshal(kubetoken.SessionRevokeRequest{})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("DELETE", uri, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	creds.authorize(req)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 204 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return errors.Errorf("expected 204, got %v\n%s", resp.Status, body)
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"log/syslog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Audit event names.
+const (
+	auditRoles = "roles" // a user requested the roles available to them
+	auditCSR   = "csr"   // a user submitted a certificate signing request
+	auditMFA   = "mfa"   // a second factor was requested from a user
+	auditSign  = "sign"  // a certificate was issued
+)
+
+// Audit event outcomes.
+const (
+	outcomeReceived = "received"
+	outcomeAllowed  = "allowed"
+	outcomeDenied   = "denied"
+	outcomeIssued   = "issued"
+)
+
+// AuditEvent is a single entry in the audit log.
+type AuditEvent struct {
+	Time        time.Time  `json:"time"`
+	Event       string     `json:"event"`
+	Outcome     string     `json:"outcome"`
+	User        string     `json:"user,omitempty"`
+	Role        string     `json:"role,omitempty"`
+	Customer    string     `json:"customer,omitempty"`
+	Environment string     `json:"environment,omitempty"`
+	Namespace   string     `json:"namespace,omitempty"`
+	Provider    string     `json:"provider,omitempty"`
+	Serial      string     `json:"serial,omitempty"`
+	NotBefore   *time.Time `json:"notbefore,omitempty"`
+	NotAfter    *time.Time `json:"notafter,omitempty"`
+	ClientIP    string     `json:"clientip,omitempty"`
+	UserAgent   string     `json:"useragent,omitempty"`
+	Reason      string     `json:"reason,omitempty"`
+}
+
+// Auditor writes AuditEvents to an append only sink, one JSON object per line.
+// A nil *Auditor discards all events.
+type Auditor struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// newAuditor returns an Auditor which writes to sink. sink may be
+// "stdout", "stderr", "syslog" for the local syslog daemon,
+// "syslog://host:port" for a remote syslog daemon, or the path to a file
+// which will be created if necessary and appended to.
+func newAuditor(sink string) (*Auditor, error) {
+	switch {
+	case sink == "stdout":
+		return &Auditor{w: os.Stdout}, nil
+	case sink == "stderr":
+		return &Auditor{w: os.Stderr}, nil
+	case sink == "syslog":
+		w, err := syslog.New(syslog.LOG_INFO|syslog.LOG_AUTH, "kubetokend")
+		if err != nil {
+			return nil, err
+		}
+		return &Auditor{w: w}, nil
+	case strings.HasPrefix(sink, "syslog://"):
+		u, err := url.Parse(sink)
+		if err != nil {
+			return nil, err
+		}
+		w, err := syslog.Dial("udp", u.Host, syslog.LOG_INFO|syslog.LOG_AUTH, "kubetokend")
+		if err != nil {
+			return nil, err
+		}
+		return &Auditor{w: w}, nil
+	default:
+		f, err := os.OpenFile(sink, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return nil, err
+		}
+		return &Auditor{w: f}, nil
+	}
+}
+
+// Record writes ev to the audit log, and counts it in the request
+// metrics. The time, client address and user agent are taken from req
+// if not already set.
+func (a *Auditor) Record(req *http.Request, ev AuditEvent) {
+	observeEvent(ev)
+	if a == nil {
+		return
+	}
+	if ev.Time.IsZero() {
+		ev.Time = time.Now().UTC()
+	}
+	if req != nil {
+		if ev.ClientIP == "" {
+			ev.ClientIP = clientIP(req)
+		}
+		if ev.UserAgent == "" {
+			ev.UserAgent = req.UserAgent()
+		}
+	}
+	buf, err := json.Marshal(ev)
+	if err != nil {
+		log.Printf("audit: %v", err)
+		return
+	}
+	buf = append(buf, '\n')
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err := a.w.Write(buf); err != nil {
+		log.Printf("audit: %v", err)
+	}
+}
+
+// clientIP returns the address of the client which made req.
+func clientIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAuditorRecord(t *testing.T) {
+	var buf bytes.Buffer
+	a := &Auditor{w: &buf}
+
+	req := httptest.NewRequest("POST", "/api/v1/signcsr", nil)
+	req.RemoteAddr = "192.0.2.1:4321"
+	req.Header.Set("User-Agent", "kubetoken/test")
+
+	a.Record(req, AuditEvent{Event: auditCSR, Outcome: outcomeReceived, User: "dcheney", Role: "kube-example-web-dev-dl-dev"})
+	a.Record(req, AuditEvent{Event: auditSign, Outcome: outcomeDenied, User: "dcheney", Reason: "not a member"})
+
+	dec := json.NewDecoder(&buf)
+	var events []AuditEvent
+	for dec.More() {
+		var ev AuditEvent
+		if err := dec.Decode(&ev); err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, ev)
+	}
+	if len(events) != 2 {
+		t.Fatalf("expected 2 events, got %d", len(events))
+	}
+	for _, ev := range events {
+		if ev.Time.IsZero() {
+			t.Errorf("%s: time not set", ev.Event)
+		}
+		if ev.ClientIP != "192.0.2.1" {
+			t.Errorf("%s: clientip: got %q, want %q", ev.Event, ev.ClientIP, "192.0.2.1")
+		}
+		if ev.UserAgent != "kubetoken/test" {
+			t.Errorf("%s: useragent: got %q, want %q", ev.Event, ev.UserAgent, "kubetoken/test")
+		}
+	}
+	if events[1].Reason != "not a member" {
+		t.Errorf("reason: got %q, want %q", events[1].Reason, "not a member")
+	}
+
+	// a nil Auditor discards events.
+	var nilAuditor *Auditor
+	nilAuditor.Record(req, AuditEvent{Event: auditRoles})
+}
+
+func TestNewAuditorFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+
+	// each auditor appends to, rather than truncates, the log.
+	for i := 0; i < 2; i++ {
+		a, err := newAuditor(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		a.Record(nil, AuditEvent{Event: auditRoles, Outcome: outcomeAllowed, User: "dcheney"})
+	}
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := bytes.Count(buf, []byte("\n")); n != 2 {
+		t.Fatalf("expected 2 lines, got %d: %s", n, buf)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+
+	"github.com/atlassian/kubetoken"
+)
+
+// auditAuth is the audit event recorded when a request fails to
+// authenticate.
+const auditAuth = "auth"
+
+type identityKey struct{}
+
+// Authenticate inserts an authentication middleware before next. The
+// Identity of the authenticated user is available to next from
+// identity. Requests which fail to authenticate are recorded in audit.
+func Authenticate(next http.Handler, auth kubetoken.Authenticator, audit *Auditor) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		id, err := auth.Authenticate(req)
+		if err != nil {
+			user, _, _ := req.BasicAuth()
+			audit.Record(req, AuditEvent{
+				Event:   auditAuth,
+				Outcome: outcomeDenied,
+				User:    user,
+				Reason:  err.Error(),
+			})
+			switch err {
+			case kubetoken.ErrNoCredentials, kubetoken.ErrInvalidCredentials:
+				w.Header().Set("WWW-Authenticate", `Basic realm="Restricted"`)
+				http.Error(w, "Authentication required", 401)
+			default:
+				log.Printf("authentication failed: %v", err)
+				http.Error(w, "authentication unavailable", 503)
+			}
+			return
+		}
+		next.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), identityKey{}, id)))
+	})
+}
+
+// identity returns the Identity of the user authenticated by
+// Authenticate, or nil if the request was not authenticated.
+func identity(req *http.Request) *kubetoken.Identity {
+	id, _ := req.Context().Value(identityKey{}).(*kubetoken.Identity)
+	return id
+}
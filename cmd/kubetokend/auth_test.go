@@ -0,0 +1,48 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/atlassian/kubetoken"
+)
+
+type authenticatorFunc func(req *http.Request) (*kubetoken.Identity, error)
+
+func (f authenticatorFunc) Authenticate(req *http.Request) (*kubetoken.Identity, error) {
+	return f(req)
+}
+
+func TestAuthenticate(t *testing.T) {
+	tests := []struct {
+		id   *kubetoken.Identity
+		err  error
+		code int
+	}{
+		{id: &kubetoken.Identity{User: "dcheney"}, code: 200},
+		{err: kubetoken.ErrNoCredentials, code: 401},
+		{err: kubetoken.ErrInvalidCredentials, code: 401},
+		{err: errors.New("ldap: connection timed out"), code: 503},
+	}
+	for _, tt := range tests {
+		auth := authenticatorFunc(func(*http.Request) (*kubetoken.Identity, error) {
+			return tt.id, tt.err
+		})
+		var got *kubetoken.Identity
+		h := Authenticate(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			got = identity(req)
+		}), auth, &Auditor{w: ioutil.Discard})
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/roles", nil))
+		if w.Code != tt.code {
+			t.Errorf("%v: got code %d, want %d", tt.err, w.Code, tt.code)
+		}
+		if got != tt.id {
+			t.Errorf("%v: got identity %v, want %v", tt.err, got, tt.id)
+		}
+	}
+}
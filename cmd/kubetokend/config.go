@@ -1,35 +1,230 @@
 package main
 
 import (
+	"crypto"
 	"crypto/x509"
 	"encoding/json"
 	"encoding/pem"
 	"io/ioutil"
 	"os"
+	"regexp"
+	"time"
 
 	"github.com/atlassian/kubetoken"
+	"github.com/atlassian/kubetoken/internal/cert"
 	"github.com/pkg/errors"
 )
 
 type Context struct {
-	CAClusterCert    string `json:"caclustercert"` // path to ca cert for kubernetes clusters
-	CACert           string `json:"cacert"` // path to ca cert for kubetoken
-	PrivKey          string `json:"privkey"` // path to ca cert private key for kubetoken
-	caClusterCertPEM []byte // contents of the CAClusterCert file, as PEM.
-	caCertPEM        []byte // contents of the CACert file, as PEM.
+	CAClusterCert    string            `json:"caclustercert"` // path to ca cert for kubernetes clusters
+	CACert           string            `json:"cacert"`        // path to ca cert for kubetoken
+	PrivKey          string            `json:"privkey"`       // path to ca cert private key for kubetoken
+	caClusterCertPEM []byte            // contents of the CAClusterCert file, as PEM.
+	caCertPEM        []byte            // contents of the CACert file, as PEM.
 	Clusters         map[string]string `json:"clusters"`
 	kubetoken.Signer `json:"-"`
 }
 
+// defaultTTL is the lifetime of certificates issued for environments
+// which do not specify a TTL policy.
+const defaultTTL = 6 * time.Hour
+
 type Environment struct {
-	Name        string `json:"name"`
-	Customer    string `json:"customer"`
-	Environment string `json:"env"`
+	Name        string    `json:"name"`
+	Customer    string    `json:"customer"`
+	Environment string    `json:"env"`
 	Contexts    []Context `json:"contexts"`
+
+	// TTL is the certificate lifetime policy for this environment.
+	TTL TTLPolicy `json:"ttl,omitempty"`
+
+	// Roles optionally override the environment's policy for roles
+	// whose name matches a pattern. The first match wins.
+	Roles []RolePolicy `json:"roles,omitempty"`
+
+	// MFA is the MFA policy for this environment; one of required,
+	// optional, or forbidden. If empty, kubetokend's --mfapolicy is
+	// used.
+	MFA string `json:"mfa,omitempty"`
+
+	// MaxSession is the longest time after a user last gave their
+	// credentials for which their certificates may be renewed. If zero,
+	// certificates in this environment are not renewed.
+	MaxSession Duration `json:"maxsession,omitempty"`
+
+	// MFAProvider names the MFA provider, for example duo or totp,
+	// which verifies users requesting roles in this environment. If
+	// empty, kubetokend's --mfaprovider is used.
+	MFAProvider string `json:"mfaprovider,omitempty"`
+}
+
+// MFA policies.
+const (
+	mfaRequired  = "required"  // a second factor is required
+	mfaOptional  = "optional"  // a second factor is required of clients which support MFA challenges
+	mfaForbidden = "forbidden" // no second factor is requested
+)
+
+// validMFAPolicy checks policy is a known MFA policy, or unset.
+func validMFAPolicy(policy string) error {
+	switch policy {
+	case "", mfaRequired, mfaOptional, mfaForbidden:
+		return nil
+	default:
+		return errors.Errorf("unknown mfa policy %q, expected required, optional, or forbidden", policy)
+	}
+}
+
+// TTLPolicy bounds the lifetime of issued certificates. Zero values
+// are inherited from the enclosing policy.
+type TTLPolicy struct {
+	Default Duration `json:"default,omitempty"` // lifetime used when the client does not request one
+	Max     Duration `json:"max,omitempty"`     // upper bound on a requested lifetime
+}
+
+// clamp returns the lifetime to grant for a request of d.
+// If d is zero the default lifetime is returned.
+func (p TTLPolicy) clamp(d time.Duration) time.Duration {
+	switch {
+	case d <= 0:
+		return p.Default.Duration
+	case d > p.Max.Duration:
+		return p.Max.Duration
+	default:
+		return d
+	}
+}
+
+// RolePolicy applies to roles whose name matches Pattern.
+type RolePolicy struct {
+	Pattern string    `json:"pattern"` // regular expression matched against the role name
+	TTL     TTLPolicy `json:"ttl,omitempty"`
+	MFA     string    `json:"mfa,omitempty"` // overrides the environment's MFA policy, if set
+
+	re *regexp.Regexp
+}
+
+// ttlPolicy returns the effective TTL policy for role in e.
+func (e *Environment) ttlPolicy(role string) TTLPolicy {
+	for _, r := range e.Roles {
+		if r.re != nil && r.re.MatchString(role) {
+			return e.TTL.inherit(r.TTL)
+		}
+	}
+	return e.TTL.inherit(TTLPolicy{})
+}
+
+// mfaPolicy returns the MFA policy for role in e, or the empty string
+// if neither e nor the first role pattern matching role set one.
+func (e *Environment) mfaPolicy(role string) string {
+	for _, r := range e.Roles {
+		if r.re != nil && r.re.MatchString(role) {
+			if r.MFA != "" {
+				return r.MFA
+			}
+			break
+		}
+	}
+	return e.MFA
+}
+
+// requiresMFA reports whether any environment, or role pattern, of c
+// requires a second factor.
+func (c *Config) requiresMFA() bool {
+	for i := range c.Environments {
+		e := &c.Environments[i]
+		if e.MFA == mfaRequired || e.MFA == mfaOptional {
+			return true
+		}
+		for _, r := range e.Roles {
+			if r.MFA == mfaRequired || r.MFA == mfaOptional {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// maxTTL returns the longest lifetime granted to certificates for any
+// role in e.
+func (e *Environment) maxTTL() time.Duration {
+	max := e.TTL.inherit(TTLPolicy{}).Max.Duration
+	for _, r := range e.Roles {
+		if d := e.TTL.inherit(r.TTL).Max.Duration; d > max {
+			max = d
+		}
+	}
+	return max
+}
+
+// inherit returns the policy o, with zero values inherited from p, and
+// then defaultTTL. A max, once set, is never raised; a default above it
+// is lowered to it.
+func (p TTLPolicy) inherit(o TTLPolicy) TTLPolicy {
+	if o.Default.Duration > 0 {
+		p.Default = o.Default
+	}
+	if o.Max.Duration > 0 {
+		p.Max = o.Max
+	}
+	if p.Default.Duration <= 0 {
+		p.Default.Duration = defaultTTL
+	}
+	switch {
+	case p.Max.Duration <= 0:
+		p.Max = p.Default
+	case p.Default.Duration > p.Max.Duration:
+		p.Default = p.Max
+	}
+	return p
+}
+
+// Duration is a time.Duration which is represented in JSON as a string,
+// for example "6h" or "90m".
+type Duration struct {
+	time.Duration
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
 }
 
 type Config struct {
 	Environments []Environment `json:"environments"`
+
+	// AdminGroups lists the groups whose members may use the
+	// administrative API, for example to revoke certificates.
+	AdminGroups []string `json:"admingroups,omitempty"`
+
+	// Directory describes where users and groups are found, and how
+	// roles are named. It is read at startup; unset fields default to
+	// the values kubetokend was built with.
+	Directory kubetoken.Directory `json:"directory,omitempty"`
+}
+
+// environment returns the Environment for customer and env, or nil
+// if there is no such environment.
+func (c *Config) environment(customer, env string) *Environment {
+	for i := range c.Environments {
+		e := &c.Environments[i]
+		if e.Customer == customer && e.Environment == env {
+			return e
+		}
+	}
+	return nil
 }
 
 func loadConfig(p string) (*Config, error) {
@@ -47,6 +242,62 @@ func loadConfig(p string) (*Config, error) {
 	return &config, nil
 }
 
+// validate checks c for errors that would otherwise only be detected
+// when a request is served, and compiles any role patterns.
+// mfaProviders are the names of the configured MFA providers, which
+// environments may name.
+func (c *Config) validate(mfaProviders []string) error {
+	if _, err := regexp.Compile(c.Directory.NamespaceRegex); err != nil {
+		return errors.WithMessage(err, "directory: namespaceregex")
+	}
+	if c.requiresMFA() && len(mfaProviders) == 0 {
+		return errors.New("MFA is required by the config, but no MFA provider is configured")
+	}
+	for i := range c.Environments {
+		e := &c.Environments[i]
+		if len(e.Contexts) == 0 {
+			return errors.Errorf("%s/%s: no contexts defined", e.Customer, e.Environment)
+		}
+		if err := e.TTL.validate(); err != nil {
+			return errors.WithMessage(err, e.Customer+"/"+e.Environment)
+		}
+		if err := validMFAPolicy(e.MFA); err != nil {
+			return errors.WithMessage(err, e.Customer+"/"+e.Environment)
+		}
+		if e.MFAProvider != "" && !contains(mfaProviders, e.MFAProvider) {
+			return errors.Errorf("%s/%s: MFA provider %q is not configured", e.Customer, e.Environment, e.MFAProvider)
+		}
+		if e.MaxSession.Duration < 0 {
+			return errors.Errorf("%s/%s: maxsession must not be negative", e.Customer, e.Environment)
+		}
+		for j := range e.Roles {
+			r := &e.Roles[j]
+			re, err := regexp.Compile(r.Pattern)
+			if err != nil {
+				return errors.WithMessage(err, e.Customer+"/"+e.Environment)
+			}
+			r.re = re
+			if err := r.TTL.validate(); err != nil {
+				return errors.WithMessage(err, e.Customer+"/"+e.Environment+": "+r.Pattern)
+			}
+			if err := validMFAPolicy(r.MFA); err != nil {
+				return errors.WithMessage(err, e.Customer+"/"+e.Environment+": "+r.Pattern)
+			}
+		}
+	}
+	return nil
+}
+
+func (p *TTLPolicy) validate() error {
+	if p.Default.Duration < 0 || p.Max.Duration < 0 {
+		return errors.New("ttl must not be negative")
+	}
+	if p.Max.Duration > 0 && p.Default.Duration > p.Max.Duration {
+		return errors.Errorf("default ttl %v exceeds max ttl %v", p.Default, p.Max)
+	}
+	return nil
+}
+
 func loadCertificates(c *Config) error {
 	for i := range c.Environments {
 		e := &c.Environments[i]
@@ -75,9 +326,15 @@ func loadCertificates(c *Config) error {
 			if block == nil {
 				return errors.Errorf("%v: pem decode privKeyPEM failed", ctx.PrivKey)
 			}
-			ctx.Signer.PrivKey, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+			ctx.Signer.PrivKey, err = cert.ParsePrivateKey(block.Bytes)
 			if err != nil {
-				return err
+				return errors.WithMessage(err, ctx.PrivKey)
+			}
+			pub, ok := ctx.Signer.PrivKey.Public().(interface {
+				Equal(crypto.PublicKey) bool
+			})
+			if !ok || !pub.Equal(ctx.Signer.Cert.PublicKey) {
+				return errors.Errorf("%v: private key does not match the certificate %v", ctx.PrivKey, ctx.CACert)
 			}
 
 			if ctx.CAClusterCert != "" {
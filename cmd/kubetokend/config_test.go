@@ -9,6 +9,9 @@ import (
 	"strings"
 	"syscall"
 	"testing"
+	"time"
+
+	"github.com/atlassian/kubetoken"
 )
 
 func TestLoadConfig(t *testing.T) {
@@ -124,6 +127,47 @@ func TestLoadConfig(t *testing.T) {
 				}},
 			}},
 		},
+	}, {
+		path: mkjson(`{
+			  "environments": [
+			      {
+				  "customer": "example",
+				  "env": "prod",
+				  "ttl": { "default": "1h", "max": "4h" },
+				  "maxsession": "12h",
+				  "roles": [
+				     { "pattern": "-breakglass-", "ttl": { "default": "15m", "max": "30m" } }
+				  ],
+				  "contexts": [
+				     {
+					"cacert": "/ssl/example-prod/ca.pem",
+					"privkey": "/ssl/example-prod/ca-key.pem"
+				     }
+				  ]
+			      }]
+		         }`),
+		want: &Config{
+			Environments: []Environment{{
+				Customer:    "example",
+				Environment: "prod",
+				TTL: TTLPolicy{
+					Default: Duration{time.Hour},
+					Max:     Duration{4 * time.Hour},
+				},
+				MaxSession: Duration{12 * time.Hour},
+				Roles: []RolePolicy{{
+					Pattern: "-breakglass-",
+					TTL: TTLPolicy{
+						Default: Duration{15 * time.Minute},
+						Max:     Duration{30 * time.Minute},
+					},
+				}},
+				Contexts: []Context{{
+					CACert:  "/ssl/example-prod/ca.pem",
+					PrivKey: "/ssl/example-prod/ca-key.pem",
+				}},
+			}},
+		},
 	}}
 
 	for i, tt := range tests {
@@ -139,6 +183,167 @@ func TestLoadConfig(t *testing.T) {
 	}
 }
 
+func TestTTLPolicy(t *testing.T) {
+	c := Config{
+		Environments: []Environment{{
+			Contexts: []Context{{}},
+			TTL: TTLPolicy{
+				Default: Duration{time.Hour},
+				Max:     Duration{4 * time.Hour},
+			},
+			Roles: []RolePolicy{{
+				Pattern: "-breakglass-",
+				TTL: TTLPolicy{
+					Default: Duration{15 * time.Minute},
+				},
+			}},
+		}, {
+			// an environment without a policy issues certificates for defaultTTL.
+			Contexts: []Context{{}},
+			Roles: []RolePolicy{{
+				// a role which sets only a max below the inherited
+				// default is issued certificates for at most max.
+				Pattern: "-admin$",
+				TTL: TTLPolicy{
+					Max: Duration{30 * time.Minute},
+				},
+			}},
+		}},
+	}
+	if err := c.validate(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		env       *Environment
+		role      string
+		requested time.Duration
+		want      time.Duration
+	}{
+		{&c.Environments[0], "kube-example-web-prod-dl-dev", 0, time.Hour},
+		{&c.Environments[0], "kube-example-web-prod-dl-dev", 2 * time.Hour, 2 * time.Hour},
+		{&c.Environments[0], "kube-example-web-prod-dl-dev", 24 * time.Hour, 4 * time.Hour},
+		{&c.Environments[0], "kube-example-web-prod-dl-breakglass-admin", 0, 15 * time.Minute},
+		{&c.Environments[0], "kube-example-web-prod-dl-breakglass-admin", 3 * time.Hour, 3 * time.Hour},
+		{&c.Environments[1], "kube-example-web-dev-dl-dev", 0, defaultTTL},
+		{&c.Environments[1], "kube-example-web-dev-dl-dev", 24 * time.Hour, defaultTTL},
+		{&c.Environments[1], "kube-example-web-dev-dl-admin", 0, 30 * time.Minute},
+		{&c.Environments[1], "kube-example-web-dev-dl-admin", 24 * time.Hour, 30 * time.Minute},
+	}
+	for i, tt := range tests {
+		got := tt.env.ttlPolicy(tt.role).clamp(tt.requested)
+		if got != tt.want {
+			t.Errorf("%d: ttlPolicy(%q).clamp(%v): got %v, want %v", i, tt.role, tt.requested, got, tt.want)
+		}
+	}
+
+	// the longest lifetime in an environment is not raised by a role
+	// which lowers the max.
+	if got := c.Environments[1].maxTTL(); got != defaultTTL {
+		t.Errorf("maxTTL: got %v, want %v", got, defaultTTL)
+	}
+	e := Environment{Roles: []RolePolicy{{TTL: TTLPolicy{Max: Duration{30 * time.Minute}}}}, TTL: TTLPolicy{Max: Duration{time.Hour}}}
+	if got := e.maxTTL(); got != time.Hour {
+		t.Errorf("maxTTL: got %v, want %v", got, time.Hour)
+	}
+}
+
+func TestMFAPolicy(t *testing.T) {
+	c := Config{
+		Environments: []Environment{{
+			Contexts: []Context{{}},
+			MFA:      mfaRequired,
+			Roles: []RolePolicy{{
+				Pattern: "-readonly$",
+				MFA:     mfaOptional,
+			}, {
+				Pattern: "-dl-",
+			}},
+		}, {
+			Contexts: []Context{{}},
+		}},
+	}
+	if err := c.validate(nil); err == nil {
+		t.Errorf("expected a config requiring MFA without an MFA provider to be rejected")
+	}
+	if err := c.validate([]string{"duo"}); err != nil {
+		t.Fatal(err)
+	}
+	if !c.requiresMFA() {
+		t.Errorf("requiresMFA: got false, want true")
+	}
+
+	tests := []struct {
+		env  *Environment
+		role string
+		want string
+	}{
+		{&c.Environments[0], "kube-example-web-prod-readonly", mfaOptional},
+		{&c.Environments[0], "kube-example-web-prod-dl-dev", mfaRequired},
+		{&c.Environments[0], "kube-example-web-prod-admin", mfaRequired},
+		{&c.Environments[1], "kube-example-web-dev-dl-dev", ""},
+	}
+	for i, tt := range tests {
+		if got := tt.env.mfaPolicy(tt.role); got != tt.want {
+			t.Errorf("%d: mfaPolicy(%q): got %q, want %q", i, tt.role, got, tt.want)
+		}
+	}
+
+	c.Environments[1].MFAProvider = "totp"
+	if err := c.validate([]string{"duo"}); err == nil {
+		t.Errorf("expected an MFA provider which is not configured to be rejected")
+	}
+	c.Environments[1].MFAProvider = ""
+
+	c.Environments[0].Roles[1].MFA = "sometimes"
+	if err := c.validate([]string{"duo"}); err == nil {
+		t.Errorf("expected unknown mfa policy to be rejected")
+	}
+}
+
+func TestDirectoryConfig(t *testing.T) {
+	var c Config
+	buf := `{"directory": {"searchbase": "DC=corp,DC=example,DC=com", "userou": "OU=staff"}}`
+	if err := json.Unmarshal([]byte(buf), &c); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.validate(nil); err != nil {
+		t.Fatal(err)
+	}
+	got := c.Directory.Override(kubetoken.Directory{UserOU: "OU=people"}).WithDefaults()
+	if got.SearchBase != "DC=corp,DC=example,DC=com" || got.UserOU != "OU=people" || got.GroupOU != kubetoken.GroupOU {
+		t.Errorf("got %+v", got)
+	}
+
+	c.Directory.NamespaceRegex = "^kube-(?P<customer>"
+	if err := c.validate(nil); err == nil {
+		t.Errorf("expected invalid namespaceregex to be rejected")
+	}
+}
+
+func TestLoadCertificatesKeyMismatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kubetokend_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	_, key := writeKeyPair(t, dir, "other CA")
+
+	c := &Config{
+		Environments: []Environment{{
+			Customer:    "example",
+			Environment: "dev",
+			Contexts: []Context{{
+				CACert:  "../../internal/cert/_testdata/ssl/ca.pem",
+				PrivKey: key,
+			}},
+		}},
+	}
+	if err := loadCertificates(c); err == nil {
+		t.Fatal("expected a CA key which does not match its certificate to be rejected")
+	}
+}
+
 func jsonError(buf string, v ...interface{}) error {
 	var m interface{}
 	if len(v) > 0 {
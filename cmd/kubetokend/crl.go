@@ -0,0 +1,151 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/atlassian/kubetoken/internal/cert"
+	"github.com/gorilla/mux"
+)
+
+// CRLPublisher maintains a signed CRL for the CA of each context.
+// A CRL is regenerated when it is requested after a certificate has
+// been revoked, or after Interval has elapsed since it was generated.
+type CRLPublisher struct {
+	Registry *Registry
+	Interval time.Duration
+
+	mu     sync.Mutex
+	crls   map[string]*signedCRL // keyed by issuerID
+	warned map[string]bool       // issuerIDs of CAs which cannot sign CRLs, once logged
+}
+
+// errNoCRLSign is returned by CRLPublisher.CRL for a CA whose key usage
+// does not permit it to sign CRLs; no CRL is published for it.
+var errNoCRLSign = errors.New("CA certificate does not permit CRL signing, reissue it with the cRLSign key usage to publish a CRL")
+
+type signedCRL struct {
+	der         []byte
+	revocations int       // number of revocations in the registry when generated
+	refresh     time.Time // time after which the CRL should be regenerated
+}
+
+// CRL returns the current DER encoded CRL for the CA of ctx.
+func (p *CRLPublisher) CRL(ctx *Context) ([]byte, error) {
+	if !cert.CanSignCRLs(ctx.Signer.Cert) {
+		return nil, errNoCRLSign
+	}
+	n, err := p.Registry.Revocations()
+	if err != nil {
+		return nil, err
+	}
+	id := issuerID(ctx.Signer.Cert)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	if c, ok := p.crls[id]; ok && c.revocations == n && now.Before(c.refresh) {
+		return c.der, nil
+	}
+	revoked, err := p.Registry.Revoked(id)
+	if err != nil {
+		return nil, err
+	}
+	// the CRL number must increase with each CRL issued by a CA,
+	// including those issued by other kubetokend instances.
+	number := big.NewInt(now.UnixNano())
+	der, err := cert.CreateCRL(ctx.Signer.Cert, ctx.Signer.PrivKey, revoked, number, now, now.Add(2*p.Interval))
+	if err != nil {
+		return nil, err
+	}
+	if p.crls == nil {
+		p.crls = make(map[string]*signedCRL)
+	}
+	p.crls[id] = &signedCRL{
+		der:         der,
+		revocations: n,
+		refresh:     now.Add(p.Interval),
+	}
+	return der, nil
+}
+
+// Run regenerates the CRL of every context in the current configuration
+// each Interval. Run does not return.
+func (p *CRLPublisher) Run(src configSource) {
+	for {
+		c := src.Current()
+		for i := range c.Environments {
+			e := &c.Environments[i]
+			for j := range e.Contexts {
+				ctx := &e.Contexts[j]
+				_, err := p.CRL(ctx)
+				switch {
+				case err == errNoCRLSign:
+					if p.warnOnce(issuerID(ctx.Signer.Cert)) {
+						log.Printf("warning: not publishing a CRL for %s/%s context %d: %v", e.Customer, e.Environment, j, err)
+					}
+				case err != nil:
+					log.Printf("could not generate CRL for %s/%s context %d: %v", e.Customer, e.Environment, j, err)
+				}
+			}
+		}
+		time.Sleep(p.Interval)
+	}
+}
+
+// warnOnce reports whether the CA identified by id has not been warned
+// about before.
+func (p *CRLPublisher) warnOnce(id string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.warned[id] {
+		return false
+	}
+	if p.warned == nil {
+		p.warned = make(map[string]bool)
+	}
+	p.warned[id] = true
+	return true
+}
+
+// CRLHandler serves the CRL for the CA of a customer and environment's
+// context. If the context is not specified, the first is used.
+type CRLHandler struct {
+	Config configSource
+	CRLs   *CRLPublisher
+}
+
+func (h *CRLHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	env := h.Config.Current().environment(vars["customer"], vars["env"])
+	if env == nil {
+		http.Error(w, fmt.Sprintf("%s/%s: no known environment", vars["customer"], vars["env"]), 404)
+		return
+	}
+	var i int
+	if v, ok := vars["context"]; ok {
+		var err error
+		i, err = strconv.Atoi(v)
+		if err != nil || i < 0 || i >= len(env.Contexts) {
+			http.Error(w, fmt.Sprintf("%s/%s: no context %q", env.Customer, env.Environment, v), 404)
+			return
+		}
+	}
+	crl, err := h.CRLs.CRL(&env.Contexts[i])
+	switch {
+	case err == errNoCRLSign:
+		http.Error(w, fmt.Sprintf("%s/%s: no CRL is published: %v", env.Customer, env.Environment, err), 404)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/pkix-crl")
+	w.Write(crl)
+}
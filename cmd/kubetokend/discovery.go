@@ -0,0 +1,79 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/atlassian/kubetoken"
+	"github.com/atlassian/kubetoken/internal/cert"
+)
+
+// csrKeyTypes are the public key algorithms accepted in CSRs, as
+// advertised in the discovery document.
+var csrKeyTypes = []string{cert.ECDSA, cert.Ed25519, cert.RSA}
+
+// minRSAKeySize is the smallest RSA key, in bits, accepted in CSRs.
+const minRSAKeySize = 2048
+
+// acceptKeyType reports whether the public key of csr is one of
+// csrKeyTypes, returning its type. ECDSA keys must be on the P-256
+// curve, as generated by the client, and RSA keys at least
+// minRSAKeySize bits.
+func acceptKeyType(csr *x509.CertificateRequest) (string, bool) {
+	var keyType string
+	switch key := csr.PublicKey.(type) {
+	case *rsa.PublicKey:
+		keyType = cert.RSA
+		if bits := key.N.BitLen(); bits < minRSAKeySize {
+			return fmt.Sprintf("%s (%d bits)", keyType, bits), false
+		}
+	case *ecdsa.PublicKey:
+		keyType = cert.ECDSA
+		if key.Curve != elliptic.P256() {
+			return fmt.Sprintf("%s (%s)", keyType, key.Curve.Params().Name), false
+		}
+	case ed25519.PublicKey:
+		keyType = cert.Ed25519
+	default:
+		return csr.PublicKeyAlgorithm.String(), false
+	}
+	for _, t := range csrKeyTypes {
+		if t == keyType {
+			return keyType, true
+		}
+	}
+	return keyType, false
+}
+
+// DiscoveryHandler serves the discovery document describing the server
+// to clients. The document is unauthenticated.
+type DiscoveryHandler struct {
+	Config configSource
+
+	// Discovery is the document to serve; MaxTTL is filled in from
+	// the current configuration.
+	Discovery kubetoken.Discovery
+}
+
+func (h *DiscoveryHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	d := h.Discovery
+	config := h.Config.Current()
+	var max time.Duration
+	for i := range config.Environments {
+		if ttl := config.Environments[i].maxTTL(); ttl > max {
+			max = ttl
+		}
+	}
+	d.MaxTTL = max.String()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "max-age=300")
+	json.NewEncoder(w).Encode(d)
+}
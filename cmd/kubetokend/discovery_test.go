@@ -0,0 +1,111 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/atlassian/kubetoken"
+)
+
+func TestDiscoveryHandler(t *testing.T) {
+	c := &Config{
+		Environments: []Environment{{
+			Name: "web-dev",
+			TTL: TTLPolicy{
+				Max: Duration{4 * time.Hour},
+			},
+			Roles: []RolePolicy{{
+				Pattern: "-admin-",
+				TTL: TTLPolicy{
+					Max: Duration{time.Hour},
+				},
+			}},
+		}, {
+			Name: "web-prod",
+			Roles: []RolePolicy{{
+				Pattern: "-dev-",
+				TTL: TTLPolicy{
+					Max: Duration{12 * time.Hour},
+				},
+			}},
+		}},
+	}
+	want := kubetoken.Discovery{
+		APIVersion:  "v1",
+		Version:     "v1.2.3",
+		AuthMethods: []string{kubetoken.AuthBasic},
+		MFA:         "duo",
+		KeyTypes:    []string{"rsa"},
+		Endpoints: kubetoken.Endpoints{
+			Roles:   "/api/v1/roles",
+			SignCSR: "/api/v1/signcsr2fa",
+			Revoke:  "/api/v1/revoke",
+		},
+	}
+	h := &DiscoveryHandler{Config: c, Discovery: want}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", kubetoken.DiscoveryPath, nil))
+	if w.Code != 200 {
+		t.Fatalf("got status %d, want 200", w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("got Content-Type %q, want application/json", ct)
+	}
+	var got kubetoken.Discovery
+	if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	want.MaxTTL = "12h0m0s"
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestAcceptKeyType(t *testing.T) {
+	key := func(generate func() (crypto.Signer, error)) crypto.PublicKey {
+		k, err := generate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return k.Public()
+	}
+	rsaKey := func(bits int) crypto.PublicKey {
+		return key(func() (crypto.Signer, error) { return rsa.GenerateKey(rand.Reader, bits) })
+	}
+	ecdsaKey := func(curve elliptic.Curve) crypto.PublicKey {
+		return key(func() (crypto.Signer, error) { return ecdsa.GenerateKey(curve, rand.Reader) })
+	}
+	edKey, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		alg  x509.PublicKeyAlgorithm
+		key  crypto.PublicKey
+		want bool
+	}{
+		{x509.RSA, rsaKey(2048), true},
+		{x509.RSA, rsaKey(1024), false},
+		{x509.ECDSA, ecdsaKey(elliptic.P256()), true},
+		{x509.ECDSA, ecdsaKey(elliptic.P384()), false},
+		{x509.Ed25519, edKey, true},
+		{x509.DSA, nil, false},
+	}
+	for _, tt := range tests {
+		keyType, got := acceptKeyType(&x509.CertificateRequest{PublicKeyAlgorithm: tt.alg, PublicKey: tt.key})
+		if got != tt.want {
+			t.Errorf("%v: got %v, want %v", keyType, got, tt.want)
+		}
+	}
+}
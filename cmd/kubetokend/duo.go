@@ -1,67 +1,207 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/url"
+	"time"
 
+	"github.com/atlassian/kubetoken"
 	"github.com/duosecurity/duo_api_golang"
 )
 
-// DuoAuth inserts a Duo auth middleware before next.
-func DuoAuth(next http.Handler, duoIKey, duoSKey, duoAPIHost string) http.Handler {
+const (
+	// duoCallTimeout bounds each call to Duo, including auth_status
+	// calls, which wait for the status of a push or call to change.
+	duoCallTimeout = 90 * time.Second
+
+	// duoAuthTimeout bounds the time a user has to respond to a push
+	// or call.
+	duoAuthTimeout = 5 * time.Minute
+
+	// duoPollInterval is the minimum interval between auth_status calls.
+	duoPollInterval = time.Second
+
+	// duoReplyMargin is the time DuoAuth leaves, within the server's
+	// write timeout, to sign the certificate once the user responds.
+	duoReplyMargin = 15 * time.Second
+)
+
+// DuoAuth inserts a Duo auth middleware before next, which blocks until
+// the user responds to an automatically chosen factor. It serves clients
+// which predate MFAChallenger. The outcome of each Duo request is
+// recorded in audit. If writeTimeout, the server's write timeout, is
+// set, the user must respond in time for the reply to be written
+// within it.
+func DuoAuth(next http.Handler, audit *Auditor, duo *DuoClient, writeTimeout time.Duration) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
-		staffid, _, ok := req.BasicAuth()
-		if !ok {
-			if !ok {
-				http.Error(w, "Forbidden", 403)
-				return
+		id := identity(req)
+		if id == nil {
+			http.Error(w, "Forbidden", 403)
+			return
+		}
+		staffid := id.User
+		ev := AuditEvent{Event: auditMFA, User: staffid, Provider: "duo"}
+		ctx := req.Context()
+		if writeTimeout > 0 {
+			timeout := writeTimeout - duoReplyMargin
+			if timeout <= 0 {
+				timeout = writeTimeout
 			}
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
 		}
-		if err := duoAuth(staffid, duoIKey, duoSKey, duoAPIHost); err != nil {
+		err := duo.verify(ctx, &mfaRequest{User: staffid, ClientIP: clientIP(req)}, "auto", "")
+		if err != nil {
+			ev.Outcome, ev.Reason = outcomeDenied, err.Error()
+			audit.Record(req, ev)
 			http.Error(w, err.Error(), 403)
 			return
 		}
-		next.ServeHTTP(w, req)
+		ev.Outcome = outcomeAllowed
+		audit.Record(req, ev)
+		next.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), mfaVerifiedKey{}, "duo")))
 	})
 }
 
-func duoAuth(staffid, duoIKey, duoSKey, duoAPIHost string) error {
+// DuoClient is an MFAProvider which verifies users with Duo's Auth
+// API. Pushes and calls are made asynchronously, and their outcome
+// polled for, so that no single call waits for the user to respond.
+type DuoClient struct {
+	api *duoapi.DuoApi
+}
+
+// NewDuoClient returns a DuoClient using the integration described by
+// ikey, skey and apiHost.
+func NewDuoClient(ikey, skey, apiHost string) *DuoClient {
 	const userAgent = "kubetoken/1.0"
-	duo := duoapi.NewDuoApi(duoIKey, duoSKey, duoAPIHost, userAgent)
+	return &DuoClient{
+		api: duoapi.NewDuoApi(ikey, skey, apiHost, userAgent, duoapi.SetTimeout(duoCallTimeout)),
+	}
+}
+
+// Methods returns the methods supported by Duo.
+func (d *DuoClient) Methods() []string {
+	return []string{kubetoken.MFAPush, kubetoken.MFAPasscode, kubetoken.MFAPhone}
+}
+
+// Verify verifies the user making r with Duo's factor of the same name
+// as method, blocking until they respond. The method may also be
+// "auto", for Duo to choose. Pushes describe r to the user.
+func (d *DuoClient) Verify(r *mfaRequest, method, passcode string) error {
+	return d.verify(context.Background(), r, method, passcode)
+}
+
+// verify is Verify, which stops waiting for the user once ctx is done.
+func (d *DuoClient) verify(ctx context.Context, r *mfaRequest, method, passcode string) error {
+	start := time.Now()
+	defer func() {
+		duoDuration.Observe(time.Since(start).Seconds())
+	}()
+
 	params := make(url.Values)
-	params.Add("username", staffid)
-	params.Add("factor", "auto")
+	params.Add("username", r.User)
+	params.Add("factor", method)
+	if r.ClientIP != "" {
+		params.Add("ipaddr", r.ClientIP)
+	}
+	if method == kubetoken.MFAPasscode {
+		params.Add("passcode", passcode)
+		result, err := d.call("POST", "/auth/v2/auth", params)
+		if err != nil {
+			return err
+		}
+		return result.err()
+	}
+
 	params.Add("device", "auto")
-	resp, body, err := duo.SignedCall("POST", "/auth/v2/auth", params, duoapi.UseTimeout)
+	params.Add("async", "1")
+	if info := duoPushinfo(r); info != "" {
+		params.Add("pushinfo", info)
+	}
+	result, err := d.call("POST", "/auth/v2/auth", params)
 	if err != nil {
 		return err
 	}
+	if result.TxID == "" {
+		return fmt.Errorf("request failed: no txid in async auth response")
+	}
+	status := url.Values{"txid": {result.TxID}}
+	deadline := start.Add(duoAuthTimeout)
+	for {
+		next := time.Now().Add(duoPollInterval)
+		result, err := d.call("GET", "/auth/v2/auth_status", status)
+		if err != nil {
+			return err
+		}
+		if result.Result != "waiting" {
+			return result.err()
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("request timed out: %s: %s", result.Status, result.Message)
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("request abandoned: %v", ctx.Err())
+		case <-time.After(next.Sub(time.Now())):
+		}
+	}
+}
+
+// duoPushinfo returns the pushinfo describing r, shown to the user in
+// Duo Push.
+func duoPushinfo(r *mfaRequest) string {
+	info := make(url.Values)
+	if r.Role != "" {
+		info.Add("role", r.Role)
+	}
+	if r.Environment != "" {
+		info.Add("environment", r.Customer+"-"+r.Environment)
+	}
+	return info.Encode()
+}
+
+// duoAuthResult is the response of auth and auth_status.
+type duoAuthResult struct {
+	Result  string `json:"result"` // allow, deny, or waiting
+	Status  string `json:"status"`
+	Message string `json:"status_msg"`
+	TxID    string `json:"txid"` // async auth only
+}
+
+// err returns an error unless the request was allowed.
+func (r *duoAuthResult) err() error {
+	if r.Result != "allow" {
+		return fmt.Errorf("request denied: %s: %s", r.Status, r.Message)
+	}
+	return nil
+}
+
+// call makes a signed call to path.
+func (d *DuoClient) call(method, path string, params url.Values) (*duoAuthResult, error) {
+	resp, body, err := d.api.SignedCall(method, path, params, duoapi.UseTimeout)
+	if err != nil {
+		return nil, err
+	}
 	if resp.StatusCode != 200 {
-		return fmt.Errorf("expected 200, got %v: %s", resp.Status, body)
+		return nil, fmt.Errorf("expected 200, got %v: %s", resp.Status, body)
 	}
 
 	// you'd think at this point that the request was approved, oh no, not so grasshopper.
 	// duo returns a 200 with a json body which contains a result key which has the words
 	// "allow", "deny", so we must inspect that
 	var result struct {
-		Stat     string `json:"stat"`
-		Response struct {
-			Result  string `json:"result"`
-			Status  string `json:"status"`
-			Message string `json:"status_msg"`
-		} `json:"response"`
+		Stat     string        `json:"stat"`
+		Response duoAuthResult `json:"response"`
 	}
-	err = json.Unmarshal(body, &result)
-	if err != nil {
-		return err
+	if err := json.Unmarshal(body, &result); err != nil {
+		return nil, err
 	}
 	if result.Stat != "OK" {
-		return fmt.Errorf("request failed: %s", body)
+		return nil, fmt.Errorf("request failed: %s", body)
 	}
-	if result.Response.Result != "allow" {
-		return fmt.Errorf("request denied: %s: %s", result.Response.Status, result.Response.Message)
-	}
-	return nil
+	return &result.Response, nil
 }
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/atlassian/kubetoken"
+	"github.com/duosecurity/duo_api_golang"
+)
+
+func TestDuoPushinfo(t *testing.T) {
+	tests := []struct {
+		r    mfaRequest
+		want string
+	}{
+		{mfaRequest{User: "dcheney"}, ""},
+		{mfaRequest{User: "dcheney", Role: "kube-example-web-prod-dl-prod"}, "role=kube-example-web-prod-dl-prod"},
+		{mfaRequest{User: "dcheney", Role: "kube-example-web-prod-dl-prod", Customer: "example", Environment: "prod"},
+			"environment=example-prod&role=kube-example-web-prod-dl-prod"},
+	}
+	for _, tt := range tests {
+		if got := duoPushinfo(&tt.r); got != tt.want {
+			t.Errorf("%+v: got %q, want %q", tt.r, got, tt.want)
+		}
+	}
+}
+
+func TestDuoClientAbandoned(t *testing.T) {
+	// a Duo which waits for the user forever.
+	polls := make(chan struct{}, 100)
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/auth/v2/auth_status" {
+			polls <- struct{}{}
+		}
+		io.WriteString(w, `{"stat": "OK", "response": {"result": "waiting", "txid": "tx"}}`)
+	}))
+	defer srv.Close()
+	d := &DuoClient{api: duoapi.NewDuoApi("ikey", "skey", strings.TrimPrefix(srv.URL, "https://"), "test", duoapi.SetInsecure())}
+
+	// the client disconnects once Duo has been polled.
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-polls
+		cancel()
+	}()
+	start := time.Now()
+	if err := d.verify(ctx, &mfaRequest{User: "dcheney"}, kubetoken.MFAPush, ""); err == nil {
+		t.Fatal("expected abandoned push to fail")
+	}
+	if elapsed := time.Since(start); elapsed > duoPollInterval {
+		t.Errorf("stopped polling after %v, want under %v", elapsed, duoPollInterval)
+	}
+}
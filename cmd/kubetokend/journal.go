@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// journal is an append only file of JSON records, one per line, which
+// may be shared by several kubetokend processes. Writers hold an
+// exclusive lock on the file, and each journal applies the records
+// appended by other processes before reading or writing.
+type journal struct {
+	mu    sync.Mutex
+	f     *os.File
+	off   int64  // offset of the first unread record in f
+	name  string // describes records in errors
+	apply func(rec []byte) error
+}
+
+// openJournal opens, creating if necessary, the journal stored at path,
+// and applies its records with apply. apply is called with j's lock
+// held, so state it updates may be read within read and write.
+func openJournal(path, name string, apply func(rec []byte) error) (*journal, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	j := &journal{f: f, name: name, apply: apply}
+	if err := j.read(func() error { return nil }); err != nil {
+		f.Close()
+		return nil, errors.WithMessage(err, path)
+	}
+	return j, nil
+}
+
+// Close closes the underlying file.
+func (j *journal) Close() error {
+	return j.f.Close()
+}
+
+// read calls fn holding a shared lock, once any records written since
+// the last call to read or write have been applied.
+func (j *journal) read(fn func() error) error {
+	return j.withLock(syscall.LOCK_SH, fn)
+}
+
+// write calls fn holding an exclusive lock, once any records written
+// since the last call to read or write have been applied. fn may call
+// append.
+func (j *journal) write(fn func() error) error {
+	return j.withLock(syscall.LOCK_EX, fn)
+}
+
+// withLock calls fn while holding j.mu and a lock of type how on the
+// file, after applying any records written since the last call.
+func (j *journal) withLock(how int, fn func() error) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if err := syscall.Flock(int(j.f.Fd()), how); err != nil {
+		return err
+	}
+	defer syscall.Flock(int(j.f.Fd()), syscall.LOCK_UN)
+	if err := j.refresh(); err != nil {
+		return err
+	}
+	return fn()
+}
+
+// append writes recs to the end of the file with a single write, and
+// applies them. Should the write fail, the file is truncated to its
+// previous length, so that either every record is written or none are.
+// It must only be called by a function passed to write.
+func (j *journal) append(recs ...interface{}) error {
+	var buf bytes.Buffer
+	for _, rec := range recs {
+		b, err := json.Marshal(rec)
+		if err != nil {
+			return err
+		}
+		buf.Write(b)
+		buf.WriteByte('\n')
+	}
+	end, err := j.f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if _, err := j.f.Write(buf.Bytes()); err != nil {
+		if terr := j.f.Truncate(end); terr != nil {
+			return errors.Wrapf(err, "could not truncate %s journal: %v", j.name, terr)
+		}
+		return err
+	}
+	return j.refresh()
+}
+
+// refresh applies any records written since the last call to refresh.
+// The caller must hold a lock.
+func (j *journal) refresh() error {
+	if _, err := j.f.Seek(j.off, io.SeekStart); err != nil {
+		return err
+	}
+	br := bufio.NewReader(j.f)
+	for {
+		line, err := br.ReadBytes('\n')
+		if err == io.EOF {
+			// ignore a trailing partial record; it will be reread
+			// once the writer has finished with it.
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		off := j.off
+		j.off += int64(len(line))
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		if err := j.apply(line); err != nil {
+			return errors.Wrapf(err, "%s record at offset %d", j.name, off)
+		}
+	}
+}
@@ -4,6 +4,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/x509"
 	"encoding/json"
 	"encoding/pem"
@@ -14,168 +15,554 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"regexp"
 	"sort"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/atlassian/kubetoken"
 	kingpin "gopkg.in/alecthomas/kingpin.v2"
 
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 func main() {
 	fmt.Println(os.Args[0], "version:", kubetoken.Version)
 
-	ldapHost := kingpin.Flag("ldap", "ldap host to use (:636 assumed)").Required().String()
+	ldapHosts := kingpin.Flag("ldap", "ldap host to use, may be repeated for failover; enables Active Directory authentication").Strings()
+	ldapBindDN := kingpin.Flag("ldapbinddn", "DN of a service account used for ldap searches, user credentials are used if not set").String()
+	ldapBindPassword := kingpin.Flag("ldapbindpassword", "password of the ldap service account").Default(os.Getenv("LDAP_BIND_PASSWORD")).String()
+	ldapPoolSize := kingpin.Flag("ldappoolsize", "maximum number of idle ldap service account connections").Default("4").Int()
+	ldapRetry := kingpin.Flag("ldapretry", "interval after which an unreachable ldap host is preferred again").Default("1m").Duration()
+	ldapPort := kingpin.Flag("ldapport", "ldap port to use").Default("636").Int()
+	ldapMode := kingpin.Flag("ldapmode", "ldap connection security; ldaps, starttls, or plain (test environments only)").Default(kubetoken.LDAPS).Enum(kubetoken.LDAPS, kubetoken.StartTLS, kubetoken.Plain)
+	ldapCAFile := kingpin.Flag("ldapcafile", "path to the CAs used to verify the ldap server's certificate, the system roots are used if not set").String()
+	ldapDialTimeout := kingpin.Flag("ldapdialtimeout", "timeout for connecting to the ldap server").Default("10s").Duration()
+	ldapTimeout := kingpin.Flag("ldaptimeout", "timeout for each ldap operation").Default("30s").Duration()
+	ldapUserBases := kingpin.Flag("ldapuserbase", "DN under which users are searched for by login name, may be repeated; enables searching for users' DNs, which requires --ldapbinddn").Strings()
+	ldapLoginAttrs := kingpin.Flag("ldaploginattr", "attribute matched against the login name when searching for users, may be repeated; for example sAMAccountName, userPrincipalName, mail or uid").Strings()
+	var dirFlags kubetoken.Directory
+	kingpin.Flag("searchbase", "LDAP search base, overrides the config").Default(os.Getenv("KUBETOKEN_SEARCH_BASE")).StringVar(&dirFlags.SearchBase)
+	kingpin.Flag("searchgroups", "comma separated prefixes of role groups, overrides the config").Default(os.Getenv("KUBETOKEN_SEARCH_GROUPS")).StringVar(&dirFlags.SearchGroups)
+	kingpin.Flag("namespaceregex", "regular expression extracting customer, ns and env from role names, overrides the config").Default(os.Getenv("KUBETOKEN_NAMESPACE_REGEX")).StringVar(&dirFlags.NamespaceRegex)
+	kingpin.Flag("userou", "OU of users relative to the search base, overrides the config").Default(os.Getenv("KUBETOKEN_USER_OU")).StringVar(&dirFlags.UserOU)
+	kingpin.Flag("botou", "OU of bots relative to the search base, overrides the config").Default(os.Getenv("KUBETOKEN_BOT_OU")).StringVar(&dirFlags.BotOU)
+	kingpin.Flag("groupou", "OU of role groups relative to the search base, overrides the config").Default(os.Getenv("KUBETOKEN_GROUP_OU")).StringVar(&dirFlags.GroupOU)
+	ldapType := kingpin.Flag("ldaptype", "type of directory; ad for Active Directory, or ldap for other LDAP servers such as OpenLDAP").Default("ad").Enum("ad", "ldap")
+	var ldapSchema kubetoken.LDAPSchema
+	kingpin.Flag("ldapuserclass", "object class of users, ldap directories only").Default("inetOrgPerson").StringVar(&ldapSchema.UserClass)
+	kingpin.Flag("ldapuserattr", "attribute naming users in their DN, ldap directories only").Default("uid").StringVar(&ldapSchema.UserAttr)
+	kingpin.Flag("ldapgroupclass", "object class of groups, ldap directories only").Default("groupOfNames").StringVar(&ldapSchema.GroupClass)
+	kingpin.Flag("ldapgroupattr", "attribute holding the name of groups, ldap directories only").Default("cn").StringVar(&ldapSchema.GroupAttr)
+	kingpin.Flag("ldapmemberattr", "attribute of groups listing their members, ldap directories only; defaults to uniqueMember for groupOfUniqueNames, otherwise member").StringVar(&ldapSchema.MemberAttr)
+	kingpin.Flag("ldapmemberofattr", "attribute listing the groups of users and groups, maintained by a memberOf overlay, ldap directories only; if not set, groups are searched").StringVar(&ldapSchema.MemberOfAttr)
+	oidcIssuer := kingpin.Flag("oidcissuer", "OpenID Connect issuer URL; enables bearer ID token authentication").String()
+	oidcClientID := kingpin.Flag("oidcclientid", "OpenID Connect client ID which ID tokens must be issued for").String()
+	oidcJWKSURL := kingpin.Flag("oidcjwksurl", "URL of the issuer's JWKS, found by discovery if not set").String()
+	oidcUsernameClaim := kingpin.Flag("oidcusernameclaim", "ID token claim holding the username").Default("sub").String()
+	oidcGroupsClaim := kingpin.Flag("oidcgroupsclaim", "ID token claim holding the user's groups").Default("groups").String()
+	userFile := kingpin.Flag("userfile", "path to a JSON or YAML file of users, bots and groups; enables file authentication").String()
 	duoIKey := kingpin.Flag("duoikey", "Duo ikey value (support disabled if not set)").Default(os.Getenv("DUO_IKEY")).String()
 	duoSKey := kingpin.Flag("duoskey", "Duo skey value (support disabled if not set)").Default(os.Getenv("DUO_SKEY")).String()
 	duoAPIHost := kingpin.Flag("duoapihost", "Duo API Host (support disabled if not set)").Default(os.Getenv("DUO_API_HOST")).String()
+	totpEnabled := kingpin.Flag("totp", "enable the TOTP MFA provider, with secrets stored in the state directory").Bool()
+	totpSelfEnroll := kingpin.Flag("totpselfenroll", "allow users without a TOTP secret to enroll with their password alone; otherwise administrators enroll them").Bool()
+	totpIssuer := kingpin.Flag("totpissuer", "name of kubetokend shown in authenticator apps").Default("kubetoken").String()
+	mfaPolicy := kingpin.Flag("mfapolicy", "MFA policy of environments which do not set one, if an MFA provider is configured; required, optional, or forbidden").Default(mfaRequired).Enum(mfaRequired, mfaOptional, mfaForbidden)
+	mfaProvider := kingpin.Flag("mfaprovider", "MFA provider, duo or totp, used for environments which do not name one; defaults to duo if configured, otherwise totp").String()
+	minClientVersion := kingpin.Flag("minclientversion", "oldest kubetoken cli version supported, advertised to clients which refuse to run if older").String()
 	configFile := kingpin.Flag("config", "path to kubetoken.json").Default("/config/kubetoken.json").String()
+	reloadInterval := kingpin.Flag("reloadinterval", "interval at which the config and certificates are checked for changes, 0 to disable").Default("30s").Duration()
+	auditSink := kingpin.Flag("audit", "audit log destination; stdout, stderr, syslog, syslog://host:port, or a file path").Default("stdout").String()
+	proxyHeaders := kingpin.Flag("proxyheaders", "trust X-Forwarded-For and X-Real-IP headers from a reverse proxy").Bool()
+	stateDir := kingpin.Flag("statedir", "directory for persistent state, may be shared between instances").Default("/var/lib/kubetokend").String()
+	sessionTTL := kingpin.Flag("sessionttl", "lifetime of session tokens, issued once a user has given their password and any second factor, 0 to disable sessions").Default("0").Duration()
+	sessionKeyFile := kingpin.Flag("sessionkeyfile", "file holding the key with which session tokens are signed, generated if missing; defaults to session.key in the state directory").String()
+	crlInterval := kingpin.Flag("crlinterval", "interval at which CRLs are regenerated").Default("1h").Duration()
+	ocspValidity := kingpin.Flag("ocspvalidity", "validity period of OCSP responses").Default("1h").Duration()
+	var limiter Limiter
+	kingpin.Flag("ratelimit", "sustained requests per second permitted for each user, and client address if limited, 0 to disable").Default("1").Float64Var(&limiter.Rate)
+	kingpin.Flag("rateburst", "requests which each user, and client address if limited, may make at once").Default("10").IntVar(&limiter.Burst)
+	kingpin.Flag("ratelimitaddress", "also limit requests, and block failed attempts, for each client address; behind a reverse proxy, requires --proxyheaders").BoolVar(&limiter.Addresses)
+	kingpin.Flag("failurethreshold", "consecutive failed attempts after which a user, or client address if limited, is blocked, 0 to disable").Default("5").IntVar(&limiter.Threshold)
+	kingpin.Flag("failurebackoff", "duration of the first block, doubling with each further failure").Default("1m").DurationVar(&limiter.Backoff)
+	kingpin.Flag("failuremaxbackoff", "maximum duration of a block").Default("1h").DurationVar(&limiter.MaxBackoff)
+	kingpin.Flag("failurereset", "duration after the last failed attempt after which failures are forgotten").Default("15m").DurationVar(&limiter.ResetAfter)
+	var server ServerConfig
+	kingpin.Flag("listen", "address to listen on").Default(":" + os.Getenv("PORT")).StringVar(&server.Addr)
+	kingpin.Flag("tlscert", "path to the server certificate, enables TLS").StringVar(&server.TLSCert)
+	kingpin.Flag("tlskey", "path to the server private key").StringVar(&server.TLSKey)
+	kingpin.Flag("tlsclientca", "path to the CAs used to verify client certificates").StringVar(&server.TLSClientCA)
+	kingpin.Flag("tlsclientauth", "client certificate policy; none, request, verify (if given), or require").Default("none").EnumVar(&server.TLSClientAuth, "none", "request", "verify", "require")
+	kingpin.Flag("readtimeout", "maximum duration for reading a request").Default("30s").DurationVar(&server.ReadTimeout)
+	kingpin.Flag("writetimeout", "maximum duration for writing a response; clients which predate MFA challenges must respond to Duo within it").Default("2m").DurationVar(&server.WriteTimeout)
+	kingpin.Flag("idletimeout", "maximum duration an idle keep-alive connection is kept open").Default("2m").DurationVar(&server.IdleTimeout)
+	kingpin.Flag("shutdowntimeout", "maximum duration to wait for in flight requests on SIGTERM").Default("2m").DurationVar(&server.ShutdownTimeout)
 	kingpin.Parse()
 
-	config, err := loadConfig(*configFile)
+	ldap := &kubetoken.LDAPPool{
+		Hosts: *ldapHosts,
+		LDAPCreds: kubetoken.LDAPCreds{
+			Port:        *ldapPort,
+			BindDN:      *ldapBindDN,
+			Password:    *ldapBindPassword,
+			Mode:        *ldapMode,
+			DialTimeout: *ldapDialTimeout,
+			Timeout:     *ldapTimeout,
+		},
+		MaxIdle:     *ldapPoolSize,
+		IdleTimeout: time.Minute,
+		RetryAfter:  *ldapRetry,
+	}
+	if *ldapCAFile != "" {
+		pem, err := ioutil.ReadFile(*ldapCAFile)
+		check(err)
+		ldap.RootCAs = x509.NewCertPool()
+		if !ldap.RootCAs.AppendCertsFromPEM(pem) {
+			log.Fatalf("%s: no certificates found", *ldapCAFile)
+		}
+	}
+
+	// the config may name only the MFA providers which are configured.
+	var mfaNames []string
+	if *duoIKey != "" && *duoSKey != "" && *duoAPIHost != "" {
+		mfaNames = append(mfaNames, "duo")
+	}
+	if *totpEnabled {
+		mfaNames = append(mfaNames, "totp")
+	}
+	config, err := newConfigLoader(*configFile, mfaNames)
 	if err != nil {
 		log.Fatalf("could not load config: %v", err)
 	}
 
+	// the directory layout is read once; flags and environment
+	// variables take precedence over the config.
+	directory := config.Current().Directory.Override(dirFlags).WithDefaults()
+	if _, err := regexp.Compile(directory.NamespaceRegex); err != nil {
+		log.Fatalf("invalid namespace regex: %v", err)
+	}
+	fmt.Printf("%s using directory: %+v\n", os.Args[0], directory)
+
+	var userSearch *kubetoken.UserSearch
+	if len(*ldapUserBases) > 0 || len(*ldapLoginAttrs) > 0 {
+		if *ldapBindDN == "" {
+			log.Fatalf("--ldapuserbase and --ldaploginattr require --ldapbinddn")
+		}
+		userSearch = &kubetoken.UserSearch{
+			Bases:      *ldapUserBases,
+			LoginAttrs: *ldapLoginAttrs,
+		}
+	}
+	var auth kubetoken.Authenticators
+	if len(*ldapHosts) > 0 {
+		if *ldapType == "ldap" {
+			auth = append(auth, &kubetoken.LDAPAuthenticator{Pool: ldap, Schema: ldapSchema, Search: userSearch, Directory: directory})
+		} else {
+			auth = append(auth, &kubetoken.ADAuthenticator{Pool: ldap, Search: userSearch, Directory: directory})
+		}
+	}
+	if *oidcIssuer != "" {
+		oidc, err := kubetoken.NewOIDCAuthenticator(context.Background(), *oidcIssuer, *oidcClientID, *oidcJWKSURL)
+		if err != nil {
+			log.Fatalf("could not configure OpenID Connect: %v", err)
+		}
+		oidc.UsernameClaim = *oidcUsernameClaim
+		oidc.GroupsClaim = *oidcGroupsClaim
+		oidc.Directory = directory
+		auth = append(auth, oidc)
+	}
+	var users *kubetoken.FileDirectory
+	if *userFile != "" {
+		users, err = kubetoken.OpenFileDirectory(*userFile)
+		if err != nil {
+			log.Fatalf("could not load users: %v", err)
+		}
+		users.Directory = directory
+		auth = append(auth, users)
+	}
+	if len(auth) == 0 {
+		log.Fatalf("no authentication backend configured; set --ldap, --oidcissuer or --userfile")
+	}
+
+	audit, err := newAuditor(*auditSink)
+	if err != nil {
+		log.Fatalf("could not open audit log: %v", err)
+	}
+
 	fmt.Println(os.Args[0], "loaded config: ")
-	b, err := json.MarshalIndent(config, "", "  ")
+	b, err := json.MarshalIndent(config.Current(), "", "  ")
 	check(err)
 	fmt.Printf("%s\n", b)
 
-	if err := loadCertificates(config); err != nil {
-		log.Fatalf("could not load certificates: %v", err)
+	// reload the config when it, or the certificates it references,
+	// change, or on SIGHUP, and likewise the users file.
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	go config.Watch(sighup, *reloadInterval)
+	if users != nil {
+		sighupUsers := make(chan os.Signal, 1)
+		signal.Notify(sighupUsers, syscall.SIGHUP)
+		go watchDirectory(users, sighupUsers, *reloadInterval)
 	}
 
-	r := mux.NewRouter()
-	signer := http.Handler(&CertificateSigner{
-		LDAPHost: *ldapHost,
-		Config:   config,
-	})
+	if err := os.MkdirAll(*stateDir, 0700); err != nil {
+		log.Fatalf("could not create state directory: %v", err)
+	}
+	registry, err := openRegistry(filepath.Join(*stateDir, "registry.json"))
+	if err != nil {
+		log.Fatalf("could not open certificate registry: %v", err)
+	}
 
-	// If Duo is enabled, redirect signcsr to a duo authenticated version
-	// this lets the client detect this and print the appropriate message
-	// before re-submitting.
-	if *duoIKey != "" && *duoSKey != "" && *duoAPIHost != "" {
+	var sessions *Sessions
+	if *sessionTTL > 0 {
+		if *sessionKeyFile == "" {
+			*sessionKeyFile = filepath.Join(*stateDir, "session.key")
+		}
+		key, err := loadSessionKey(*sessionKeyFile)
+		if err != nil {
+			log.Fatalf("could not load session key: %v", err)
+		}
+		sessions, err = openSessions(filepath.Join(*stateDir, "sessions.json"), key)
+		if err != nil {
+			log.Fatalf("could not open sessions: %v", err)
+		}
+		sessions.TTL = *sessionTTL
+		// session tokens are checked first, as the other
+		// authenticators would reject them.
+		auth = append(kubetoken.Authenticators{sessions}, auth...)
+	}
+
+	// base64 encoded OCSP requests may contain runs of slashes which
+	// must not be cleaned from the path.
+	r := mux.NewRouter().SkipClean(true)
+	// authenticated requires requests to next to be authenticated,
+	// rate limiting attempts before they reach the backend.
+	authenticated := func(next http.Handler) http.Handler {
+		return RateLimit(Authenticate(next, auth, audit), &limiter, audit)
+	}
+	signer := &CertificateSigner{
+		Config:    config,
+		Directory: directory,
+		Audit:     audit,
+		Registry:  registry,
+	}
+
+	discovery := kubetoken.Discovery{
+		APIVersion:       "v1",
+		Version:          kubetoken.Version,
+		MinClientVersion: *minClientVersion,
+		KeyTypes:         csrKeyTypes,
+		Endpoints: kubetoken.Endpoints{
+			Roles:   "/api/v1/roles",
+			SignCSR: "/api/v1/signcsr",
+			Revoke:  "/api/v1/revoke",
+			Renew:   "/api/v1/renew",
+		},
+	}
+	if len(*ldapHosts) > 0 || *userFile != "" {
+		discovery.AuthMethods = append(discovery.AuthMethods, kubetoken.AuthBasic)
+	}
+	if *oidcIssuer != "" {
+		discovery.AuthMethods = append(discovery.AuthMethods, kubetoken.AuthBearer)
+	}
+	mfaProviders := make(map[string]MFAProvider)
+	var duo *DuoClient
+	if contains(mfaNames, "duo") {
 		fmt.Println("Duo support enabled, using api host:", *duoAPIHost)
-		r.HandleFunc("/api/v1/signcsr", func(w http.ResponseWriter, req *http.Request) {
-			w.Header().Set("Location", "/api/v1/signcsr2fa")
-			w.WriteHeader(399)
-		})
-		r.Handle("/api/v1/signcsr2fa", BasicAuth(DuoAuth(signer, *duoIKey, *duoSKey, *duoAPIHost)))
-	} else {
-		r.Handle("/api/v1/signcsr", BasicAuth(signer))
+		duo = NewDuoClient(*duoIKey, *duoSKey, *duoAPIHost)
+		mfaProviders["duo"] = duo
+	}
+	var totp *TOTPProvider
+	if *totpEnabled {
+		totp, err = openTOTP(filepath.Join(*stateDir, "totp.json"))
+		if err != nil {
+			log.Fatalf("could not open TOTP secrets: %v", err)
+		}
+		totp.Issuer = *totpIssuer
+		mfaProviders["totp"] = totp
+		r.Handle("/api/v1/totp/enroll", authenticated(&TOTPEnrollHandler{
+			TOTP:       totp,
+			Config:     config,
+			SelfEnroll: *totpSelfEnroll,
+			Limiter:    &limiter,
+			Audit:      audit,
+		})).Methods("POST")
+		discovery.Endpoints.TOTP = "/api/v1/totp/enroll"
+	}
+	if len(mfaProviders) > 0 {
+		if *mfaProvider == "" {
+			*mfaProvider = "totp"
+			if duo != nil {
+				*mfaProvider = "duo"
+			}
+		}
+		if _, ok := mfaProviders[*mfaProvider]; !ok {
+			log.Fatalf("MFA provider %q is not configured", *mfaProvider)
+		}
+		fmt.Printf("MFA %s by default, using provider: %s\n", *mfaPolicy, *mfaProvider)
+		mfa, err := openMFAChallenger(filepath.Join(*stateDir, "mfa.json"))
+		if err != nil {
+			log.Fatalf("could not open MFA transactions: %v", err)
+		}
+		mfa.Providers = mfaProviders
+		mfa.Provider = *mfaProvider
+		mfa.Limiter = &limiter
+		mfa.Audit = audit
+		signer.MFA = mfa
+		signer.MFAPolicy = *mfaPolicy
+		if duo != nil {
+			signer.LegacyMFA = "/api/v1/signcsr2fa"
+			r.Handle("/api/v1/signcsr2fa", authenticated(DuoAuth(signer, audit, duo, server.WriteTimeout)))
+		}
+		// mfa limits answers by the transaction's user, to slow
+		// passcode guessing; polls are not limited, as clients behind
+		// a shared address poll concurrently.
+		r.Handle("/api/v1/mfa/{transaction}", mfa).Methods("GET", "POST")
+		discovery.MFA = *mfaProvider
+		discovery.Endpoints.MFA = "/api/v1/mfa"
+	}
+	r.Handle("/api/v1/signcsr", authenticated(signer))
+	if sessions != nil {
+		r.Handle("/api/v1/session", authenticated(&SessionHandler{
+			Sessions: sessions,
+			Config:   config,
+			MFA:      signer.MFA,
+			Audit:    audit,
+		})).Methods("POST", "DELETE")
+		discovery.AuthMethods = append(discovery.AuthMethods, kubetoken.AuthSession)
+		discovery.Endpoints.Session = "/api/v1/session"
 	}
-	r.Handle("/api/v1/roles", BasicAuth(&RoleHandler{
-		ldaphost: *ldapHost,
+	r.Handle(kubetoken.DiscoveryPath, &DiscoveryHandler{
+		Config:    config,
+		Discovery: discovery,
+	}).Methods("GET")
+	r.Handle("/api/v1/roles", authenticated(&RoleHandler{
+		Audit: audit,
 	}))
+	// renewals are authenticated by the certificate presented, and
+	// rate limited as any other authentication.
+	r.Handle("/api/v1/renew", RateLimit(&RenewHandler{
+		Signer: signer,
+		Users:  auth,
+	}, &limiter, audit)).Methods("POST")
+	r.Handle("/api/v1/revoke", authenticated(&RevokeHandler{
+		Config:   config,
+		Registry: registry,
+		Audit:    audit,
+	})).Methods("POST")
+
+	if *crlInterval <= 0 {
+		log.Fatalf("--crlinterval must be positive, got %v", *crlInterval)
+	}
+	crls := &CRLPublisher{
+		Registry: registry,
+		Interval: *crlInterval,
+	}
+	go crls.Run(config)
+	crlHandler := &CRLHandler{
+		Config: config,
+		CRLs:   crls,
+	}
+	r.Handle("/api/v1/crl/{customer}/{env}", crlHandler)
+	r.Handle("/api/v1/crl/{customer}/{env}/{context}", crlHandler)
+
+	ocspResponder := &OCSPResponder{
+		Config:   config,
+		Registry: registry,
+		Validity: *ocspValidity,
+	}
+	r.Handle("/api/v1/ocsp", ocspResponder).Methods("POST")
+	r.PathPrefix("/api/v1/ocsp/").Handler(ocspResponder).Methods("GET")
+
 	r.HandleFunc("/healthcheck", func(w http.ResponseWriter, req *http.Request) {
 		io.WriteString(w, "OK")
 	})
 	r.HandleFunc("/version", func(w http.ResponseWriter, req *http.Request) {
 		io.WriteString(w, kubetoken.Version)
 	})
+	prometheus.MustRegister(&caExpiryCollector{Config: config})
+	r.Handle("/metrics", promhttp.Handler())
 
-	loggedRouter := handlers.LoggingHandler(os.Stdout, r)
-
-	addr := fmt.Sprintf(":%s", os.Getenv("PORT"))
-	log.Println("listening on", addr)
+	var handler http.Handler = r
+	if *proxyHeaders {
+		handler = handlers.ProxyHeaders(handler)
+	}
+	loggedRouter := handlers.LoggingHandler(os.Stdout, handler)
 
-	http.ListenAndServe(addr, loggedRouter)
+	if err := serve(&server, loggedRouter); err != nil {
+		log.Fatal(err)
+	}
+	if signer.MFA != nil {
+		// answers being verified are recorded before the file is
+		// closed, so that clients polling another process see them.
+		if !signer.MFA.Wait(server.ShutdownTimeout) {
+			log.Println("abandoning MFA answers still being verified")
+		}
+		signer.MFA.Close()
+	}
+	registry.Close()
+	if totp != nil {
+		totp.Close()
+	}
+	if sessions != nil {
+		sessions.Close()
+	}
+	ldap.Close()
+	log.Println("shutdown complete")
 }
 
 type CertificateSigner struct {
 	kubetoken.Signer
-	LDAPHost string
-	*Config
-}
+	Config    configSource
+	Directory kubetoken.Directory
+	Audit     *Auditor
+	Registry  *Registry
+
+	// MFA verifies second factors, if any MFA provider is configured.
+	MFA *MFAChallenger
+
+	// MFAPolicy is the MFA policy of environments which do not set
+	// one.
+	MFAPolicy string
 
-func userdn(user string) string {
-	return fmt.Sprintf(binddn(user), escapeDN(user))
+	// LegacyMFA, if set, is the path to which clients which predate
+	// MFA challenges are redirected when a second factor is required.
+	LegacyMFA string
 }
 
-func binddn(user string) string {
-	if strings.HasSuffix(user, "-bot") {
-		return "CN=%s," + kubetoken.BotOU + "," + kubetoken.SearchBase
+func (s *CertificateSigner) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	ev := AuditEvent{Event: auditCSR}
+	deny := func(code int, reason string) {
+		ev.Outcome = outcomeDenied
+		ev.Reason = reason
+		s.Audit.Record(req, ev)
+		http.Error(w, reason, code)
 	}
-	return "CN=%s," + kubetoken.UserOU + "," + kubetoken.SearchBase
-}
 
-func BasicAuth(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
-		_, _, ok := req.BasicAuth()
-		if !ok {
-			w.Header().Set("WWW-Authenticate", `Basic realm="Restricted"`)
-			http.Error(w, "Authentication required", 401)
+	id := identity(req)
+	if id == nil {
+		deny(403, "Forbidden")
+		return
+	}
+	user := id.User
+	ev.User = user
+
+	var ttl time.Duration
+	if v := req.URL.Query().Get("ttl"); v != "" {
+		var err error
+		ttl, err = time.ParseDuration(v)
+		if err != nil {
+			deny(400, fmt.Sprintf("invalid ttl: %v", err))
 			return
 		}
-		next.ServeHTTP(w, req)
-	})
-}
+	}
 
-func (s *CertificateSigner) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	user, pass, ok := req.BasicAuth()
-	if !ok {
-		http.Error(w, "Forbidden", 403)
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, maxCSRSize))
+	if err != nil {
+		deny(400, err.Error())
 		return
 	}
-
-	csr, err := readCSR(req.Body)
+	csr, err := readCSR(bytes.NewReader(body))
 	if err != nil {
-		http.Error(w, err.Error(), 400)
+		deny(400, err.Error())
+		return
+	}
+	if keyType, ok := acceptKeyType(csr); !ok {
+		deny(400, fmt.Sprintf("unsupported key type %s, accepted key types are %s", keyType, strings.Join(csrKeyTypes, ", ")))
 		return
 	}
 
 	if user != csr.Subject.CommonName {
-		http.Error(w, fmt.Sprintf("Subject.CommonName %q does not match auth username %q", csr.Subject.CommonName, user), 403)
+		deny(403, fmt.Sprintf("Subject.CommonName %q does not match auth username %q", csr.Subject.CommonName, user))
 		return
 	}
-	role := csr.Subject.Organization[0]
-
-	ad := kubetoken.ADRoleValidater{
-		Bind: func() (kubetoken.LDAPConn, error) {
-			ldapcreds := kubetoken.LDAPCreds{
-				Host:     s.LDAPHost,
-				Port:     636,
-				BindDN:   userdn(user),
-				Password: pass,
-			}
-			return ldapcreds.Bind()
-		},
+	if len(csr.Subject.Organization) == 0 {
+		deny(400, "Subject.Organization must contain the requested role")
+		return
 	}
+	role := csr.Subject.Organization[0]
+	ev.Role = role
+	ev.Outcome = outcomeReceived
+	s.Audit.Record(req, ev)
 
-	if err := ad.ValidateRoleForUser(user, role); err != nil {
-		http.Error(w, err.Error(), 403)
+	ev.Event = auditSign
+	if err := id.ValidateRoleForUser(user, role); err != nil {
+		deny(403, err.Error())
 		return
 	}
 
-	customer, ns, environ, err := parseCustomerNamespaceEnvFromRole(role)
+	customer, ns, environ, err := parseCustomerNamespaceEnvFromRole(s.Directory.NamespaceRegex, role)
 	if err != nil {
-		http.Error(w, err.Error(), 404)
+		deny(404, err.Error())
 		return
 	}
+	ev.Customer, ev.Environment, ev.Namespace = customer, environ, ns
 
 	// find customer/environment for role
-	var env *Environment
-	for i := range s.Config.Environments {
-		e := &s.Config.Environments[i]
-		if e.Customer == customer && e.Environment == environ {
-			env = e
-			break
-		}
-	}
+	env := s.Config.Current().environment(customer, environ)
 	if env == nil {
-		http.Error(w, fmt.Sprintf("%s: no known environment", role), 400)
+		deny(400, fmt.Sprintf("%s: no known environment", role))
+		return
+	}
+
+	if !s.checkMFA(w, req, env, mfaRequest{
+		User:        user,
+		Role:        role,
+		Customer:    customer,
+		Environment: environ,
+		ClientIP:    clientIP(req),
+	}, body, deny) {
 		return
 	}
 
-	certPEM, err := env.Contexts[0].Sign(csr)
+	authenticated := time.Now()
+	if c := sessionOf(req); c != nil {
+		authenticated = c.Issued
+	}
+	s.issue(w, req, ev, env, csr, ttl, time.Time{}, Issuance{
+		User:          user,
+		Role:          role,
+		Customer:      customer,
+		Environment:   environ,
+		Namespace:     ns,
+		Authenticated: authenticated.UTC(),
+	}, deny)
+}
+
+// issue signs csr, described by iss, with the CA of each context of
+// env, as the clusters of each may trust a different CA, and replies
+// with the CertificateResponse. The certificates are valid for ttl,
+// clamped to the policy for the role, and if notAfter is set, no later
+// than notAfter. Nothing is registered, or recorded in audit as
+// issued, unless every context signs csr; then ev is recorded for each
+// certificate.
+func (s *CertificateSigner) issue(w http.ResponseWriter, req *http.Request, ev AuditEvent, env *Environment, csr *x509.CertificateRequest, ttl time.Duration, notAfter time.Time, iss Issuance, deny func(int, string)) {
+	user, role, ns := iss.User, iss.Role, iss.Namespace
+	ttl = env.ttlPolicy(role).clamp(ttl)
+	now := time.Now()
+	expires := now.Add(ttl)
+	if !notAfter.IsZero() && expires.After(notAfter) {
+		expires = notAfter
+		ttl = expires.Sub(now).Round(time.Second)
+	}
+	certs, crts, err := s.sign(env.Contexts, csr, expires, iss)
 	if err != nil {
-		http.Error(w, err.Error(), 500)
+		deny(500, err.Error())
 		return
 	}
+	for _, crt := range crts {
+		ev.Serial = crt.SerialNumber.String()
+		ev.NotBefore, ev.NotAfter = &crt.NotBefore, &crt.NotAfter
+		ev.Outcome = outcomeIssued
+		s.Audit.Record(req, ev)
+	}
 
 	// to support older clients, we push the cluster addresses from the
 	// first context.
@@ -188,58 +575,139 @@ func (s *CertificateSigner) ServeHTTP(w http.ResponseWriter, req *http.Request)
 	sort.Stable(sort.StringSlice(addresses))
 
 	var contexts []kubetoken.Context
-	for _, c := range env.Contexts {
+	for i, c := range env.Contexts {
 		contexts = append(contexts, kubetoken.Context{
 			Files: map[string][]byte{
 				"ca.pem":                    c.caClusterCertPEM,
-				fmt.Sprintf("%s.pem", user): certPEM,
+				fmt.Sprintf("%s.pem", user): certs[i],
 			},
 			Clusters: c.Clusters,
 		})
 	}
 
+	// older clients use the certificate for the first context for
+	// every context.
+	expires = expires.UTC()
 	enc := json.NewEncoder(w)
 	enc.Encode(kubetoken.CertificateResponse{
 		Username: user,
-		Role:     csr.Subject.Organization[0],
+		Role:     role,
 		Files: map[string][]byte{
 			"ca.pem":                    env.Contexts[0].caClusterCertPEM,
-			fmt.Sprintf("%s.pem", user): certPEM,
+			fmt.Sprintf("%s.pem", user): certs[0],
 		},
 		Customer:    env.Customer,
 		Addresses:   addresses,
 		Environment: env.Environment,
 		Namespace:   ns,
 		Contexts:    contexts,
+		TTL:         ttl.String(),
+		Expires:     &expires,
 	})
-	log.Printf("authorised %v to assume role %v", csr.Subject.CommonName, csr.Subject.Organization[0])
+	log.Printf("authorised %v to assume role %v for %v", user, role, ttl)
+}
+
+// checkMFA enforces the MFA policy of env for r, the request req to
+// sign csr, once the role has been validated. It returns true if the
+// request may proceed; otherwise it has replied to req, with a
+// challenge, a redirect, or by calling deny.
+func (s *CertificateSigner) checkMFA(w http.ResponseWriter, req *http.Request, env *Environment, r mfaRequest, csr []byte, deny func(int, string)) bool {
+	policy := env.mfaPolicy(r.Role)
+	if policy == "" {
+		policy = s.MFAPolicy
+	}
+	if policy == "" || policy == mfaForbidden {
+		return true
+	}
+	if s.MFA != nil && mfaVerified(req, s.MFA.provider(env)) {
+		return true
+	}
+	header := req.Header.Get(kubetoken.MFAHeader)
+	switch {
+	case s.MFA == nil:
+		deny(500, fmt.Sprintf("%s requires MFA, but no MFA provider is configured", r.Role))
+		return false
+	case header == "" && policy == mfaOptional:
+		return true
+	case header == "" && s.LegacyMFA != "" && s.MFA.provider(env) == "duo":
+		// this lets older clients detect this and print the
+		// appropriate message before re-submitting. The legacy
+		// endpoint verifies with Duo only, so clients are denied
+		// below in environments using another provider.
+		w.Header().Set("Location", s.LegacyMFA)
+		w.WriteHeader(399)
+		return false
+	default:
+		return s.MFA.verify(w, req, r, s.MFA.provider(env), csr, deny)
+	}
+}
+
+// sign signs csr with the CA of each of contexts, and once every
+// context has signed it, records the resulting certificates, described
+// by iss, in the registry. Should the registry report that the serial
+// number of a certificate has been issued before, the csr is signed
+// again.
+func (s *CertificateSigner) sign(contexts []Context, csr *x509.CertificateRequest, expires time.Time, iss Issuance) ([][]byte, []*x509.Certificate, error) {
+	const attempts = 3
+	for i := 0; ; i++ {
+		certs := make([][]byte, len(contexts))
+		crts := make([]*x509.Certificate, len(contexts))
+		issued := make([]Issuance, len(contexts))
+		for j := range contexts {
+			ctx := &contexts[j]
+			certPEM, err := ctx.Sign(csr, expires)
+			if err != nil {
+				return nil, nil, err
+			}
+			crt, err := parseCertificate(certPEM)
+			if err != nil {
+				return nil, nil, err
+			}
+			certs[j], crts[j] = certPEM, crt
+			issued[j] = iss
+			issued[j].Serial = crt.SerialNumber.String()
+			issued[j].Issuer = issuerID(ctx.Signer.Cert)
+			issued[j].NotBefore, issued[j].NotAfter = crt.NotBefore, crt.NotAfter
+		}
+		if s.Registry == nil {
+			return certs, crts, nil
+		}
+		switch err := s.Registry.Record(issued...); {
+		case err == nil:
+			return certs, crts, nil
+		case err == errDuplicateSerial && i < attempts-1:
+			log.Printf("serial already issued, resigning")
+		default:
+			return nil, nil, err
+		}
+	}
 }
 
 type RoleHandler struct {
-	ldaphost string
+	Audit *Auditor
 }
 
 func (r *RoleHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	user, pass, ok := req.BasicAuth()
-	if !ok {
+	ev := AuditEvent{Event: auditRoles}
+	id := identity(req)
+	if id == nil {
+		ev.Outcome, ev.Reason = outcomeDenied, "Forbidden"
+		r.Audit.Record(req, ev)
 		http.Error(w, "Forbidden", 403)
 		return
 	}
+	user := id.User
+	ev.User = user
 
-	ad := &kubetoken.ADRoleProvider{
-		LDAPCreds: kubetoken.LDAPCreds{
-			Host:     r.ldaphost,
-			Port:     636,
-			BindDN:   userdn(user),
-			Password: pass,
-		},
-	}
-
-	roles, err := ad.FetchRolesForUser(user)
+	roles, err := id.FetchRolesForUser(user)
 	if err != nil {
+		ev.Outcome, ev.Reason = outcomeDenied, err.Error()
+		r.Audit.Record(req, ev)
 		http.Error(w, err.Error(), 403)
 		return
 	}
+	ev.Outcome = outcomeAllowed
+	r.Audit.Record(req, ev)
 
 	enc := json.NewEncoder(w)
 	enc.Encode(struct {
@@ -263,17 +731,35 @@ func readCSR(r io.Reader) (*x509.CertificateRequest, error) {
 	if block.Type != "CERTIFICATE REQUEST" {
 		return nil, errors.New("expected CERTIFICATE REQUEST, got " + block.Type)
 	}
-	return x509.ParseCertificateRequest(block.Bytes)
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	// the signature proves the requester holds the private key of the
+	// certificate they are issued.
+	if err := csr.CheckSignature(); err != nil {
+		return nil, fmt.Errorf("invalid CSR signature: %v", err)
+	}
+	return csr, nil
 }
 
-func parseCustomerNamespaceEnvFromRole(role string) (string, string, string, error) {
-	re, err := regexp.Compile(kubetoken.NamespaceRegex)
+// parseCertificate parses a single PEM encoded certificate.
+func parseCertificate(certPEM []byte) (*x509.Certificate, error) {
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		return nil, errors.New("unable to decode PEM block")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+func parseCustomerNamespaceEnvFromRole(pattern, role string) (string, string, string, error) {
+	re, err := regexp.Compile(pattern)
 	if err != nil {
 		return "", "", "", err
 	}
 	m := re.FindStringSubmatch(role)
 	if m == nil {
-		log.Printf("failed to match role %q against regex %q", role, kubetoken.NamespaceRegex)
+		log.Printf("failed to match role %q against regex %q", role, pattern)
 		return "", "", "", fmt.Errorf("no match for role %q", role)
 	}
 	var customer, ns, env string
@@ -316,24 +802,6 @@ func parseCustomerNamespaceEnvFromRole(role string) (string, string, string, err
 	return customer, ns, env, nil
 }
 
-// escapeDN returns a string with characters escaped to safely injected into a DN.
-// Intended as a complement to ldap.EscapeFilter, which escapes ldap filter strings.
-// Made with reference to https://www.owasp.org/index.php/LDAP_Injection_Prevention_Cheat_Sheet
-// and http://www.rlmueller.net/CharactersEscaped.htm
-func escapeDN(unsafe string) string {
-	var buf bytes.Buffer
-	for _, r := range unsafe {
-		switch r {
-		case '/', '\\', '#', ',', ';', '<', '>', '+', '=':
-			buf.WriteRune('\\')
-			fallthrough
-		default:
-			buf.WriteRune(r)
-		}
-	}
-	return buf.String()
-}
-
 func check(err error) {
 	if err != nil {
 		log.Fatal(err)
@@ -1,31 +1,143 @@
 package main
 
 import (
+	"bytes"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/atlassian/kubetoken"
+	"github.com/atlassian/kubetoken/internal/cert"
 )
 
-func TestBinddn(t *testing.T) {
-	tests := []struct {
-		role string
-		want string
-	}{{
-		role: "aperson",
-		want: "CN=%s,OU=people,DC=office,DC=atlassian,DC=com",
-	}, {
-		role: "abot",
-		want: "CN=%s,OU=people,DC=office,DC=atlassian,DC=com",
-	}, {
-		role: "a-bot",
-		want: "CN=%s,OU=bots,OU=people,DC=office,DC=atlassian,DC=com",
-	}}
-
-	kubetoken.SearchBase = "DC=office,DC=atlassian,DC=com"
-	for _, tt := range tests {
-		got := binddn(tt.role)
-		if got != tt.want {
-			t.Errorf("binddn(%q): got: %q, want: %q", tt.role, got, tt.want)
+func TestCertificateSignerContexts(t *testing.T) {
+	config := testConfig(t)
+	env := &config.Environments[0]
+
+	// a second context whose clusters trust another CA.
+	caPEM, keyPEM, err := cert.NewCA("other-ca", time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := parseCertificate(caPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(keyPEM)
+	key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := env.Contexts[0]
+	other.Signer = kubetoken.Signer{Cert: ca, PrivKey: key}
+	env.Contexts = append(env.Contexts, other)
+
+	registry, cleanup := testRegistry(t)
+	defer cleanup()
+	s := &CertificateSigner{Config: config, Registry: registry, Audit: &Auditor{w: ioutil.Discard}}
+	req := httptest.NewRequest("POST", "/api/v1/signcsr", nil)
+	w := httptest.NewRecorder()
+	deny := func(code int, reason string) {
+		t.Fatalf("got %d: %s", code, reason)
+	}
+	s.issue(w, req, AuditEvent{}, env, testCSR(t, "dcheney", "kube-example-web-dev-dl-dev"), time.Hour, time.Time{}, Issuance{
+		User: "dcheney",
+		Role: "kube-example-web-dev-dl-dev",
+	}, deny)
+
+	var result kubetoken.CertificateResponse
+	if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Contexts) != len(env.Contexts) {
+		t.Fatalf("got %d contexts, want %d", len(result.Contexts), len(env.Contexts))
+	}
+	for i, ctx := range result.Contexts {
+		crt, err := parseCertificate(ctx.Files["dcheney.pem"])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := crt.CheckSignatureFrom(env.Contexts[i].Signer.Cert); err != nil {
+			t.Errorf("context %d: %v", i, err)
 		}
+		iss, _, err := registry.Status(crt.SerialNumber.String())
+		if err != nil || iss == nil || iss.Issuer != issuerID(env.Contexts[i].Signer.Cert) {
+			t.Errorf("context %d: got registered issuance %+v, %v", i, iss, err)
+		}
+	}
+	// older clients use the first context's certificate throughout.
+	if string(result.Files["dcheney.pem"]) != string(result.Contexts[0].Files["dcheney.pem"]) {
+		t.Errorf("expected the first context's certificate in Files")
+	}
+}
+
+func TestCertificateSignerContextFails(t *testing.T) {
+	config := testConfig(t)
+	env := &config.Environments[0]
+
+	// a second context whose key does not match its CA, so cannot sign.
+	_, keyPEM, err := cert.NewCA("other-ca", time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(keyPEM)
+	key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := env.Contexts[0]
+	other.Signer = kubetoken.Signer{Cert: env.Contexts[0].Signer.Cert, PrivKey: key}
+	env.Contexts = append(env.Contexts, other)
+
+	registry, cleanup := testRegistry(t)
+	defer cleanup()
+	var audit bytes.Buffer
+	s := &CertificateSigner{Config: config, Registry: registry, Audit: &Auditor{w: &audit}}
+	req := httptest.NewRequest("POST", "/api/v1/signcsr", nil)
+	w := httptest.NewRecorder()
+	var denied int
+	deny := func(code int, reason string) {
+		denied = code
+	}
+	s.issue(w, req, AuditEvent{}, env, testCSR(t, "dcheney", "kube-example-web-dev-dl-dev"), time.Hour, time.Time{}, Issuance{
+		User: "dcheney",
+		Role: "kube-example-web-dev-dl-dev",
+	}, deny)
+	if denied != 500 {
+		t.Fatalf("got %d, want 500", denied)
+	}
+
+	// the certificate signed by the first context is neither
+	// registered nor audited as issued.
+	revoked, err := registry.Revoke(func(*Issuance) bool { return true }, Revocation{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revoked) != 0 {
+		t.Errorf("got %d certificates registered, want none", len(revoked))
+	}
+	if strings.Contains(audit.String(), outcomeIssued) {
+		t.Errorf("got issued audit events: %s", audit.String())
+	}
+}
+
+func TestReadCSRSignature(t *testing.T) {
+	csrPEM, _, err := cert.NewCSR("dcheney", "kube-example-web-prod-dl-prod", cert.ECDSA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readCSR(bytes.NewReader(csrPEM)); err != nil {
+		t.Fatal(err)
+	}
+	// the signature is the last field of the CSR.
+	block, _ := pem.Decode(csrPEM)
+	block.Bytes[len(block.Bytes)-1] ^= 0xff
+	if _, err := readCSR(bytes.NewReader(pem.EncodeToMemory(block))); err == nil {
+		t.Error("expected CSR with an invalid signature to be rejected")
 	}
 }
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/atlassian/kubetoken"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const metricsNamespace = "kubetoken"
+
+var (
+	authFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "auth_failures_total",
+		Help:      "Requests which failed to authenticate.",
+	})
+
+	rolesRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "roles_requests_total",
+		Help:      "Roles requests by outcome.",
+	}, []string{"outcome"})
+
+	csrRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "csr_requests_total",
+		Help:      "Certificate signing requests by outcome.",
+	}, []string{"outcome"})
+
+	signings = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "signings_total",
+		Help:      "Certificate signing outcomes by customer and environment.",
+	}, []string{"customer", "environment", "outcome"})
+
+	revocations = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "revocations_total",
+		Help:      "Certificates revoked.",
+	})
+
+	ldapDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "ldap_request_duration_seconds",
+		Help:      "Latency of LDAP binds and searches.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"op"})
+
+	ldapErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "ldap_errors_total",
+		Help:      "LDAP binds and searches which returned an error.",
+	}, []string{"op"})
+
+	duoDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "duo_request_duration_seconds",
+		Help:      "Latency of Duo auth requests, including the time taken by the user to respond.",
+		Buckets:   []float64{0.5, 1, 2.5, 5, 10, 20, 30, 60},
+	})
+
+	mfaResults = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "mfa_requests_total",
+		Help:      "MFA requests by provider and outcome.",
+	}, []string{"provider", "outcome"})
+
+	rateLimited = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "rate_limited_total",
+		Help:      "Requests refused by the rate limiter, by scope (user or address) and limit (rate or failures).",
+	}, []string{"scope", "limit"})
+
+	configReloads = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "config_reloads_total",
+		Help:      "Configuration reloads by outcome.",
+	}, []string{"outcome"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		authFailures,
+		rolesRequests,
+		csrRequests,
+		signings,
+		revocations,
+		ldapDuration,
+		ldapErrors,
+		duoDuration,
+		mfaResults,
+		rateLimited,
+		configReloads,
+	)
+	kubetoken.LDAPObserver = observeLDAP
+}
+
+// observeLDAP records the latency and outcome of an LDAP operation.
+func observeLDAP(op string, d time.Duration, err error) {
+	ldapDuration.WithLabelValues(op).Observe(d.Seconds())
+	if err != nil {
+		ldapErrors.WithLabelValues(op).Inc()
+	}
+}
+
+// observeEvent counts ev in the metric for its event type.
+func observeEvent(ev AuditEvent) {
+	switch ev.Event {
+	case auditAuth:
+		authFailures.Inc()
+	case auditRoles:
+		rolesRequests.WithLabelValues(ev.Outcome).Inc()
+	case auditCSR:
+		csrRequests.WithLabelValues(ev.Outcome).Inc()
+	case auditSign:
+		signings.WithLabelValues(ev.Customer, ev.Environment, ev.Outcome).Inc()
+	case auditMFA:
+		mfaResults.WithLabelValues(ev.Provider, ev.Outcome).Inc()
+	case auditRevoke:
+		revocations.Inc()
+	}
+}
+
+// caExpiryDesc describes the days until each CA certificate expires.
+var caExpiryDesc = prometheus.NewDesc(
+	prometheus.BuildFQName(metricsNamespace, "", "ca_expiry_days"),
+	"Days until the CA certificate of a context expires.",
+	[]string{"customer", "environment", "context", "subject"}, nil,
+)
+
+// caExpiryCollector reports the days until expiry of the CA certificate
+// of every context in the current configuration.
+type caExpiryCollector struct {
+	Config configSource
+}
+
+func (c *caExpiryCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- caExpiryDesc
+}
+
+func (c *caExpiryCollector) Collect(ch chan<- prometheus.Metric) {
+	config := c.Config.Current()
+	now := time.Now()
+	for _, e := range config.Environments {
+		for i, ctx := range e.Contexts {
+			ca := ctx.Signer.Cert
+			if ca == nil {
+				continue
+			}
+			days := ca.NotAfter.Sub(now).Hours() / 24
+			ch <- prometheus.MustNewConstMetric(caExpiryDesc, prometheus.GaugeValue, days,
+				e.Customer, e.Environment, strconv.Itoa(i), ca.Subject.CommonName)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestCAExpiryCollector(t *testing.T) {
+	config := testConfig(t)
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(&caExpiryCollector{Config: config})
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mfs) != 1 || len(mfs[0].Metric) != 1 {
+		t.Fatalf("expected one metric, got %v", mfs)
+	}
+	m := mfs[0].Metric[0]
+	labels := make(map[string]string)
+	for _, l := range m.Label {
+		labels[l.GetName()] = l.GetValue()
+	}
+	if labels["customer"] != "example" || labels["environment"] != "dev" || labels["context"] != "0" {
+		t.Errorf("unexpected labels: %v", labels)
+	}
+	ca := config.Environments[0].Contexts[0].Signer.Cert
+	if !strings.EqualFold(labels["subject"], ca.Subject.CommonName) {
+		t.Errorf("subject: got %q, want %q", labels["subject"], ca.Subject.CommonName)
+	}
+}
+
+func TestObserveMFA(t *testing.T) {
+	count := func(provider, outcome string) float64 {
+		var m dto.Metric
+		if err := mfaResults.WithLabelValues(provider, outcome).Write(&m); err != nil {
+			t.Fatal(err)
+		}
+		return m.GetCounter().GetValue()
+	}
+	duo, totp := count("duo", outcomeAllowed), count("totp", outcomeAllowed)
+	observeEvent(AuditEvent{Event: auditMFA, Provider: "totp", Outcome: outcomeAllowed})
+	if got := count("totp", outcomeAllowed); got != totp+1 {
+		t.Errorf("totp: got %v, want %v", got, totp+1)
+	}
+	if got := count("duo", outcomeAllowed); got != duo {
+		t.Errorf("duo: got %v, want %v", got, duo)
+	}
+}
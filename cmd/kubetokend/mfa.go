@@ -0,0 +1,503 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/atlassian/kubetoken"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+)
+
+// outcomeChallenged is the outcome of an auditMFA event recorded when a
+// client is challenged for a second factor.
+const outcomeChallenged = "challenged"
+
+// maxCSRSize bounds the CSRs read by CertificateSigner.
+const maxCSRSize = 64 << 10
+
+// maxPasscodeAttempts is the number of incorrect passcodes after which
+// an MFA transaction is denied.
+const maxPasscodeAttempts = 3
+
+// MFAProvider verifies users' second factors.
+type MFAProvider interface {
+	// Methods returns the kubetoken MFA methods which the provider
+	// supports.
+	Methods() []string
+
+	// Verify verifies the second factor of the user making r by
+	// method, blocking until they respond. passcode is set for
+	// MFAPasscode only.
+	Verify(r *mfaRequest, method, passcode string) error
+}
+
+// MFAChallenger verifies the second factor of users whose CSRs require
+// one, using the challenge protocol described at kubetoken.MFAHeader.
+// Challenges are stored as a journal, which may be shared by several
+// kubetokend processes, so a client may answer a challenge at any of
+// them.
+type MFAChallenger struct {
+	// Providers are the MFA providers, by name.
+	Providers map[string]MFAProvider
+
+	// Provider is the name of the provider used for environments which
+	// do not name one.
+	Provider string
+
+	// Expiry is how long a challenge may be answered for; five minutes
+	// if zero.
+	Expiry time.Duration
+
+	// Limiter, if not nil, limits answers by the transaction's user,
+	// and client address if it limits them, and counts incorrect
+	// passcodes as failed attempts by the user, so that guessing
+	// passcodes across challenges blocks them as guessing passwords
+	// would.
+	Limiter *Limiter
+
+	Audit *Auditor
+
+	j            *journal
+	transactions map[string]*mfaTransaction
+	verifying    sync.WaitGroup   // answers being verified asynchronously
+	now          func() time.Time // for testing
+}
+
+// mfaRequest describes the request for which a second factor is
+// required.
+type mfaRequest struct {
+	User        string `json:"user"`
+	Role        string `json:"role,omitempty"` // may be empty for clients which predate challenges
+	Customer    string `json:"customer"`
+	Environment string `json:"env"`
+	ClientIP    string `json:"clientip,omitempty"`
+}
+
+// mfaRecord is a single line in the MFA transactions file. It starts
+// the transaction ID, updates its state, or redeems it.
+type mfaRecord struct {
+	ID       string          `json:"id"`
+	Started  *mfaTransaction `json:"started,omitempty"`
+	State    *mfaState       `json:"state,omitempty"`
+	Redeemed bool            `json:"redeemed,omitempty"`
+}
+
+// mfaTransaction is a challenge, and its state.
+type mfaTransaction struct {
+	mfaRequest
+	Provider string    `json:"provider"`
+	CSR      []byte    `json:"csr"` // SHA-256 digest of the challenged CSR
+	Expires  time.Time `json:"expires"`
+	mfaState
+}
+
+// mfaState is the part of an mfaTransaction which changes as it is
+// answered.
+type mfaState struct {
+	Status   string `json:"status"` // kubetoken.MFAPending, MFAAllow or MFADeny
+	Message  string `json:"message,omitempty"`
+	Busy     bool   `json:"busy,omitempty"`     // an answer is being verified
+	Attempts int    `json:"attempts,omitempty"` // incorrect passcodes
+}
+
+// openMFAChallenger opens, creating if necessary, the MFA transactions
+// file stored at path.
+func openMFAChallenger(path string) (*MFAChallenger, error) {
+	m := &MFAChallenger{
+		transactions: make(map[string]*mfaTransaction),
+	}
+	j, err := openJournal(path, "MFA", m.apply)
+	if err != nil {
+		return nil, err
+	}
+	m.j = j
+	return m, nil
+}
+
+// Wait waits up to timeout for the answers being verified by this
+// process to be recorded, reporting whether they were.
+func (m *MFAChallenger) Wait(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		m.verifying.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// Close closes the underlying MFA transactions file.
+func (m *MFAChallenger) Close() error {
+	return m.j.Close()
+}
+
+func (m *MFAChallenger) clock() time.Time {
+	if m.now != nil {
+		return m.now()
+	}
+	return time.Now()
+}
+
+// mfaVerifiedKey marks requests whose user has given a second factor
+// before reaching the CertificateSigner. Its value is the name of the
+// provider which verified them.
+type mfaVerifiedKey struct{}
+
+// mfaVerified reports whether the user making req has given a second
+// factor to the named provider, by DuoAuth, or to start the session
+// with which req was authenticated.
+func mfaVerified(req *http.Request, provider string) bool {
+	p, _ := req.Context().Value(mfaVerifiedKey{}).(string)
+	if c := sessionOf(req); p == "" && c != nil {
+		p = c.MFA
+	}
+	return p != "" && p == provider
+}
+
+// provider returns the name of the provider for requests in env.
+func (m *MFAChallenger) provider(env *Environment) string {
+	if env.MFAProvider != "" {
+		return env.MFAProvider
+	}
+	return m.Provider
+}
+
+// writeMFAChallenge replies to a request with challenge c.
+func writeMFAChallenge(w http.ResponseWriter, c *kubetoken.MFAChallenge) {
+	w.Header().Set("WWW-Authenticate", fmt.Sprintf("%s transaction=%q", kubetoken.MFAScheme, c.Transaction))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(401)
+	json.NewEncoder(w).Encode(c)
+}
+
+// verify takes part in the challenge protocol for r, the request req
+// whose body is body, verified by the named provider. It returns true
+// once the client has redeemed an allowed transaction; otherwise it has
+// replied to req, with a challenge, or by calling deny.
+func (m *MFAChallenger) verify(w http.ResponseWriter, req *http.Request, r mfaRequest, provider string, body []byte, deny func(int, string)) bool {
+	header := req.Header.Get(kubetoken.MFAHeader)
+	if header == kubetoken.MFARequestChallenge {
+		c, err := m.challenge(r, provider, body)
+		if err != nil {
+			deny(500, err.Error())
+			return false
+		}
+		m.Audit.Record(req, AuditEvent{
+			Event:       auditMFA,
+			Outcome:     outcomeChallenged,
+			User:        r.User,
+			Role:        r.Role,
+			Customer:    r.Customer,
+			Environment: r.Environment,
+			Provider:    provider,
+		})
+		writeMFAChallenge(w, c)
+		return false
+	}
+	if err := m.redeem(header, r.User, body); err != nil {
+		deny(403, err.Error())
+		return false
+	}
+	return true
+}
+
+// challenge starts a transaction for r to submit csr, verified by the
+// named provider.
+func (m *MFAChallenger) challenge(r mfaRequest, provider string, csr []byte) (*kubetoken.MFAChallenge, error) {
+	p, ok := m.Providers[provider]
+	if !ok {
+		return nil, fmt.Errorf("unknown MFA provider %q", provider)
+	}
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return nil, err
+	}
+	txid := hex.EncodeToString(b[:])
+	expiry := m.Expiry
+	if expiry <= 0 {
+		expiry = 5 * time.Minute
+	}
+	sum := sha256.Sum256(csr)
+	tx := &mfaTransaction{
+		mfaRequest: r,
+		Provider:   provider,
+		CSR:        sum[:],
+		Expires:    m.clock().Add(expiry).UTC(),
+		mfaState:   mfaState{Status: kubetoken.MFAPending},
+	}
+	if err := m.j.write(func() error {
+		return m.j.append(mfaRecord{ID: txid, Started: tx})
+	}); err != nil {
+		return nil, err
+	}
+	return &kubetoken.MFAChallenge{
+		Transaction: txid,
+		Provider:    provider,
+		Methods:     p.Methods(),
+		Expires:     tx.Expires,
+	}, nil
+}
+
+// redeem consumes the allowed transaction txid for user to submit csr.
+// A transaction allows a single request, from the user it was issued
+// to, for the CSR which was challenged.
+func (m *MFAChallenger) redeem(txid, user string, csr []byte) error {
+	if txid == "" {
+		return fmt.Errorf("a second factor is required, set %s to %q to be challenged", kubetoken.MFAHeader, kubetoken.MFARequestChallenge)
+	}
+	sum := sha256.Sum256(csr)
+	return m.j.write(func() error {
+		tx := m.lookup(txid)
+		switch {
+		case tx == nil:
+			return fmt.Errorf("unknown or expired MFA transaction")
+		case tx.User != user || !bytes.Equal(tx.CSR, sum[:]):
+			return fmt.Errorf("MFA transaction was issued for another request")
+		case tx.Status != kubetoken.MFAAllow:
+			return fmt.Errorf("MFA transaction has not been allowed")
+		}
+		return m.j.append(mfaRecord{ID: txid, Redeemed: true})
+	})
+}
+
+// lookup returns the unexpired transaction txid, or nil. It must be
+// called within m.j.read or m.j.write.
+func (m *MFAChallenger) lookup(txid string) *mfaTransaction {
+	tx := m.transactions[txid]
+	if tx == nil || m.clock().After(tx.Expires) {
+		return nil
+	}
+	return tx
+}
+
+// ServeHTTP answers, with POST, and polls, with GET, the transaction
+// named by the transaction route variable, replying with its
+// kubetoken.MFAStatus. Requests need not be authenticated, as the
+// transaction ID is known only to the client which was challenged.
+func (m *MFAChallenger) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	txid := mux.Vars(req)["transaction"]
+	if req.Method == "POST" {
+		// the answer is read before the journal is locked, so that a
+		// client which sends it slowly does not hold up every other
+		// transaction.
+		var answer kubetoken.MFAAnswer
+		if err := json.NewDecoder(io.LimitReader(req.Body, 4096)).Decode(&answer); err != nil {
+			http.Error(w, fmt.Sprintf("invalid answer: %v", err), 400)
+			return
+		}
+		m.answer(w, req, txid, answer)
+		return
+	}
+	var status *kubetoken.MFAStatus
+	if err := m.j.read(func() error {
+		if tx := m.lookup(txid); tx != nil {
+			status = &kubetoken.MFAStatus{Status: tx.Status, Message: tx.Message}
+		}
+		return nil
+	}); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if status == nil {
+		http.Error(w, "unknown or expired MFA transaction", 404)
+		return
+	}
+	writeMFAStatus(w, *status)
+}
+
+// errMFANotFound is returned by begin for unknown or expired
+// transactions.
+var errMFANotFound = errors.New("unknown or expired MFA transaction")
+
+// begin marks the transaction txid as busy verifying answer, from addr,
+// and returns a copy of it. Errors other than errMFANotFound and
+// *refusal are the client's, unless err is from the journal.
+func (m *MFAChallenger) begin(txid, addr string, answer kubetoken.MFAAnswer) (*mfaTransaction, MFAProvider, error) {
+	var tx mfaTransaction
+	var provider MFAProvider
+	err := m.j.write(func() error {
+		t := m.lookup(txid)
+		if t == nil {
+			return errMFANotFound
+		}
+		tx = *t
+		if m.Limiter != nil {
+			if r := m.Limiter.Allow(t.User, addr); r != nil {
+				return r
+			}
+		}
+		provider = m.Providers[t.Provider]
+		switch {
+		case provider == nil:
+			return fmt.Errorf("unknown MFA provider %q", t.Provider)
+		case t.Status != kubetoken.MFAPending || t.Busy:
+			return fmt.Errorf("MFA transaction has already been answered")
+		case !contains(provider.Methods(), answer.Method):
+			return fmt.Errorf("unsupported MFA method %q", answer.Method)
+		case answer.Method == kubetoken.MFAPasscode && answer.Passcode == "":
+			return fmt.Errorf("passcode required")
+		}
+		state := t.mfaState
+		state.Busy = true
+		if err := m.j.append(mfaRecord{ID: txid, State: &state}); err != nil {
+			return errors.Wrap(err, "could not record MFA answer")
+		}
+		return nil
+	})
+	return &tx, provider, err
+}
+
+// finish records the outcome, err, of verifying answer to the
+// transaction txid, and returns its new status.
+func (m *MFAChallenger) finish(txid string, answer kubetoken.MFAAnswer, err error) kubetoken.MFAStatus {
+	var state mfaState
+	werr := m.j.write(func() error {
+		tx := m.lookup(txid)
+		if tx == nil {
+			return errMFANotFound
+		}
+		state = tx.mfaState
+		state.Busy = false
+		switch {
+		case err == nil:
+			state.Status, state.Message = kubetoken.MFAAllow, ""
+		case answer.Method == kubetoken.MFAPasscode:
+			// allow the user to correct a mistyped passcode.
+			state.Attempts++
+			state.Message = err.Error()
+			if state.Attempts >= maxPasscodeAttempts {
+				state.Status = kubetoken.MFADeny
+			}
+		default:
+			state.Status, state.Message = kubetoken.MFADeny, err.Error()
+		}
+		return m.j.append(mfaRecord{ID: txid, State: &state})
+	})
+	if werr != nil {
+		if werr != errMFANotFound {
+			log.Printf("could not record MFA outcome of %s: %v", txid, werr)
+		}
+		return kubetoken.MFAStatus{Status: kubetoken.MFADeny, Message: werr.Error()}
+	}
+	return kubetoken.MFAStatus{Status: state.Status, Message: state.Message}
+}
+
+// answer verifies answer, read from req, to the transaction txid.
+func (m *MFAChallenger) answer(w http.ResponseWriter, req *http.Request, txid string, answer kubetoken.MFAAnswer) {
+	tx, provider, err := m.begin(txid, clientIP(req), answer)
+	if r, ok := err.(*refusal); ok {
+		writeRefusal(w, req, r, tx.User, m.Audit)
+		return
+	}
+	switch {
+	case err == errMFANotFound:
+		http.Error(w, err.Error(), 404)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	ev := AuditEvent{
+		Event:       auditMFA,
+		User:        tx.User,
+		Role:        tx.Role,
+		Customer:    tx.Customer,
+		Environment: tx.Environment,
+		Provider:    tx.Provider,
+		ClientIP:    clientIP(req),
+		UserAgent:   req.UserAgent(),
+	}
+	verify := func() kubetoken.MFAStatus {
+		err := provider.Verify(&tx.mfaRequest, answer.Method, answer.Passcode)
+		if err != nil && answer.Method == kubetoken.MFAPasscode && m.Limiter != nil {
+			m.Limiter.Failure(tx.User, ev.ClientIP)
+		}
+		status := m.finish(txid, answer, err)
+		ev.Outcome, ev.Reason = outcomeAllowed, ""
+		if err != nil {
+			ev.Outcome, ev.Reason = outcomeDenied, err.Error()
+		}
+		m.Audit.Record(nil, ev)
+		return status
+	}
+
+	if answer.Method == kubetoken.MFAPasscode {
+		status := verify()
+		if status.Status != kubetoken.MFAAllow {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(403)
+			json.NewEncoder(w).Encode(status)
+			return
+		}
+		writeMFAStatus(w, status)
+		return
+	}
+
+	// pushes and calls wait for the user, which may take longer than
+	// the client or a proxy will wait for a response, so the client
+	// polls for the outcome, at any kubetokend process.
+	m.verifying.Add(1)
+	go func() {
+		defer m.verifying.Done()
+		verify()
+	}()
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(202)
+	json.NewEncoder(w).Encode(kubetoken.MFAStatus{Status: kubetoken.MFAPending})
+}
+
+func (m *MFAChallenger) apply(line []byte) error {
+	var rec mfaRecord
+	if err := json.Unmarshal(line, &rec); err != nil {
+		return err
+	}
+	switch {
+	case rec.Started != nil:
+		// forget expired transactions as others start, so that only
+		// those which may still be answered are held.
+		now := m.clock()
+		for id, tx := range m.transactions {
+			if now.After(tx.Expires) {
+				delete(m.transactions, id)
+			}
+		}
+		m.transactions[rec.ID] = rec.Started
+	case rec.State != nil:
+		if tx := m.transactions[rec.ID]; tx != nil {
+			tx.mfaState = *rec.State
+		}
+	case rec.Redeemed:
+		delete(m.transactions, rec.ID)
+	}
+	return nil
+}
+
+func writeMFAStatus(w http.ResponseWriter, status kubetoken.MFAStatus) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(status)
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
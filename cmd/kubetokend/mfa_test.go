@@ -0,0 +1,402 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/atlassian/kubetoken"
+	"github.com/atlassian/kubetoken/internal/cert"
+	"github.com/gorilla/mux"
+)
+
+type testMFAProvider struct {
+	methods []string
+	verify  func(r *mfaRequest, method, passcode string) error
+}
+
+func (p *testMFAProvider) Methods() []string { return p.methods }
+
+func (p *testMFAProvider) Verify(r *mfaRequest, method, passcode string) error {
+	return p.verify(r, method, passcode)
+}
+
+func TestMFAChallenger(t *testing.T) {
+	csr, _, err := cert.NewCSR("dcheney", "kube-example-web-prod-dl-prod", cert.ECDSA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, cleanup := testMFAChallenger(t, map[string]MFAProvider{
+		"test": &testMFAProvider{
+			methods: []string{kubetoken.MFAPush, kubetoken.MFAPasscode},
+			verify: func(r *mfaRequest, method, passcode string) error {
+				if r.Role != "kube-example-web-prod-dl-prod" || r.Environment != "prod" {
+					return fmt.Errorf("unexpected request %+v", r)
+				}
+				if method == kubetoken.MFAPasscode && passcode != "123456" {
+					return errors.New("incorrect passcode")
+				}
+				if r.User != "dcheney" {
+					return errors.New("push denied")
+				}
+				return nil
+			},
+		},
+	})
+	defer cleanup()
+	env := &Environment{Customer: "example", Environment: "prod"}
+	var signed []byte
+	signer := mfaTestSigner(&CertificateSigner{MFA: m, MFAPolicy: mfaRequired, Audit: m.Audit}, env, &signed)
+	r := mux.NewRouter()
+	r.Handle("/api/v1/mfa/{transaction}", m)
+
+	submit := func(user, header string, body []byte) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api/v1/signcsr", bytes.NewReader(body))
+		req.Header.Set(kubetoken.MFAHeader, header)
+		req = req.WithContext(context.WithValue(req.Context(), identityKey{}, &kubetoken.Identity{User: user}))
+		w := httptest.NewRecorder()
+		signer.ServeHTTP(w, req)
+		return w
+	}
+	challenge := func(provider string) string {
+		w := submit("dcheney", kubetoken.MFARequestChallenge, csr)
+		if w.Code != 401 || !strings.HasPrefix(w.Header().Get("WWW-Authenticate"), kubetoken.MFAScheme) {
+			t.Fatalf("challenge: got %d %q, want 401 %s", w.Code, w.Header().Get("WWW-Authenticate"), kubetoken.MFAScheme)
+		}
+		var c kubetoken.MFAChallenge
+		if err := json.NewDecoder(w.Body).Decode(&c); err != nil {
+			t.Fatal(err)
+		}
+		if c.Transaction == "" || c.Provider != provider {
+			t.Fatalf("challenge: got %+v", c)
+		}
+		return c.Transaction
+	}
+	answer := func(txid string, a kubetoken.MFAAnswer) (int, kubetoken.MFAStatus) {
+		body, _ := json.Marshal(a)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("POST", "/api/v1/mfa/"+txid, bytes.NewReader(body)))
+		var status kubetoken.MFAStatus
+		json.NewDecoder(w.Body).Decode(&status)
+		return w.Code, status
+	}
+	poll := func(txid string) kubetoken.MFAStatus {
+		for i := 0; i < 100; i++ {
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/mfa/"+txid, nil))
+			var status kubetoken.MFAStatus
+			json.NewDecoder(w.Body).Decode(&status)
+			if status.Status != kubetoken.MFAPending {
+				return status
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("%s: still pending", txid)
+		return kubetoken.MFAStatus{}
+	}
+
+	// a push is answered asynchronously.
+	txid := challenge("test")
+	if w := submit("dcheney", txid, csr); w.Code != 403 {
+		t.Errorf("before answer: got %d, want 403", w.Code)
+	}
+	if code, _ := answer(txid, kubetoken.MFAAnswer{Method: kubetoken.MFAPush}); code != 202 {
+		t.Fatalf("push: got %d, want 202", code)
+	}
+	if status := poll(txid); status.Status != kubetoken.MFAAllow {
+		t.Fatalf("push: got %+v, want allow", status)
+	}
+	if w := submit("jdoe", txid, csr); w.Code != 403 {
+		t.Errorf("other user: got %d, want 403", w.Code)
+	}
+	if w := submit("dcheney", txid, append([]byte("x"), csr...)); w.Code != 403 {
+		t.Errorf("other csr: got %d, want 403", w.Code)
+	}
+	if w := submit("dcheney", txid, csr); w.Code != 200 || !bytes.Equal(signed, csr) {
+		t.Errorf("allowed: got %d, want 200 and the csr passed on", w.Code)
+	}
+	if w := submit("dcheney", txid, csr); w.Code != 403 {
+		t.Errorf("reused: got %d, want 403", w.Code)
+	}
+
+	// a mistyped passcode may be corrected, up to maxPasscodeAttempts.
+	txid = challenge("test")
+	if code, status := answer(txid, kubetoken.MFAAnswer{Method: kubetoken.MFAPasscode, Passcode: "000000"}); code != 403 || status.Status != kubetoken.MFAPending {
+		t.Errorf("wrong passcode: got %d %+v, want 403 pending", code, status)
+	}
+	if code, status := answer(txid, kubetoken.MFAAnswer{Method: kubetoken.MFAPasscode, Passcode: "123456"}); code != 200 || status.Status != kubetoken.MFAAllow {
+		t.Errorf("passcode: got %d %+v, want 200 allow", code, status)
+	}
+	txid = challenge("test")
+	for i := 0; i < maxPasscodeAttempts; i++ {
+		answer(txid, kubetoken.MFAAnswer{Method: kubetoken.MFAPasscode, Passcode: "000000"})
+	}
+	if code, status := answer(txid, kubetoken.MFAAnswer{Method: kubetoken.MFAPasscode, Passcode: "123456"}); code != 400 || status.Status == kubetoken.MFAAllow {
+		t.Errorf("passcode after %d attempts: got %d %+v, want 400", maxPasscodeAttempts, code, status)
+	}
+
+	// unsupported methods and unknown transactions are rejected.
+	txid = challenge("test")
+	if code, _ := answer(txid, kubetoken.MFAAnswer{Method: kubetoken.MFAPhone}); code != 400 {
+		t.Errorf("phone: got %d, want 400", code)
+	}
+	if code, _ := answer("nope", kubetoken.MFAAnswer{Method: kubetoken.MFAPush}); code != 404 {
+		t.Errorf("unknown transaction: got %d, want 404", code)
+	}
+
+	// environments may name another provider.
+	m.Providers["totp"] = &testMFAProvider{methods: []string{kubetoken.MFAPasscode}}
+	env.MFAProvider = "totp"
+	txid = challenge("totp")
+	if code, _ := answer(txid, kubetoken.MFAAnswer{Method: kubetoken.MFAPush}); code != 400 {
+		t.Errorf("push to totp: got %d, want 400", code)
+	}
+
+	// challenges expire.
+	m.now = func() time.Time { return time.Now().Add(time.Hour) }
+	if code, _ := answer(txid, kubetoken.MFAAnswer{Method: kubetoken.MFAPush}); code != 404 {
+		t.Errorf("expired transaction: got %d, want 404", code)
+	}
+}
+
+// testMFAChallenger returns an MFAChallenger using providers, the
+// default being named test, with its transactions in a temporary file.
+func testMFAChallenger(t *testing.T, providers map[string]MFAProvider) (*MFAChallenger, func()) {
+	dir, err := ioutil.TempDir("", "kubetokend_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := openMFAChallenger(filepath.Join(dir, "mfa.json"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	m.Providers = providers
+	m.Provider = "test"
+	m.Audit = &Auditor{w: ioutil.Discard}
+	return m, func() {
+		m.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestMFAChallengerShared(t *testing.T) {
+	release := make(chan error)
+	provider := &testMFAProvider{
+		methods: []string{kubetoken.MFAPush},
+		verify: func(r *mfaRequest, method, passcode string) error {
+			return <-release
+		},
+	}
+	a, cleanup := testMFAChallenger(t, map[string]MFAProvider{"test": provider})
+	defer cleanup()
+	b, err := openMFAChallenger(a.j.f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	b.Providers = a.Providers
+	b.Audit = a.Audit
+	router := func(m *MFAChallenger) *mux.Router {
+		r := mux.NewRouter()
+		r.Handle("/api/v1/mfa/{transaction}", m)
+		return r
+	}
+	poll := func(m *MFAChallenger, txid string) (int, kubetoken.MFAStatus) {
+		w := httptest.NewRecorder()
+		router(m).ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/mfa/"+txid, nil))
+		var status kubetoken.MFAStatus
+		json.NewDecoder(w.Body).Decode(&status)
+		return w.Code, status
+	}
+
+	// a challenge issued by one process may be answered at another,
+	// and its outcome polled at either.
+	c, err := a.challenge(mfaRequest{User: "dcheney"}, "test", []byte("csr"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	router(b).ServeHTTP(w, httptest.NewRequest("POST", "/api/v1/mfa/"+c.Transaction, strings.NewReader(`{"method": "push"}`)))
+	if w.Code != 202 {
+		t.Fatalf("push: got %d, want 202: %s", w.Code, w.Body)
+	}
+	if code, status := poll(a, c.Transaction); code != 200 || status.Status != kubetoken.MFAPending {
+		t.Errorf("pending: got %d %+v, want 200 pending", code, status)
+	}
+	w = httptest.NewRecorder()
+	router(a).ServeHTTP(w, httptest.NewRequest("POST", "/api/v1/mfa/"+c.Transaction, strings.NewReader(`{"method": "push"}`)))
+	if w.Code != 400 {
+		t.Errorf("second answer: got %d, want 400", w.Code)
+	}
+
+	// shutting down waits for the answer to be recorded.
+	if b.Wait(10 * time.Millisecond) {
+		t.Fatal("Wait returned before the answer was verified")
+	}
+	release <- nil
+	if !b.Wait(time.Second) {
+		t.Fatal("Wait timed out")
+	}
+	if code, status := poll(a, c.Transaction); code != 200 || status.Status != kubetoken.MFAAllow {
+		t.Errorf("allowed: got %d %+v, want 200 allow", code, status)
+	}
+	if err := a.redeem(c.Transaction, "dcheney", []byte("csr")); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.redeem(c.Transaction, "dcheney", []byte("csr")); err == nil {
+		t.Error("transaction redeemed twice")
+	}
+}
+
+func TestMFAChallengerPasscodeLimit(t *testing.T) {
+	m, cleanup := testMFAChallenger(t, map[string]MFAProvider{
+		"test": &testMFAProvider{
+			methods: []string{kubetoken.MFAPasscode},
+			verify: func(r *mfaRequest, method, passcode string) error {
+				return errors.New("incorrect passcode")
+			},
+		},
+	})
+	defer cleanup()
+	limiter := &Limiter{Threshold: 2 * maxPasscodeAttempts, Backoff: time.Minute, MaxBackoff: time.Hour}
+	m.Limiter = limiter
+	env := &Environment{Customer: "example", Environment: "prod"}
+	var signed []byte
+	signer := RateLimit(mfaTestSigner(&CertificateSigner{MFA: m, MFAPolicy: mfaRequired, Audit: m.Audit}, env, &signed), limiter, m.Audit)
+	r := mux.NewRouter()
+	r.Handle("/api/v1/mfa/{transaction}", m)
+
+	challenge := func() (*httptest.ResponseRecorder, string) {
+		req := httptest.NewRequest("POST", "/api/v1/signcsr", strings.NewReader("csr"))
+		req.SetBasicAuth("dcheney", "password")
+		req.Header.Set(kubetoken.MFAHeader, kubetoken.MFARequestChallenge)
+		req = req.WithContext(context.WithValue(req.Context(), identityKey{}, &kubetoken.Identity{User: "dcheney"}))
+		w := httptest.NewRecorder()
+		signer.ServeHTTP(w, req)
+		if w.Code != 401 {
+			return w, ""
+		}
+		var c kubetoken.MFAChallenge
+		if err := json.NewDecoder(w.Body).Decode(&c); err != nil {
+			t.Fatal(err)
+		}
+		return w, c.Transaction
+	}
+	answer := func(txid string) int {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("POST", "/api/v1/mfa/"+txid, strings.NewReader(`{"method": "passcode", "passcode": "000000"}`)))
+		return w.Code
+	}
+
+	// incorrect passcodes count against the user across challenges,
+	// until they may neither be challenged again nor answer challenges
+	// already issued.
+	_, spare := challenge()
+	for i := 0; i < 2; i++ {
+		w, txid := challenge()
+		if w.Code != 401 {
+			t.Fatalf("challenge %d: got %d, want 401", i, w.Code)
+		}
+		for j := 0; j < maxPasscodeAttempts; j++ {
+			if code := answer(txid); code != 403 {
+				t.Fatalf("challenge %d, passcode %d: got %d, want 403", i, j, code)
+			}
+		}
+	}
+	if w, _ := challenge(); w.Code != 429 {
+		t.Errorf("challenge after %d incorrect passcodes: got %d, want 429", 2*maxPasscodeAttempts, w.Code)
+	}
+	if code := answer(spare); code != 429 {
+		t.Errorf("answer after %d incorrect passcodes: got %d, want 429", 2*maxPasscodeAttempts, code)
+	}
+}
+
+// mfaTestSigner returns a handler which enforces the MFA policy of s
+// and env on requests for kube-example-web-prod-dl-prod, storing the
+// body of each request allowed in signed.
+func mfaTestSigner(s *CertificateSigner, env *Environment, signed *[]byte) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		deny := func(code int, reason string) {
+			http.Error(w, reason, code)
+		}
+		r := mfaRequest{
+			User:        identity(req).User,
+			Role:        "kube-example-web-prod-dl-prod",
+			Customer:    env.Customer,
+			Environment: env.Environment,
+		}
+		if s.checkMFA(w, req, env, r, body, deny) {
+			*signed = body
+		}
+	})
+}
+
+func TestCertificateSignerMFAPolicy(t *testing.T) {
+	m, cleanup := testMFAChallenger(t, map[string]MFAProvider{
+		"test": &testMFAProvider{methods: []string{kubetoken.MFAPush}},
+		"totp": &testMFAProvider{methods: []string{kubetoken.MFAPasscode}},
+	})
+	defer cleanup()
+	tests := []struct {
+		mfa       *MFAChallenger
+		policy    string // of the server
+		env       Environment
+		legacyMFA string
+		header    string
+		verified  string // the provider to which a second factor was given
+		want      int
+	}{
+		{mfa: m, policy: mfaRequired, verified: "test", want: 200},
+		{mfa: m, policy: mfaRequired, env: Environment{MFAProvider: "totp"}, verified: "test", header: kubetoken.MFARequestChallenge, want: 401},
+		{mfa: m, policy: mfaRequired, header: "", want: 403},
+		{mfa: m, policy: mfaRequired, header: kubetoken.MFARequestChallenge, want: 401},
+		{mfa: m, policy: mfaRequired, legacyMFA: "/api/v1/signcsr2fa", want: 403},
+		{mfa: m, policy: mfaRequired, env: Environment{MFAProvider: "duo"}, legacyMFA: "/api/v1/signcsr2fa", want: 399},
+		{mfa: m, policy: mfaRequired, env: Environment{MFAProvider: "duo"}, legacyMFA: "/api/v1/signcsr2fa", verified: "duo", want: 200},
+		{mfa: m, policy: mfaOptional, header: "", want: 200},
+		{mfa: m, policy: mfaOptional, header: kubetoken.MFARequestChallenge, want: 401},
+		{mfa: m, policy: mfaForbidden, header: kubetoken.MFARequestChallenge, want: 200},
+		{mfa: m, policy: mfaRequired, env: Environment{MFA: mfaForbidden}, header: kubetoken.MFARequestChallenge, want: 200},
+		{mfa: m, policy: mfaForbidden, env: Environment{MFA: mfaRequired}, header: kubetoken.MFARequestChallenge, want: 401},
+		{mfa: m, policy: mfaForbidden, env: Environment{Roles: []RolePolicy{{re: regexp.MustCompile("-prod$"), MFA: mfaRequired}}}, header: kubetoken.MFARequestChallenge, want: 401},
+		{mfa: m, policy: mfaRequired, env: Environment{Roles: []RolePolicy{{re: regexp.MustCompile("-dev$"), MFA: mfaForbidden}}}, header: kubetoken.MFARequestChallenge, want: 401},
+		{env: Environment{MFA: mfaRequired}, header: kubetoken.MFARequestChallenge, want: 500},
+		{want: 200},
+	}
+	for i, tt := range tests {
+		env := tt.env
+		env.Customer, env.Environment = "example", "prod"
+		s := &CertificateSigner{MFA: tt.mfa, MFAPolicy: tt.policy, LegacyMFA: tt.legacyMFA, Audit: m.Audit}
+		var signed []byte
+		req := httptest.NewRequest("POST", "/api/v1/signcsr", strings.NewReader("csr"))
+		if tt.header != "" {
+			req.Header.Set(kubetoken.MFAHeader, tt.header)
+		}
+		ctx := context.WithValue(req.Context(), identityKey{}, &kubetoken.Identity{User: "dcheney"})
+		if tt.verified != "" {
+			ctx = context.WithValue(ctx, mfaVerifiedKey{}, tt.verified)
+		}
+		req = req.WithContext(ctx)
+		w := httptest.NewRecorder()
+		mfaTestSigner(s, &env, &signed).ServeHTTP(w, req)
+		if w.Code != tt.want {
+			t.Errorf("%d: got %d, want %d: %s", i, w.Code, tt.want, w.Body)
+		}
+		if (signed != nil) != (tt.want == 200) {
+			t.Errorf("%d: got signed %v, want %v", i, signed != nil, tt.want == 200)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/atlassian/kubetoken/internal/cert"
+	"golang.org/x/crypto/ocsp"
+)
+
+// ocspContentType is the media type of OCSP requests.
+const ocspContentType = "application/ocsp-request"
+
+// OCSPResponder answers RFC 6960 OCSP requests for certificates issued
+// by the CA of any context in Config, using the certificate registry to
+// determine whether a certificate is good, revoked, or unknown.
+// Responses are signed by the issuing CA and are valid for Validity.
+type OCSPResponder struct {
+	Config   configSource
+	Registry *Registry
+	Validity time.Duration
+}
+
+func (o *OCSPResponder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var der []byte
+	var err error
+	switch req.Method {
+	case "GET":
+		// RFC 6960, appendix A.1; the request is base64 encoded
+		// then appended to the responder's URL.
+		i := strings.Index(req.URL.Path, "/ocsp/")
+		if i < 0 {
+			http.Error(w, "missing OCSP request", 400)
+			return
+		}
+		der, err = base64.StdEncoding.DecodeString(req.URL.Path[i+len("/ocsp/"):])
+	case "POST":
+		if ct := req.Header.Get("Content-Type"); ct != ocspContentType {
+			http.Error(w, "expected Content-Type "+ocspContentType+", got "+ct, 415)
+			return
+		}
+		der, err = ioutil.ReadAll(http.MaxBytesReader(w, req.Body, 1<<16))
+	default:
+		http.Error(w, "method not allowed", 405)
+		return
+	}
+	if err != nil {
+		writeOCSP(w, ocsp.MalformedRequestErrorResponse)
+		return
+	}
+	r, err := ocsp.ParseRequest(der)
+	if err != nil {
+		writeOCSP(w, ocsp.MalformedRequestErrorResponse)
+		return
+	}
+
+	ctx := o.issuer(r)
+	if ctx == nil {
+		writeOCSP(w, ocsp.UnauthorizedErrorResponse)
+		return
+	}
+	iss, rev, err := o.Registry.Status(r.SerialNumber.String())
+	if err != nil {
+		log.Printf("ocsp: %v", err)
+		writeOCSP(w, ocsp.InternalErrorErrorResponse)
+		return
+	}
+
+	now := time.Now().UTC().Truncate(time.Minute)
+	template := ocsp.Response{
+		Status:       ocsp.Good,
+		SerialNumber: r.SerialNumber,
+		IssuerHash:   r.HashAlgorithm,
+		ThisUpdate:   now,
+		NextUpdate:   now.Add(o.Validity),
+	}
+	switch {
+	case iss == nil || iss.Issuer != issuerID(ctx.Signer.Cert):
+		template.Status = ocsp.Unknown
+	case rev != nil:
+		template.Status = ocsp.Revoked
+		template.RevokedAt = rev.Time
+		template.RevocationReason = revocationReasons[rev.Reason]
+	}
+	resp, err := ocsp.CreateResponse(ctx.Signer.Cert, ctx.Signer.Cert, template, ctx.Signer.PrivKey)
+	if err != nil {
+		log.Printf("ocsp: %v", err)
+		writeOCSP(w, ocsp.InternalErrorErrorResponse)
+		return
+	}
+	writeOCSP(w, resp)
+}
+
+// issuer returns the Context whose CA matches the issuer name and key
+// hashes of r, or nil if there is no such Context.
+func (o *OCSPResponder) issuer(r *ocsp.Request) *Context {
+	if !r.HashAlgorithm.Available() {
+		return nil
+	}
+	sum := func(b []byte) []byte {
+		h := r.HashAlgorithm.New()
+		h.Write(b)
+		return h.Sum(nil)
+	}
+	c := o.Config.Current()
+	for i := range c.Environments {
+		e := &c.Environments[i]
+		for j := range e.Contexts {
+			ctx := &e.Contexts[j]
+			ca := ctx.Signer.Cert
+			if bytes.Equal(sum(ca.RawSubject), r.IssuerNameHash) && bytes.Equal(sum(cert.SubjectPublicKey(ca)), r.IssuerKeyHash) {
+				return ctx
+			}
+		}
+	}
+	return nil
+}
+
+func writeOCSP(w http.ResponseWriter, resp []byte) {
+	w.Header().Set("Content-Type", "application/ocsp-response")
+	w.Write(resp)
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/atlassian/kubetoken/internal/cert"
+	"golang.org/x/crypto/ocsp"
+)
+
+// testConfig returns a Config with a single environment, example/dev,
+// whose context is signed by the test CA.
+func testConfig(t *testing.T) *Config {
+	c := &Config{
+		Environments: []Environment{{
+			Customer:    "example",
+			Environment: "dev",
+			Contexts: []Context{{
+				CACert:  "../../internal/cert/_testdata/ssl/ca.pem",
+				PrivKey: "../../internal/cert/_testdata/ssl/ca-key.pem",
+				Clusters: map[string]string{
+					"example": "https://example.com",
+				},
+			}},
+		}},
+	}
+	if err := c.validate(nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadCertificates(c); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// testRegistry returns a Registry in a temporary directory, and a
+// function to remove it.
+func testRegistry(t *testing.T) (*Registry, func()) {
+	dir, err := ioutil.TempDir("", "kubetokend_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := openRegistry(filepath.Join(dir, "registry.json"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return r, func() {
+		r.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// testCSR returns a CSR for user and role.
+func testCSR(t *testing.T, user, role string) *x509.CertificateRequest {
+	csrPEM, _, err := cert.NewCSR(user, role, cert.ECDSA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := readCSR(bytes.NewReader(csrPEM))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return csr
+}
+
+func TestOCSPResponder(t *testing.T) {
+	config := testConfig(t)
+	registry, cleanup := testRegistry(t)
+	defer cleanup()
+
+	ctx := &config.Environments[0].Contexts[0]
+	s := &CertificateSigner{Config: config, Registry: registry}
+	_, crts, err := s.sign(config.Environments[0].Contexts, testCSR(t, "dcheney", "kube-example-web-dev-dl-dev"), time.Now().Add(time.Hour), Issuance{
+		User: "dcheney",
+		Role: "kube-example-web-dev-dl-dev",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	crt := crts[0]
+
+	o := &OCSPResponder{
+		Config:   config,
+		Registry: registry,
+		Validity: time.Hour,
+	}
+	query := func(t *testing.T, leaf *x509.Certificate, get bool) *ocsp.Response {
+		der, err := ocsp.CreateRequest(leaf, ctx.Signer.Cert, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := httptest.NewRequest("POST", "/api/v1/ocsp", bytes.NewReader(der))
+		req.Header.Set("Content-Type", ocspContentType)
+		if get {
+			req = httptest.NewRequest("GET", "/api/v1/ocsp/"+base64.StdEncoding.EncodeToString(der), nil)
+		}
+		w := httptest.NewRecorder()
+		o.ServeHTTP(w, req)
+		resp, err := ocsp.ParseResponseForCert(w.Body.Bytes(), leaf, ctx.Signer.Cert)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	if resp := query(t, crt, false); resp.Status != ocsp.Good {
+		t.Fatalf("issued certificate: got status %d, want %d", resp.Status, ocsp.Good)
+	}
+
+	unknown := *crt
+	unknown.SerialNumber = big.NewInt(42)
+	if resp := query(t, &unknown, true); resp.Status != ocsp.Unknown {
+		t.Fatalf("unknown certificate: got status %d, want %d", resp.Status, ocsp.Unknown)
+	}
+
+	if _, err := registry.Revoke(func(iss *Issuance) bool { return iss.User == "dcheney" }, Revocation{Reason: "keyCompromise"}); err != nil {
+		t.Fatal(err)
+	}
+	resp := query(t, crt, true)
+	if resp.Status != ocsp.Revoked {
+		t.Fatalf("revoked certificate: got status %d, want %d", resp.Status, ocsp.Revoked)
+	}
+	if resp.RevocationReason != ocsp.KeyCompromise {
+		t.Errorf("revoked certificate: got reason %d, want %d", resp.RevocationReason, ocsp.KeyCompromise)
+	}
+}
+
+func TestOCSPResponderUnknownIssuer(t *testing.T) {
+	config := testConfig(t)
+	registry, cleanup := testRegistry(t)
+	defer cleanup()
+
+	caPEM, _, err := cert.NewCA("other-ca", time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(caPEM)
+	other, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := ocsp.CreateRequest(other, other, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	o := &OCSPResponder{Config: config, Registry: registry, Validity: time.Hour}
+	req := httptest.NewRequest("POST", "/api/v1/ocsp", bytes.NewReader(der))
+	req.Header.Set("Content-Type", ocspContentType)
+	w := httptest.NewRecorder()
+	o.ServeHTTP(w, req)
+	if !bytes.Equal(w.Body.Bytes(), ocsp.UnauthorizedErrorResponse) {
+		t.Fatalf("expected unauthorized response, got %x", w.Body.Bytes())
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/atlassian/kubetoken"
+)
+
+// auditRateLimit is the audit event recorded when a request is refused
+// by the Limiter.
+const auditRateLimit = "ratelimit"
+
+// Limiter protects authenticated endpoints from password spraying and
+// account lockout. Requests are limited per username, and if Addresses
+// is set per client address, and once Threshold consecutive attempts
+// have failed further attempts are refused, before they reach LDAP, for
+// Backoff, doubling with each further failure up to MaxBackoff.
+type Limiter struct {
+	// Addresses enables limits per client address as well as per
+	// username. Every client behind a reverse proxy shares its address
+	// unless the proxy's headers are trusted.
+	Addresses bool
+
+	// Rate is the sustained number of requests per second permitted
+	// for each username and address, and Burst the number which may be
+	// made at once. If Rate is zero, requests are not rate limited.
+	Rate  float64
+	Burst int
+
+	// Threshold is the number of consecutive failures after which a
+	// username or address is blocked. If zero, failures are not counted.
+	Threshold  int
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+
+	// ResetAfter is how long after its last failure a username or
+	// address's failures are forgotten.
+	ResetAfter time.Duration
+
+	mu     sync.Mutex
+	keys   map[string]*limitEntry // keyed by scope:user or scope:addr
+	pruned time.Time
+	now    func() time.Time // for testing
+}
+
+type limitEntry struct {
+	tokens   float64
+	last     time.Time // last request
+	failures int
+	failed   time.Time // last failure
+	blocked  time.Time // refuse requests until
+}
+
+// Limit scopes.
+const (
+	limitUser    = "user"
+	limitAddress = "address"
+)
+
+// Limit kinds.
+const (
+	limitRate     = "rate"
+	limitFailures = "failures"
+)
+
+// refusal describes why a request was refused.
+type refusal struct {
+	scope, kind string
+	retryAfter  time.Duration
+}
+
+func (r *refusal) Error() string {
+	if r.kind == limitRate {
+		return fmt.Sprintf("too many requests for %s", r.scope)
+	}
+	return fmt.Sprintf("too many failed attempts for %s, retry after %v", r.scope, r.retryAfter)
+}
+
+func (l *Limiter) clock() time.Time {
+	if l.now != nil {
+		return l.now()
+	}
+	return time.Now()
+}
+
+// Allow reports whether a request for user from addr may proceed. If
+// user is empty, as it is for bearer tokens, only addr is limited, if
+// l.Addresses is set.
+func (l *Limiter) Allow(user, addr string) *refusal {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.clock()
+	l.prune(now)
+	entries := l.entries(user, addr)
+	for i, e := range entries {
+		scope := limitAddress
+		if i == 0 && user != "" {
+			scope = limitUser
+		}
+		if now.Before(e.blocked) {
+			return &refusal{scope: scope, kind: limitFailures, retryAfter: e.blocked.Sub(now)}
+		}
+		if l.Rate > 0 {
+			e.tokens = math.Min(float64(l.Burst), e.tokens+now.Sub(e.last).Seconds()*l.Rate)
+			if e.tokens < 1 {
+				return &refusal{scope: scope, kind: limitRate, retryAfter: time.Duration((1 - e.tokens) / l.Rate * float64(time.Second))}
+			}
+		}
+	}
+	for _, e := range entries {
+		if l.Rate > 0 {
+			e.tokens--
+		}
+		e.last = now
+	}
+	return nil
+}
+
+// Failure records a failed attempt for user from addr.
+func (l *Limiter) Failure(user, addr string) {
+	if l.Threshold <= 0 {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.clock()
+	for _, e := range l.entries(user, addr) {
+		if l.ResetAfter > 0 && now.Sub(e.failed) > l.ResetAfter {
+			e.failures = 0
+		}
+		e.failures++
+		e.failed = now
+		if n := e.failures - l.Threshold; n >= 0 {
+			backoff := l.Backoff << uint(n)
+			if backoff > l.MaxBackoff || backoff <= 0 {
+				backoff = l.MaxBackoff
+			}
+			e.blocked = now.Add(backoff)
+		}
+	}
+}
+
+// Success records a successful attempt by user, clearing its failures.
+// The failures of the client address are not cleared, so that a client
+// cannot reset its count by authenticating as a valid user.
+func (l *Limiter) Success(user string) {
+	if user == "" {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	e := l.entry(limitUser, user)
+	e.failures = 0
+	e.blocked = time.Time{}
+}
+
+// entries returns the entries for user, if not empty, and addr, if
+// l.Addresses is set.
+func (l *Limiter) entries(user, addr string) []*limitEntry {
+	var entries []*limitEntry
+	if user != "" {
+		entries = append(entries, l.entry(limitUser, user))
+	}
+	if l.Addresses {
+		entries = append(entries, l.entry(limitAddress, addr))
+	}
+	return entries
+}
+
+func (l *Limiter) entry(scope, key string) *limitEntry {
+	if l.keys == nil {
+		l.keys = make(map[string]*limitEntry)
+	}
+	k := scope + ":" + key
+	e, ok := l.keys[k]
+	if !ok {
+		e = &limitEntry{tokens: float64(l.Burst), last: l.clock()}
+		l.keys[k] = e
+	}
+	return e
+}
+
+// prune discards entries which no longer affect any request.
+func (l *Limiter) prune(now time.Time) {
+	idle := l.ResetAfter
+	if l.MaxBackoff > idle {
+		idle = l.MaxBackoff
+	}
+	if l.Rate > 0 {
+		if fill := time.Duration(float64(l.Burst) / l.Rate * float64(time.Second)); fill > idle {
+			idle = fill
+		}
+	}
+	if now.Sub(l.pruned) < idle {
+		return
+	}
+	l.pruned = now
+	for k, e := range l.keys {
+		if now.Sub(e.last) > idle && now.Sub(e.failed) > idle && now.After(e.blocked) {
+			delete(l.keys, k)
+		}
+	}
+}
+
+// RateLimit inserts a Limiter before next. Responses of 401 from next
+// are counted as failures, other than MFA challenges, and 2xx responses
+// as successes. A 403, such as a role refused to a user whose password
+// was accepted, is neither. Refused requests are recorded in audit.
+func RateLimit(next http.Handler, l *Limiter, audit *Auditor) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		user, _, _ := req.BasicAuth()
+		addr := clientIP(req)
+		if r := l.Allow(user, addr); r != nil {
+			writeRefusal(w, req, r, user, audit)
+			return
+		}
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, req)
+		switch {
+		case sw.status == 401 && strings.HasPrefix(sw.Header().Get("WWW-Authenticate"), kubetoken.MFAScheme):
+			// the user's password was accepted; a second factor is
+			// yet to be given.
+		case sw.status == 401:
+			l.Failure(user, addr)
+		case sw.status >= 200 && sw.status < 300:
+			l.Success(user)
+		}
+	})
+}
+
+// writeRefusal replies to req, made by user, with the refusal r, and
+// records it in audit.
+func writeRefusal(w http.ResponseWriter, req *http.Request, r *refusal, user string, audit *Auditor) {
+	rateLimited.WithLabelValues(r.scope, r.kind).Inc()
+	audit.Record(req, AuditEvent{
+		Event:   auditRateLimit,
+		Outcome: outcomeDenied,
+		User:    user,
+		Reason:  r.Error(),
+	})
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(r.retryAfter.Seconds()))))
+	http.Error(w, r.Error(), 429)
+}
+
+// statusWriter records the status code written to a ResponseWriter.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = 200
+	}
+	return w.ResponseWriter.Write(b)
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLimiterFailures(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	l := &Limiter{
+		Addresses:  true,
+		Threshold:  3,
+		Backoff:    time.Minute,
+		MaxBackoff: 4 * time.Minute,
+		ResetAfter: time.Hour,
+		now:        func() time.Time { return now },
+	}
+
+	for i := 0; i < 2; i++ {
+		l.Failure("dcheney", "10.0.0.1")
+	}
+	if r := l.Allow("dcheney", "10.0.0.1"); r != nil {
+		t.Fatalf("blocked below threshold: %v", r)
+	}
+
+	// the third failure blocks for Backoff, each further failure doubles
+	// the block, up to MaxBackoff.
+	for i, want := range []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute, 4 * time.Minute} {
+		l.Failure("dcheney", "10.0.0.1")
+		r := l.Allow("dcheney", "10.0.0.1")
+		if r == nil || r.kind != limitFailures || r.retryAfter != want {
+			t.Fatalf("%d: got %+v, want block for %v", i, r, want)
+		}
+	}
+
+	// another user from the same address is also blocked, as is the
+	// same user from another address.
+	if r := l.Allow("other", "10.0.0.1"); r == nil || r.scope != limitAddress {
+		t.Fatalf("expected address to be blocked, got %+v", r)
+	}
+	if r := l.Allow("dcheney", "10.0.0.2"); r == nil || r.scope != limitUser {
+		t.Fatalf("expected user to be blocked, got %+v", r)
+	}
+
+	now = now.Add(5 * time.Minute)
+	if r := l.Allow("dcheney", "10.0.0.2"); r != nil {
+		t.Fatalf("block not lifted: %v", r)
+	}
+	// a success clears the user's failures, but not the address's.
+	l.Success("dcheney")
+	l.Failure("dcheney", "10.0.0.1")
+	if r := l.Allow("dcheney", "10.0.0.2"); r != nil {
+		t.Fatalf("user blocked after success: %v", r)
+	}
+	if r := l.Allow("other", "10.0.0.1"); r == nil || r.scope != limitAddress {
+		t.Fatalf("expected address to remain blocked, got %+v", r)
+	}
+}
+
+func TestLimiterUsersOnly(t *testing.T) {
+	l := &Limiter{Threshold: 1, Backoff: time.Minute, MaxBackoff: time.Minute}
+	l.Failure("dcheney", "10.0.0.1")
+	if r := l.Allow("dcheney", "10.0.0.2"); r == nil || r.scope != limitUser {
+		t.Fatalf("expected user to be blocked, got %+v", r)
+	}
+	// without Addresses, users behind a shared address are unaffected.
+	if r := l.Allow("other", "10.0.0.1"); r != nil {
+		t.Fatalf("address blocked: %v", r)
+	}
+	l.Failure("", "10.0.0.1")
+	if r := l.Allow("", "10.0.0.1"); r != nil {
+		t.Fatalf("address blocked: %v", r)
+	}
+}
+
+func TestLimiterRate(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	l := &Limiter{
+		Rate:  1,
+		Burst: 2,
+		now:   func() time.Time { return now },
+	}
+	for i := 0; i < 2; i++ {
+		if r := l.Allow("dcheney", "10.0.0.1"); r != nil {
+			t.Fatalf("%d: refused within burst: %v", i, r)
+		}
+	}
+	if r := l.Allow("dcheney", "10.0.0.1"); r == nil || r.kind != limitRate {
+		t.Fatalf("expected rate limit, got %+v", r)
+	}
+	now = now.Add(time.Second)
+	if r := l.Allow("dcheney", "10.0.0.1"); r != nil {
+		t.Fatalf("refused after refill: %v", r)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	var buf bytes.Buffer
+	audit := &Auditor{w: &buf}
+	l := &Limiter{Threshold: 2, Backoff: time.Minute, MaxBackoff: time.Minute}
+	calls := 0
+	code := 403
+	h := RateLimit(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		calls++
+		http.Error(w, http.StatusText(code), code)
+	}), l, audit)
+	serve := func() int {
+		req := httptest.NewRequest("GET", "/api/v1/roles", nil)
+		req.SetBasicAuth("dcheney", "hunter2")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// a role refused is not an authentication failure.
+	for i := 0; i < 3; i++ {
+		if got := serve(); got != 403 {
+			t.Fatalf("%d: got %d, want 403", i, got)
+		}
+	}
+	if buf.Len() != 0 {
+		t.Fatalf("unexpected audit events: %s", &buf)
+	}
+
+	code = 401
+	calls = 0
+	codes := []int{}
+	for i := 0; i < 3; i++ {
+		codes = append(codes, serve())
+	}
+	if codes[0] != 401 || codes[1] != 401 || codes[2] != 429 {
+		t.Fatalf("got codes %v, want [401 401 429]", codes)
+	}
+	if calls != 2 {
+		t.Fatalf("blocked request reached the handler; %d calls", calls)
+	}
+
+	var ev AuditEvent
+	if err := json.Unmarshal(buf.Bytes(), &ev); err != nil {
+		t.Fatal(err)
+	}
+	if ev.Event != auditRateLimit || ev.Outcome != outcomeDenied || ev.User != "dcheney" {
+		t.Fatalf("unexpected audit event: %+v", ev)
+	}
+}
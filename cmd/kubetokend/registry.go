@@ -0,0 +1,228 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"math/big"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// errDuplicateSerial is returned by Registry.Record if a certificate
+// with the same serial number has already been issued.
+var errDuplicateSerial = errors.New("duplicate certificate serial number")
+
+// Issuance describes a certificate issued by kubetokend.
+type Issuance struct {
+	Serial      string    `json:"serial"`
+	Issuer      string    `json:"issuer"` // see issuerID
+	User        string    `json:"user"`
+	Role        string    `json:"role"`
+	Customer    string    `json:"customer"`
+	Environment string    `json:"environment"`
+	Namespace   string    `json:"namespace"`
+	NotBefore   time.Time `json:"notbefore"`
+	NotAfter    time.Time `json:"notafter"`
+
+	// Authenticated is the time at which the user last gave their
+	// credentials; renewals carry it forward. If zero, NotBefore.
+	Authenticated time.Time `json:"authenticated,omitempty"`
+
+	// RenewedFrom is the serial number of the certificate renewed, if
+	// any.
+	RenewedFrom string `json:"renewedfrom,omitempty"`
+}
+
+// Revocation describes the revocation of a certificate before its expiry.
+type Revocation struct {
+	Serial string    `json:"serial"`
+	Time   time.Time `json:"time"`
+	Reason string    `json:"reason,omitempty"` // see revocationReasons
+	By     string    `json:"by,omitempty"`     // the administrator who revoked the certificate
+}
+
+// revocationReasons maps the accepted revocation reasons to their
+// RFC 5280 CRLReason codes.
+var revocationReasons = map[string]int{
+	"":                     0,
+	"unspecified":          0,
+	"keyCompromise":        1,
+	"affiliationChanged":   3,
+	"superseded":           4,
+	"cessationOfOperation": 5,
+}
+
+// registryRecord is a single line in the registry file.
+type registryRecord struct {
+	Issued  *Issuance   `json:"issued,omitempty"`
+	Revoked *Revocation `json:"revoked,omitempty"`
+}
+
+// Registry is a persistent, append only, record of every certificate
+// issued by kubetokend. The registry is stored as a journal, which may
+// be shared by several kubetokend processes.
+type Registry struct {
+	j       *journal
+	issued  map[string]*Issuance
+	revoked map[string]*Revocation
+}
+
+// openRegistry opens, creating if necessary, the registry stored at path.
+func openRegistry(path string) (*Registry, error) {
+	r := &Registry{
+		issued:  make(map[string]*Issuance),
+		revoked: make(map[string]*Revocation),
+	}
+	j, err := openJournal(path, "registry", r.apply)
+	if err != nil {
+		return nil, err
+	}
+	r.j = j
+	return r, nil
+}
+
+// Close closes the underlying registry file.
+func (r *Registry) Close() error {
+	return r.j.Close()
+}
+
+// Record adds issued to the registry together. If a certificate with
+// the same serial number as any of them has been issued previously,
+// none are added and errDuplicateSerial is returned.
+func (r *Registry) Record(issued ...Issuance) error {
+	return r.j.write(func() error {
+		serials := make(map[string]bool)
+		for _, iss := range issued {
+			if _, ok := r.issued[iss.Serial]; ok || serials[iss.Serial] {
+				return errDuplicateSerial
+			}
+			serials[iss.Serial] = true
+		}
+		recs := make([]interface{}, len(issued))
+		for i := range issued {
+			recs[i] = registryRecord{Issued: &issued[i]}
+		}
+		return r.j.append(recs...)
+	})
+}
+
+// Lookup returns the Issuance for the certificate with the given serial number.
+func (r *Registry) Lookup(serial string) (*Issuance, bool, error) {
+	var iss *Issuance
+	err := r.j.read(func() error {
+		iss = r.issued[serial]
+		return nil
+	})
+	return iss, iss != nil, err
+}
+
+// Status returns the Issuance for the certificate with the given serial
+// number, and its Revocation if the certificate has been revoked.
+// If no such certificate has been issued, Status returns nil, nil, nil.
+func (r *Registry) Status(serial string) (*Issuance, *Revocation, error) {
+	var iss *Issuance
+	var rev *Revocation
+	err := r.j.read(func() error {
+		iss, rev = r.issued[serial], r.revoked[serial]
+		return nil
+	})
+	return iss, rev, err
+}
+
+// Revoke revokes every unexpired, unrevoked, certificate for which match
+// returns true, returning the Issuances of the certificates revoked.
+// The Serial field of rev is ignored.
+func (r *Registry) Revoke(match func(*Issuance) bool, rev Revocation) ([]*Issuance, error) {
+	if _, ok := revocationReasons[rev.Reason]; !ok {
+		return nil, errors.Errorf("unknown revocation reason %q", rev.Reason)
+	}
+	if rev.Time.IsZero() {
+		rev.Time = time.Now().UTC()
+	}
+	var revoked []*Issuance
+	err := r.j.write(func() error {
+		var recs []interface{}
+		for serial, iss := range r.issued {
+			if _, ok := r.revoked[serial]; ok || iss.NotAfter.Before(rev.Time) || !match(iss) {
+				continue
+			}
+			rev := rev
+			rev.Serial = serial
+			recs = append(recs, registryRecord{Revoked: &rev})
+			revoked = append(revoked, iss)
+		}
+		if len(recs) == 0 {
+			return nil
+		}
+		return r.j.append(recs...)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return revoked, nil
+}
+
+// Revocations returns the number of revocations recorded in the registry.
+func (r *Registry) Revocations() (int, error) {
+	var n int
+	err := r.j.read(func() error {
+		n = len(r.revoked)
+		return nil
+	})
+	return n, err
+}
+
+// Revoked returns the CRL entries for every unexpired certificate
+// issued by the CA identified by issuer which has been revoked.
+func (r *Registry) Revoked(issuer string) ([]x509.RevocationListEntry, error) {
+	var entries []x509.RevocationListEntry
+	err := r.j.read(func() error {
+		now := time.Now()
+		for serial, rev := range r.revoked {
+			iss, ok := r.issued[serial]
+			if !ok || iss.Issuer != issuer || iss.NotAfter.Before(now) {
+				continue
+			}
+			n, ok := new(big.Int).SetString(serial, 10)
+			if !ok {
+				return errors.Errorf("invalid serial number %q", serial)
+			}
+			entries = append(entries, x509.RevocationListEntry{
+				SerialNumber:   n,
+				RevocationTime: rev.Time,
+				ReasonCode:     revocationReasons[rev.Reason],
+			})
+		}
+		return nil
+	})
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].SerialNumber.Cmp(entries[j].SerialNumber) < 0
+	})
+	return entries, err
+}
+
+// apply applies a record read from the registry file.
+func (r *Registry) apply(line []byte) error {
+	var rec registryRecord
+	if err := json.Unmarshal(line, &rec); err != nil {
+		return err
+	}
+	if iss := rec.Issued; iss != nil {
+		r.issued[iss.Serial] = iss
+	}
+	if rev := rec.Revoked; rev != nil {
+		r.revoked[rev.Serial] = rev
+	}
+	return nil
+}
+
+// issuerID returns an identifier for the key of a CA certificate which
+// is stable across reissues of the certificate.
+func issuerID(ca *x509.Certificate) string {
+	sum := sha256.Sum256(ca.RawSubjectPublicKeyInfo)
+	return hex.EncodeToString(sum[:])
+}
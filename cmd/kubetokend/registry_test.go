@@ -0,0 +1,145 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRegistry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "registry_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "registry.json")
+
+	r1, err := openRegistry(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r1.Close()
+
+	iss := Issuance{
+		Serial:   "1234",
+		User:     "dcheney",
+		Role:     "kube-example-web-dev-dl-dev",
+		NotAfter: time.Now().Add(time.Hour).UTC().Truncate(time.Second),
+	}
+	if err := r1.Record(iss); err != nil {
+		t.Fatal(err)
+	}
+	if err := r1.Record(iss); err != errDuplicateSerial {
+		t.Fatalf("Record: got err %v, want %v", err, errDuplicateSerial)
+	}
+
+	// a second registry sharing the same file sees records from the first,
+	// and vice versa.
+	r2, err := openRegistry(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r2.Close()
+	got, ok, err := r2.Lookup(iss.Serial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Fatalf("Lookup(%q): not found", iss.Serial)
+	}
+	if got.User != iss.User || got.Role != iss.Role || !got.NotAfter.Equal(iss.NotAfter) {
+		t.Fatalf("Lookup(%q): got %+v, want %+v", iss.Serial, got, iss)
+	}
+	if err := r2.Record(Issuance{Serial: "5678", User: "bot-bot"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r1.Record(Issuance{Serial: "5678"}); err != errDuplicateSerial {
+		t.Fatalf("Record: got err %v, want %v", err, errDuplicateSerial)
+	}
+	if _, ok, _ := r1.Lookup("9999"); ok {
+		t.Fatalf("Lookup(%q): unexpectedly found", "9999")
+	}
+
+	// certificates recorded together are all recorded, or none are.
+	if err := r1.Record(Issuance{Serial: "9999"}, Issuance{Serial: "1234"}); err != errDuplicateSerial {
+		t.Fatalf("Record: got err %v, want %v", err, errDuplicateSerial)
+	}
+	if _, ok, _ := r2.Lookup("9999"); ok {
+		t.Fatalf("Lookup(%q): recorded with a duplicate", "9999")
+	}
+}
+
+func TestRegistryRevoke(t *testing.T) {
+	dir, err := ioutil.TempDir("", "registry_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	r, err := openRegistry(filepath.Join(dir, "registry.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	now := time.Now().UTC()
+	for _, iss := range []Issuance{
+		{Serial: "1", Issuer: "ca1", User: "alice", Role: "dev", NotAfter: now.Add(time.Hour)},
+		{Serial: "2", Issuer: "ca1", User: "alice", Role: "prod", NotAfter: now.Add(time.Hour)},
+		{Serial: "3", Issuer: "ca2", User: "alice", Role: "dev", NotAfter: now.Add(time.Hour)},
+		{Serial: "4", Issuer: "ca1", User: "bob", Role: "dev", NotAfter: now.Add(time.Hour)},
+		{Serial: "5", Issuer: "ca1", User: "alice", Role: "dev", NotAfter: now.Add(-time.Hour)},
+	} {
+		if err := r.Record(iss); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := r.Revoke(func(*Issuance) bool { return true }, Revocation{Reason: "bogus"}); err == nil {
+		t.Fatal("expected error for unknown revocation reason")
+	}
+
+	// revoke alice's unexpired dev certificates.
+	revoked, err := r.Revoke(func(iss *Issuance) bool {
+		return iss.User == "alice" && iss.Role == "dev"
+	}, Revocation{Reason: "keyCompromise", By: "admin"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revoked) != 2 {
+		t.Fatalf("expected 2 certificates revoked, got %d", len(revoked))
+	}
+
+	// certificates which have already been revoked are skipped.
+	revoked, err = r.Revoke(func(iss *Issuance) bool { return iss.User == "alice" }, Revocation{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revoked) != 1 || revoked[0].Serial != "2" {
+		t.Fatalf("expected only serial 2 to be revoked, got %v", revoked)
+	}
+
+	_, rev, err := r.Status("1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rev == nil || rev.Reason != "keyCompromise" || rev.By != "admin" {
+		t.Fatalf("Status(1): unexpected revocation %+v", rev)
+	}
+	if _, rev, _ := r.Status("4"); rev != nil {
+		t.Fatalf("Status(4): unexpectedly revoked: %+v", rev)
+	}
+
+	entries, err := r.Revoked("ca1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].SerialNumber.Int64() != 1 || entries[1].SerialNumber.Int64() != 2 {
+		t.Fatalf("Revoked(ca1): got %v", entries)
+	}
+	if entries[0].ReasonCode != 1 {
+		t.Errorf("Revoked(ca1): reason code: got %d, want 1", entries[0].ReasonCode)
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/atlassian/kubetoken"
+)
+
+// configSource provides the configuration to use for a request.
+// Handlers call Current once per request so that a request is served
+// entirely with one configuration, even if a reload happens meanwhile.
+type configSource interface {
+	Current() *Config
+}
+
+// Current returns c; a *Config is a configSource which never changes.
+func (c *Config) Current() *Config { return c }
+
+// ConfigLoader is a configSource which loads the configuration file at
+// Path, and the CA material it references, and reloads them when they
+// change. A configuration is only swapped in once it has been loaded and
+// validated in full; if a reload fails the previous configuration is kept.
+type ConfigLoader struct {
+	Path string
+
+	// MFAProviders are the names of the configured MFA providers,
+	// which the configuration may name.
+	MFAProviders []string
+
+	config atomic.Value // *Config
+
+	mu     sync.Mutex           // serialises reloads
+	stamps map[string]fileStamp // stamps of the files read by the last successful load
+}
+
+// fileStamp identifies a version of a file.
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// newConfigLoader returns a ConfigLoader which has loaded the
+// configuration at path, which may name mfaProviders.
+func newConfigLoader(path string, mfaProviders []string) (*ConfigLoader, error) {
+	l := &ConfigLoader{Path: path, MFAProviders: mfaProviders}
+	return l, l.Reload()
+}
+
+// Current returns the most recently loaded configuration.
+func (l *ConfigLoader) Current() *Config {
+	c, _ := l.config.Load().(*Config)
+	return c
+}
+
+// Reload loads, validates and swaps in the configuration at l.Path.
+func (l *ConfigLoader) Reload() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// stamp the files before they are read, whether or not they turn
+	// out to be valid, so that a broken configuration is retried only
+	// once it has changed again.
+	files := []string{l.Path}
+	prev := l.Current()
+	if prev != nil {
+		files = prev.files(l.Path)
+	}
+	l.stamps = stampFiles(files)
+
+	config, err := readConfig(l.Path, l.MFAProviders)
+	if err != nil {
+		return err
+	}
+	if prev != nil && config.Directory != prev.Directory {
+		// the authenticators were configured with the directory
+		// layout at startup.
+		log.Printf("warning: directory changed, kubetokend must be restarted to use it")
+	}
+	for path, stamp := range stampFiles(config.files(l.Path)) {
+		if _, ok := l.stamps[path]; !ok {
+			l.stamps[path] = stamp
+		}
+	}
+	l.config.Store(config)
+	return nil
+}
+
+// readConfig loads and validates the configuration at path, which may
+// name mfaProviders, and loads the CA material it references.
+func readConfig(path string, mfaProviders []string) (*Config, error) {
+	config, err := loadConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := config.validate(mfaProviders); err != nil {
+		return nil, err
+	}
+	if err := loadCertificates(config); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// changed reports whether any of the files read by the last load have
+// changed since.
+func (l *ConfigLoader) changed() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for path, stamp := range l.stamps {
+		if stampFile(path) != stamp {
+			return true
+		}
+	}
+	return false
+}
+
+// Watch reloads the configuration when a value is received on reload,
+// or when one of its files is found to have changed, checking every
+// interval. If interval is zero, files are not checked. Watch does not
+// return.
+func (l *ConfigLoader) Watch(reload <-chan os.Signal, interval time.Duration) {
+	var tick <-chan time.Time
+	if interval > 0 {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		tick = t.C
+	}
+	for {
+		select {
+		case sig := <-reload:
+			log.Printf("received %v, reloading config", sig)
+		case <-tick:
+			if !l.changed() {
+				continue
+			}
+			log.Printf("config changed, reloading")
+		}
+		if err := l.Reload(); err != nil {
+			configReloads.WithLabelValues("failure").Inc()
+			log.Printf("could not reload config, keeping previous config: %v", err)
+			continue
+		}
+		configReloads.WithLabelValues("success").Inc()
+		log.Printf("reloaded config from %s", l.Path)
+	}
+}
+
+// watchDirectory reloads d when a value is received on reload, or when
+// its file is found to have changed, checking every interval. If
+// interval is zero, the file is not checked. watchDirectory does not
+// return.
+func watchDirectory(d *kubetoken.FileDirectory, reload <-chan os.Signal, interval time.Duration) {
+	var tick <-chan time.Time
+	if interval > 0 {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		tick = t.C
+	}
+	stamp := stampFile(d.Path)
+	for {
+		select {
+		case <-reload:
+		case <-tick:
+			if stampFile(d.Path) == stamp {
+				continue
+			}
+		}
+		stamp = stampFile(d.Path)
+		if err := d.Reload(); err != nil {
+			log.Printf("could not reload users, keeping previous users: %v", err)
+			continue
+		}
+		log.Printf("reloaded users from %s", d.Path)
+	}
+}
+
+// files returns the path of the configuration file, path, and every
+// file it references.
+func (c *Config) files(path string) []string {
+	files := []string{path}
+	for _, e := range c.Environments {
+		for _, ctx := range e.Contexts {
+			files = append(files, ctx.CACert, ctx.PrivKey, ctx.CAClusterCert)
+		}
+	}
+	return files
+}
+
+func stampFiles(paths []string) map[string]fileStamp {
+	stamps := make(map[string]fileStamp)
+	for _, path := range paths {
+		if path != "" {
+			stamps[path] = stampFile(path)
+		}
+	}
+	return stamps
+}
+
+// stampFile returns the stamp of the file at path, following symlinks
+// as Kubernetes updates mounted secrets and config maps by replacing a
+// symlink. If the file cannot be read, the zero stamp is returned.
+func stampFile(path string) fileStamp {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return fileStamp{}
+	}
+	return fileStamp{
+		modTime: fi.ModTime(),
+		size:    fi.Size(),
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestConfigLoaderReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reload_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca, err := filepath.Abs("../../internal/cert/_testdata/ssl/ca.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := filepath.Abs("../../internal/cert/_testdata/ssl/ca-key.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := func(name string) string {
+		return fmt.Sprintf(`{"customer": "example", "env": %q, "contexts": [{"cacert": %q, "privkey": %q}]}`, name, ca, key)
+	}
+	path := filepath.Join(dir, "kubetoken.json")
+	write := func(contents string) {
+		if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+		// ensure the modification time differs from the previous version.
+		mtime := time.Now().Add(time.Duration(len(contents)) * time.Second)
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(`{"environments": [` + env("dev") + `]}`)
+	l, err := newConfigLoader(path, []string{"duo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := l.Current()
+	if first.environment("example", "dev") == nil {
+		t.Fatal("example/dev not loaded")
+	}
+	if l.changed() {
+		t.Fatal("config unexpectedly changed")
+	}
+
+	write(`{"environments": [` + env("dev") + `, ` + env("prod") + `]}`)
+	if !l.changed() {
+		t.Fatal("config change not detected")
+	}
+	if err := l.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if l.Current().environment("example", "prod") == nil {
+		t.Fatal("example/prod not loaded")
+	}
+	// the previous config is unaffected by the reload.
+	if first.environment("example", "prod") != nil {
+		t.Fatal("reload modified the previous config")
+	}
+
+	// an invalid config is rejected, leaving the current config in place.
+	current := l.Current()
+	write(`{"environments": [{"customer": "example", "env": "broken", "contexts": [{"cacert": "/missing/ca.pem"}]}]}`)
+	if err := l.Reload(); err == nil {
+		t.Fatal("expected error reloading invalid config")
+	}
+	if l.Current() != current {
+		t.Fatal("invalid config replaced current config")
+	}
+	// and is not retried until it changes again.
+	if l.changed() {
+		t.Fatal("invalid config reported as changed")
+	}
+
+	// as is a config naming an MFA provider which is not configured.
+	write(fmt.Sprintf(`{"environments": [{"customer": "example", "env": "dev", "mfaprovider": "totp", "contexts": [{"cacert": %q, "privkey": %q}]}]}`, ca, key))
+	if err := l.Reload(); err == nil {
+		t.Fatal("expected error reloading config naming an unconfigured MFA provider")
+	}
+	if l.Current() != current {
+		t.Fatal("invalid config replaced current config")
+	}
+}
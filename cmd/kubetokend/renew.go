@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/atlassian/kubetoken"
+)
+
+// auditRenew is the audit event recorded when a certificate is renewed.
+const auditRenew = "renew"
+
+// renewProofSkew is how far the date of a proof of possession may be
+// from the server's clock.
+const renewProofSkew = 5 * time.Minute
+
+// RenewHandler issues a fresh certificate, for the same user and role,
+// to the holder of an unexpired and unrevoked certificate issued by
+// kubetokend, without their password or second factor. The user must
+// still hold the role, and have given their credentials within the
+// environment's MaxSession.
+type RenewHandler struct {
+	Signer *CertificateSigner
+
+	// Users finds the holder of the certificate to validate their role
+	// again.
+	Users kubetoken.UserFinder
+}
+
+func (h *RenewHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s := h.Signer
+	ev := AuditEvent{Event: auditRenew}
+	deny := func(code int, reason string) {
+		ev.Outcome, ev.Reason = outcomeDenied, reason
+		s.Audit.Record(req, ev)
+		http.Error(w, reason, code)
+	}
+
+	var ttl time.Duration
+	if v := req.URL.Query().Get("ttl"); v != "" {
+		var err error
+		ttl, err = time.ParseDuration(v)
+		if err != nil {
+			deny(400, fmt.Sprintf("invalid ttl: %v", err))
+			return
+		}
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, maxCSRSize))
+	if err != nil {
+		deny(400, err.Error())
+		return
+	}
+	crt, err := renewCertificate(req, s.Config.Current(), body, time.Now())
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", `Basic realm="Restricted"`)
+		deny(401, err.Error())
+		return
+	}
+	serial := crt.SerialNumber.String()
+	ev.Serial = serial
+	ev.User = crt.Subject.CommonName
+
+	iss, rev, err := s.Registry.Status(serial)
+	switch {
+	case err != nil:
+		deny(500, err.Error())
+		return
+	case iss == nil:
+		deny(403, fmt.Sprintf("certificate %s was not issued by kubetokend", serial))
+		return
+	case rev != nil:
+		deny(403, fmt.Sprintf("certificate %s has been revoked", serial))
+		return
+	}
+	ev.User, ev.Role = iss.User, iss.Role
+	ev.Customer, ev.Environment, ev.Namespace = iss.Customer, iss.Environment, iss.Namespace
+
+	env := s.Config.Current().environment(iss.Customer, iss.Environment)
+	if env == nil {
+		deny(400, fmt.Sprintf("%s: no known environment", iss.Role))
+		return
+	}
+	if err := verifyIssued(crt, env, iss, time.Now()); err != nil {
+		deny(403, err.Error())
+		return
+	}
+
+	csr, err := readCSR(bytes.NewReader(body))
+	if err != nil {
+		deny(400, err.Error())
+		return
+	}
+	if keyType, ok := acceptKeyType(csr); !ok {
+		deny(400, fmt.Sprintf("unsupported key type %s, accepted key types are %s", keyType, strings.Join(csrKeyTypes, ", ")))
+		return
+	}
+	if csr.Subject.CommonName != iss.User || len(csr.Subject.Organization) == 0 || csr.Subject.Organization[0] != iss.Role {
+		deny(403, fmt.Sprintf("a renewal must be for %s as %s", iss.User, iss.Role))
+		return
+	}
+
+	if env.MaxSession.Duration <= 0 {
+		deny(403, fmt.Sprintf("certificates for %s/%s are not renewed", env.Customer, env.Environment))
+		return
+	}
+	authenticated := iss.Authenticated
+	if authenticated.IsZero() {
+		authenticated = iss.NotBefore
+	}
+	notAfter := authenticated.Add(env.MaxSession.Duration)
+	if !time.Now().Before(notAfter) {
+		deny(403, fmt.Sprintf("session started at %s has exceeded %v, log in again", authenticated.Format(time.RFC3339), env.MaxSession.Duration))
+		return
+	}
+
+	// the user's roles may have changed since they last logged in.
+	id, err := h.Users.FindUser(iss.User)
+	if err == nil {
+		err = id.ValidateRoleForUser(iss.User, iss.Role)
+	}
+	if err != nil {
+		deny(403, err.Error())
+		return
+	}
+
+	s.issue(w, req, ev, env, csr, ttl, notAfter, Issuance{
+		User:          iss.User,
+		Role:          iss.Role,
+		Customer:      iss.Customer,
+		Environment:   iss.Environment,
+		Namespace:     iss.Namespace,
+		Authenticated: authenticated,
+		RenewedFrom:   serial,
+	}, deny)
+}
+
+// renewCertificate returns the certificate presented to renew with req,
+// whose body is csr: the TLS client certificate, if it was issued by
+// the CA of a context in c, or failing that, the certificate in
+// kubetoken.RenewCertificateHeader, if the request is signed with its
+// key.
+func renewCertificate(req *http.Request, c *Config, csr []byte, now time.Time) (*x509.Certificate, error) {
+	if req.TLS != nil && len(req.TLS.PeerCertificates) > 0 {
+		// clients may present another certificate, such as one
+		// required by a proxy, in which case the headers are used.
+		if crt := req.TLS.PeerCertificates[0]; issuedByContext(c, crt) {
+			return crt, nil
+		}
+	}
+	v := req.Header.Get(kubetoken.RenewCertificateHeader)
+	if v == "" {
+		return nil, fmt.Errorf("a certificate is required, as the TLS client certificate or in %s", kubetoken.RenewCertificateHeader)
+	}
+	der, err := base64.StdEncoding.DecodeString(v)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", kubetoken.RenewCertificateHeader, err)
+	}
+	crt, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", kubetoken.RenewCertificateHeader, err)
+	}
+
+	date := req.Header.Get(kubetoken.RenewDateHeader)
+	t, err := time.Parse(time.RFC3339, date)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", kubetoken.RenewDateHeader, err)
+	}
+	if d := now.Sub(t); d > renewProofSkew || d < -renewProofSkew {
+		return nil, fmt.Errorf("%s is more than %v from the server's time", kubetoken.RenewDateHeader, renewProofSkew)
+	}
+	sig, err := base64.StdEncoding.DecodeString(req.Header.Get(kubetoken.RenewSignatureHeader))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", kubetoken.RenewSignatureHeader, err)
+	}
+	algo, ok := proofAlgorithm(crt.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("unsupported certificate key type %T", crt.PublicKey)
+	}
+	if err := crt.CheckSignature(algo, kubetoken.RenewProof(date, csr), sig); err != nil {
+		return nil, fmt.Errorf("%s: %v", kubetoken.RenewSignatureHeader, err)
+	}
+	return crt, nil
+}
+
+// proofAlgorithm returns the algorithm with which the proof of
+// possession of pub's private key is signed.
+func proofAlgorithm(pub interface{}) (x509.SignatureAlgorithm, bool) {
+	switch pub.(type) {
+	case *rsa.PublicKey:
+		return x509.SHA256WithRSA, true
+	case *ecdsa.PublicKey:
+		return x509.ECDSAWithSHA256, true
+	case ed25519.PublicKey:
+		return x509.PureEd25519, true
+	default:
+		return x509.UnknownSignatureAlgorithm, false
+	}
+}
+
+// issuedByContext reports whether crt was signed by the CA of any
+// context in c.
+func issuedByContext(c *Config, crt *x509.Certificate) bool {
+	for _, e := range c.Environments {
+		for _, ctx := range e.Contexts {
+			ca := ctx.Signer.Cert
+			if ca != nil && bytes.Equal(crt.RawIssuer, ca.RawSubject) && crt.CheckSignatureFrom(ca) == nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// verifyIssued verifies crt is the certificate described by iss, signed
+// by the CA of one of env's contexts, and valid at now.
+func verifyIssued(crt *x509.Certificate, env *Environment, iss *Issuance, now time.Time) error {
+	if now.Before(crt.NotBefore) || now.After(crt.NotAfter) {
+		return fmt.Errorf("certificate %s has expired", iss.Serial)
+	}
+	for i := range env.Contexts {
+		ca := env.Contexts[i].Signer.Cert
+		if ca == nil || issuerID(ca) != iss.Issuer {
+			continue
+		}
+		if err := crt.CheckSignatureFrom(ca); err != nil {
+			return fmt.Errorf("certificate %s: %v", iss.Serial, err)
+		}
+		return nil
+	}
+	return fmt.Errorf("certificate %s was issued by a CA no longer in use", iss.Serial)
+}
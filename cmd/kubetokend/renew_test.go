@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/atlassian/kubetoken"
+	"github.com/atlassian/kubetoken/internal/cert"
+)
+
+// testUsers finds users who are members of groups.
+type testUsers map[string][]string
+
+func (u testUsers) FindUser(user string) (*kubetoken.Identity, error) {
+	groups, ok := u[user]
+	if !ok {
+		return nil, kubetoken.ErrInvalidCredentials
+	}
+	roles := &kubetoken.GroupRoles{
+		Groups:    groups,
+		Directory: kubetoken.Directory{}.WithDefaults(),
+	}
+	return &kubetoken.Identity{User: user, RoleProvider: roles, RoleValidator: roles}, nil
+}
+
+func TestRenewHandler(t *testing.T) {
+	const role = "kube-example-web-dev-dl-dev"
+	tests := []struct {
+		authenticated time.Duration // before now
+		maxSession    time.Duration
+		keyType       string // of the certificate renewed, if not RSA
+		csrRole       string
+		groups        []string
+		revoke        bool
+		tls           string                  // TLS client certificate: "issued", or "other" from another CA
+		proof         func(req *http.Request) // alters the proof of possession
+		want          int
+	}{
+		{maxSession: time.Hour, want: 200},
+		{maxSession: time.Hour, keyType: cert.ECDSA, want: 200},
+		{maxSession: time.Hour, keyType: cert.Ed25519, want: 200},
+		{maxSession: time.Hour, tls: "issued", proof: func(req *http.Request) { req.Header = http.Header{} }, want: 200},
+		{maxSession: time.Hour, tls: "other", want: 200},
+		{maxSession: time.Hour, tls: "other", proof: func(req *http.Request) { req.Header = http.Header{} }, want: 401},
+		{maxSession: time.Hour, proof: func(req *http.Request) { req.Header = http.Header{} }, want: 401},
+		{maxSession: time.Hour, proof: func(req *http.Request) {
+			req.Header.Set(kubetoken.RenewSignatureHeader, base64.StdEncoding.EncodeToString([]byte("forged")))
+		}, want: 401},
+		{maxSession: time.Hour, proof: func(req *http.Request) {
+			req.Header.Set(kubetoken.RenewDateHeader, time.Now().Add(-time.Hour).UTC().Format(time.RFC3339))
+		}, want: 401},
+		{maxSession: time.Hour, csrRole: "kube-example-web-dev-dl-admin", want: 403},
+		{maxSession: time.Hour, groups: []string{}, want: 403},
+		{maxSession: time.Hour, revoke: true, want: 403},
+		{maxSession: time.Hour, authenticated: 2 * time.Hour, want: 403},
+		{want: 403},
+	}
+	for i, tt := range tests {
+		config := testConfig(t)
+		env := &config.Environments[0]
+		env.MaxSession = Duration{tt.maxSession}
+		registry, cleanup := testRegistry(t)
+		defer cleanup()
+		s := &CertificateSigner{Config: config, Registry: registry, Audit: &Auditor{w: ioutil.Discard}}
+
+		keyType := cert.RSA
+		if tt.keyType != "" {
+			keyType = tt.keyType
+		}
+		csrPEM, keyPEM, err := cert.NewCSR("dcheney", role, keyType)
+		if err != nil {
+			t.Fatal(err)
+		}
+		csr, err := readCSR(bytes.NewReader(csrPEM))
+		if err != nil {
+			t.Fatal(err)
+		}
+		authenticated := time.Now().Add(-tt.authenticated).UTC()
+		_, crts, err := s.sign(env.Contexts, csr, time.Now().Add(time.Hour), Issuance{
+			User:          "dcheney",
+			Role:          role,
+			Customer:      env.Customer,
+			Environment:   env.Environment,
+			Authenticated: authenticated,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		crt := crts[0]
+		if tt.revoke {
+			if _, err := registry.Revoke(func(*Issuance) bool { return true }, Revocation{Reason: "keyCompromise"}); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		groups := []string{role}
+		if tt.groups != nil {
+			groups = tt.groups
+		}
+		h := &RenewHandler{Signer: s, Users: testUsers{"dcheney": groups}}
+
+		csrRole := role
+		if tt.csrRole != "" {
+			csrRole = tt.csrRole
+		}
+		body, _, err := cert.NewCSR("dcheney", csrRole, cert.ECDSA)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := httptest.NewRequest("POST", "/api/v1/renew", bytes.NewReader(body))
+		block, _ := pem.Decode(keyPEM)
+		key, err := cert.ParsePrivateKey(block.Bytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		date := time.Now().UTC().Format(time.RFC3339)
+		sig, err := kubetoken.SignRenewProof(key, date, body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(kubetoken.RenewCertificateHeader, base64.StdEncoding.EncodeToString(crt.Raw))
+		req.Header.Set(kubetoken.RenewDateHeader, date)
+		req.Header.Set(kubetoken.RenewSignatureHeader, base64.StdEncoding.EncodeToString(sig))
+		switch tt.tls {
+		case "issued":
+			req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{crt}}
+		case "other":
+			otherPEM, _, err := cert.NewCA("other-ca", time.Now().Add(time.Hour))
+			if err != nil {
+				t.Fatal(err)
+			}
+			other, err := parseCertificate(otherPEM)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{other}}
+		}
+		if tt.proof != nil {
+			tt.proof(req)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != tt.want {
+			t.Errorf("%d: got %d, want %d: %s", i, w.Code, tt.want, w.Body)
+			continue
+		}
+		if w.Code != 200 {
+			continue
+		}
+
+		// the renewed certificate carries the time the user logged in
+		// forward, and expires no later than the session.
+		var result kubetoken.CertificateResponse
+		if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+			t.Fatal(err)
+		}
+		renewed, err := parseCertificate(result.Files["dcheney.pem"])
+		if err != nil {
+			t.Fatal(err)
+		}
+		iss, _, err := registry.Status(renewed.SerialNumber.String())
+		if err != nil || iss == nil {
+			t.Fatalf("%d: renewed certificate not registered: %v", i, err)
+		}
+		if iss.RenewedFrom != crt.SerialNumber.String() {
+			t.Errorf("%d: got renewedfrom %q, want %q", i, iss.RenewedFrom, crt.SerialNumber)
+		}
+		if !iss.Authenticated.Equal(authenticated) {
+			t.Errorf("%d: got authenticated %v, want %v", i, iss.Authenticated, authenticated)
+		}
+		if deadline := authenticated.Add(tt.maxSession); renewed.NotAfter.After(deadline) {
+			t.Errorf("%d: renewed certificate expires at %v, after the session ends at %v", i, renewed.NotAfter, deadline)
+		}
+	}
+}
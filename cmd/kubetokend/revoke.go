@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/atlassian/kubetoken"
+)
+
+// Audit event names for the administrative API.
+const (
+	auditRevoke = "revoke" // an administrator revoked a certificate
+)
+
+// RevokeRequest is the body of a request to revoke certificates.
+// Either Serial or User must be provided. If User is provided, all
+// of the user's certificates are revoked, or if Role is also provided,
+// only those for that role.
+type RevokeRequest struct {
+	Serial string `json:"serial,omitempty"`
+	User   string `json:"user,omitempty"`
+	Role   string `json:"role,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// RevokeHandler revokes certificates on behalf of members of the
+// configured admin groups.
+type RevokeHandler struct {
+	Config   configSource
+	Registry *Registry
+	Audit    *Auditor
+}
+
+func (h *RevokeHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	id := identity(req)
+	if id == nil {
+		http.Error(w, "Forbidden", 403)
+		return
+	}
+	user := id.User
+	ev := AuditEvent{Event: auditRevoke, User: user}
+	if err := requireAdmin(h.Config.Current(), id, user); err != nil {
+		ev.Outcome, ev.Reason = outcomeDenied, err.Error()
+		h.Audit.Record(req, ev)
+		http.Error(w, err.Error(), 403)
+		return
+	}
+
+	var r RevokeRequest
+	if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if r.Serial == "" && r.User == "" {
+		http.Error(w, "serial or user must be provided", 400)
+		return
+	}
+	match := func(iss *Issuance) bool {
+		return (r.Serial == "" || iss.Serial == r.Serial) &&
+			(r.User == "" || iss.User == r.User) &&
+			(r.Role == "" || iss.Role == r.Role)
+	}
+	revoked, err := h.Registry.Revoke(match, Revocation{
+		Time:   time.Now().UTC(),
+		Reason: r.Reason,
+		By:     user,
+	})
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	type revokedCert struct {
+		Serial   string    `json:"serial"`
+		User     string    `json:"user"`
+		Role     string    `json:"role"`
+		NotAfter time.Time `json:"notafter"`
+	}
+	result := struct {
+		Revoked []revokedCert `json:"revoked"`
+	}{
+		Revoked: []revokedCert{},
+	}
+	for _, iss := range revoked {
+		h.Audit.Record(req, AuditEvent{
+			Event:       auditRevoke,
+			Outcome:     outcomeAllowed,
+			User:        iss.User,
+			Role:        iss.Role,
+			Customer:    iss.Customer,
+			Environment: iss.Environment,
+			Namespace:   iss.Namespace,
+			Serial:      iss.Serial,
+			NotBefore:   &iss.NotBefore,
+			NotAfter:    &iss.NotAfter,
+			Reason:      fmt.Sprintf("revoked by %s: %s", user, r.Reason),
+		})
+		result.Revoked = append(result.Revoked, revokedCert{
+			Serial:   iss.Serial,
+			User:     iss.User,
+			Role:     iss.Role,
+			NotAfter: iss.NotAfter,
+		})
+	}
+	json.NewEncoder(w).Encode(result)
+}
+
+// requireAdmin returns an error unless user is a member of one of
+// the admin groups listed in c.
+func requireAdmin(c *Config, v kubetoken.RoleValidator, user string) error {
+	for _, group := range c.AdminGroups {
+		if err := v.ValidateRoleForUser(user, group); err == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s is not an administrator", user)
+}
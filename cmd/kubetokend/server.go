@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ServerConfig holds the settings of kubetokend's HTTP server.
+type ServerConfig struct {
+	Addr string
+
+	// TLSCert and TLSKey are the paths of the PEM encoded server
+	// certificate and key. If they are empty, the server uses plain HTTP.
+	TLSCert, TLSKey string
+
+	// TLSClientCA is the path of a PEM encoded bundle of CAs used to
+	// verify client certificates, if TLSClientAuth requests them.
+	TLSClientCA string
+
+	// TLSClientAuth is one of "none", "request", "verify" or "require".
+	TLSClientAuth string
+
+	ReadTimeout     time.Duration
+	WriteTimeout    time.Duration
+	IdleTimeout     time.Duration
+	ShutdownTimeout time.Duration
+}
+
+var clientAuthTypes = map[string]tls.ClientAuthType{
+	"none":    tls.NoClientCert,
+	"request": tls.RequestClientCert,
+	"verify":  tls.VerifyClientCertIfGiven,
+	"require": tls.RequireAndVerifyClientCert,
+}
+
+// tlsConfig returns the tls.Config for c, or nil if c does not use TLS.
+func (c *ServerConfig) tlsConfig() (*tls.Config, error) {
+	if c.TLSCert == "" && c.TLSKey == "" {
+		if c.TLSClientCA != "" {
+			return nil, fmt.Errorf("a client CA requires a server certificate and key")
+		}
+		return nil, nil
+	}
+	if c.TLSCert == "" || c.TLSKey == "" {
+		return nil, fmt.Errorf("both a server certificate and key are required")
+	}
+	certs, err := newKeyPairReloader(c.TLSCert, c.TLSKey)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: certs.GetCertificate,
+	}
+	auth := c.TLSClientAuth
+	if auth == "" {
+		auth = "none"
+	}
+	config.ClientAuth, err = clientAuthType(auth)
+	if err != nil {
+		return nil, err
+	}
+	if c.TLSClientCA != "" {
+		pem, err := ioutil.ReadFile(c.TLSClientCA)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = x509.NewCertPool()
+		if !config.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no certificates found", c.TLSClientCA)
+		}
+	}
+	if config.ClientAuth >= tls.VerifyClientCertIfGiven && config.ClientCAs == nil {
+		return nil, fmt.Errorf("client auth %q requires a client CA", auth)
+	}
+	return config, nil
+}
+
+func clientAuthType(s string) (tls.ClientAuthType, error) {
+	t, ok := clientAuthTypes[s]
+	if !ok {
+		return 0, fmt.Errorf("unknown client auth %q, expected none, request, verify or require", s)
+	}
+	return t, nil
+}
+
+// serve serves handler according to c until the process receives
+// SIGTERM or SIGINT, then stops accepting connections and waits up to
+// ShutdownTimeout for in flight requests, such as those waiting on a
+// Duo push, to complete.
+func serve(c *ServerConfig, handler http.Handler) error {
+	tlsConfig, err := c.tlsConfig()
+	if err != nil {
+		return err
+	}
+	srv := &http.Server{
+		Addr:         c.Addr,
+		Handler:      handler,
+		TLSConfig:    tlsConfig,
+		ReadTimeout:  c.ReadTimeout,
+		WriteTimeout: c.WriteTimeout,
+		IdleTimeout:  c.IdleTimeout,
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, syscall.SIGINT)
+	done := make(chan error, 1)
+	go func() {
+		sig := <-stop
+		log.Printf("received %v, shutting down", sig)
+		ctx, cancel := context.WithTimeout(context.Background(), c.ShutdownTimeout)
+		defer cancel()
+		done <- srv.Shutdown(ctx)
+	}()
+
+	if tlsConfig != nil {
+		log.Println("listening on", c.Addr, "(TLS)")
+		err = srv.ListenAndServeTLS("", "")
+	} else {
+		log.Println("listening on", c.Addr)
+		err = srv.ListenAndServe()
+	}
+	if err != http.ErrServerClosed {
+		return err
+	}
+	return <-done
+}
+
+// keyPairReloader provides a TLS certificate which is reloaded from
+// disk when its files change, so a renewed certificate is picked up
+// without a restart.
+type keyPairReloader struct {
+	certFile, keyFile string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	stamps  map[string]fileStamp
+	checked time.Time
+}
+
+// keyPairCheckInterval is the minimum interval between checks of the
+// certificate files.
+const keyPairCheckInterval = 10 * time.Second
+
+func newKeyPairReloader(certFile, keyFile string) (*keyPairReloader, error) {
+	k := &keyPairReloader{certFile: certFile, keyFile: keyFile}
+	return k, k.reload()
+}
+
+// reload loads the key pair. If the key pair cannot be loaded the
+// previous certificate, if any, is kept.
+func (k *keyPairReloader) reload() error {
+	stamps := stampFiles([]string{k.certFile, k.keyFile})
+	cert, err := tls.LoadX509KeyPair(k.certFile, k.keyFile)
+	k.stamps = stamps
+	if err != nil {
+		return err
+	}
+	k.cert = &cert
+	return nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate.
+func (k *keyPairReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if now := time.Now(); now.Sub(k.checked) >= keyPairCheckInterval {
+		k.checked = now
+		for path, stamp := range k.stamps {
+			if stampFile(path) == stamp {
+				continue
+			}
+			if err := k.reload(); err != nil {
+				log.Printf("could not reload TLS certificate, keeping previous certificate: %v", err)
+			} else {
+				log.Printf("reloaded TLS certificate from %s", k.certFile)
+			}
+			break
+		}
+	}
+	return k.cert, nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/atlassian/kubetoken/internal/cert"
+)
+
+func TestServerConfigTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "server_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	crt, key := writeKeyPair(t, dir, "kubetoken.example.com")
+
+	tests := []struct {
+		config     ServerConfig
+		tls        bool
+		clientAuth tls.ClientAuthType
+		err        bool
+	}{{
+		config: ServerConfig{},
+	}, {
+		config: ServerConfig{TLSCert: crt, TLSKey: key},
+		tls:    true,
+	}, {
+		config:     ServerConfig{TLSCert: crt, TLSKey: key, TLSClientCA: crt, TLSClientAuth: "require"},
+		tls:        true,
+		clientAuth: tls.RequireAndVerifyClientCert,
+	}, {
+		config: ServerConfig{TLSCert: crt},
+		err:    true,
+	}, {
+		config: ServerConfig{TLSClientCA: crt},
+		err:    true,
+	}, {
+		config: ServerConfig{TLSCert: crt, TLSKey: key, TLSClientAuth: "verify"},
+		err:    true,
+	}, {
+		config: ServerConfig{TLSCert: crt, TLSKey: key, TLSClientAuth: "sometimes"},
+		err:    true,
+	}}
+
+	for i, tt := range tests {
+		config, err := tt.config.tlsConfig()
+		if (err != nil) != tt.err {
+			t.Errorf("%d: got err %v, want err %v", i, err, tt.err)
+			continue
+		}
+		if (config != nil) != tt.tls {
+			t.Errorf("%d: got TLS config %v, want TLS %v", i, config, tt.tls)
+			continue
+		}
+		if config != nil && config.ClientAuth != tt.clientAuth {
+			t.Errorf("%d: got client auth %v, want %v", i, config.ClientAuth, tt.clientAuth)
+		}
+	}
+}
+
+func TestKeyPairReloader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "server_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	crt, key := writeKeyPair(t, dir, "first.example.com")
+
+	k, err := newKeyPairReloader(crt, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commonName := func() string {
+		c, err := k.GetCertificate(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		leaf, err := x509.ParseCertificate(c.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return leaf.Subject.CommonName
+	}
+	if cn := commonName(); cn != "first.example.com" {
+		t.Fatalf("got %q, want first.example.com", cn)
+	}
+
+	writeKeyPair(t, dir, "second.example.com")
+	later := time.Now().Add(time.Minute)
+	for _, path := range []string{crt, key} {
+		if err := os.Chtimes(path, later, later); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the files are not checked again until the check interval has passed.
+	if cn := commonName(); cn != "first.example.com" {
+		t.Fatalf("got %q before the check interval, want first.example.com", cn)
+	}
+	k.checked = time.Time{}
+	if cn := commonName(); cn != "second.example.com" {
+		t.Fatalf("got %q after reload, want second.example.com", cn)
+	}
+
+	// an unreadable key pair leaves the previous certificate in place.
+	if err := ioutil.WriteFile(key, []byte("garbage"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	k.checked = time.Time{}
+	if cn := commonName(); cn != "second.example.com" {
+		t.Fatalf("got %q after failed reload, want second.example.com", cn)
+	}
+}
+
+// writeKeyPair writes a self signed certificate for cn, and its key,
+// to dir, returning their paths.
+func writeKeyPair(t *testing.T, dir, cn string) (string, string) {
+	crtPEM, keyPEM, err := cert.NewCA(cn, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	crt, key := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	if err := ioutil.WriteFile(crt, crtPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(key, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return crt, key
+}
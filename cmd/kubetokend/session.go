@@ -0,0 +1,433 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/atlassian/kubetoken"
+)
+
+// auditSession is the audit event recorded when a session is started,
+// or revoked.
+const auditSession = "session"
+
+// outcomeRevoked is the outcome of an auditSession event recorded when
+// sessions are revoked.
+const outcomeRevoked = "revoked"
+
+// sessionKeySize is the size of the key with which session tokens are
+// signed.
+const sessionKeySize = 32
+
+// sessionClaims are the contents of a session token. A session carries
+// the roles and admin groups of the user when it was started, so that
+// later requests need not consult the directory.
+type sessionClaims struct {
+	ID      string    `json:"id"`
+	User    string    `json:"user"`
+	Roles   []string  `json:"roles"`
+	Admin   []string  `json:"admin,omitempty"` // the configured admin groups of which the user was a member
+	Issued  time.Time `json:"iat"`
+	Expires time.Time `json:"exp"`
+
+	// MFA names the provider to which the user gave a second factor
+	// to start the session, if any.
+	MFA string `json:"mfaprovider,omitempty"`
+}
+
+// FetchRolesForUser returns the roles of the session's user.
+func (c *sessionClaims) FetchRolesForUser(user string) ([]string, error) {
+	if user != c.User {
+		return nil, fmt.Errorf("session of %s cannot fetch the roles of %s", c.User, user)
+	}
+	return c.Roles, nil
+}
+
+// ValidateRoleForUser validates role was one of the user's roles, or
+// admin groups, when the session was started.
+func (c *sessionClaims) ValidateRoleForUser(user, role string) error {
+	if user != c.User {
+		return fmt.Errorf("session of %s cannot assume roles for %s", c.User, user)
+	}
+	if !contains(c.Roles, role) && !contains(c.Admin, role) {
+		return fmt.Errorf("%s is not a member of %s", user, role)
+	}
+	return nil
+}
+
+// sessionRecord is a single line in the sessions file.
+type sessionRecord struct {
+	Revoked *sessionRevocation `json:"revoked,omitempty"`
+}
+
+// sessionRevocation revokes a session, or if ID is empty, all of the
+// sessions of User started before Time.
+type sessionRevocation struct {
+	ID   string    `json:"id,omitempty"`
+	User string    `json:"user"`
+	Time time.Time `json:"time"`
+	By   string    `json:"by,omitempty"` // the administrator who revoked the sessions
+
+	// Expires is the time after which no session revoked remains
+	// valid, and the revocation may be forgotten.
+	Expires time.Time `json:"expires"`
+}
+
+// Sessions is an Authenticator for session tokens, which it issues.
+// Tokens are signed with a key shared by every kubetokend process
+// which accepts them. Revocations are stored as a journal, which may be
+// shared by several kubetokend processes.
+type Sessions struct {
+	// TTL is the lifetime of sessions.
+	TTL time.Duration
+
+	key []byte
+
+	j       *journal
+	revoked map[string]time.Time // expiry of revoked sessions, by ID
+	before  map[string]time.Time // sessions of each user started before are revoked
+	now     func() time.Time     // for testing
+}
+
+// openSessions opens, creating if necessary, the sessions file stored
+// at path. Tokens are signed with key.
+func openSessions(path string, key []byte) (*Sessions, error) {
+	s := &Sessions{
+		TTL:     time.Hour,
+		key:     key,
+		revoked: make(map[string]time.Time),
+		before:  make(map[string]time.Time),
+	}
+	j, err := openJournal(path, "session", s.apply)
+	if err != nil {
+		return nil, err
+	}
+	s.j = j
+	return s, nil
+}
+
+// loadSessionKey returns the session key stored at path, generating it
+// if the file does not exist. A generated key is written to a temporary
+// file which is linked into place, so that instances starting together
+// never read a partially written key.
+func loadSessionKey(path string) ([]byte, error) {
+	key, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		key = make([]byte, sessionKeySize)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+		f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+		if err != nil {
+			return nil, err
+		}
+		defer os.Remove(f.Name())
+		_, err = f.Write(key)
+		if err == nil {
+			err = f.Sync()
+		}
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return nil, err
+		}
+		err = os.Link(f.Name(), path)
+		if os.IsExist(err) {
+			// another instance created it first.
+			return loadSessionKey(path)
+		}
+		return key, err
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(key) < sessionKeySize {
+		return nil, fmt.Errorf("%s: session key must be at least %d bytes", path, sessionKeySize)
+	}
+	return key, nil
+}
+
+// Close closes the underlying sessions file.
+func (s *Sessions) Close() error {
+	return s.j.Close()
+}
+
+func (s *Sessions) clock() time.Time {
+	if s.now != nil {
+		return s.now()
+	}
+	return time.Now()
+}
+
+// Issue starts a session for user, who may assume roles, and is a
+// member of the admin groups admin, and returns it. mfa names the
+// provider with which the user gave a second factor, if they did.
+func (s *Sessions) Issue(user string, roles, admin []string, mfa string) (*kubetoken.Session, error) {
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return nil, err
+	}
+	now := s.clock().UTC()
+	c := sessionClaims{
+		ID:      hex.EncodeToString(id[:]),
+		User:    user,
+		Roles:   roles,
+		Admin:   admin,
+		MFA:     mfa,
+		Issued:  now,
+		Expires: now.Add(s.TTL),
+	}
+	payload, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	enc := base64.RawURLEncoding
+	token := enc.EncodeToString(payload) + "." + enc.EncodeToString(s.sign(payload))
+	return &kubetoken.Session{
+		User:    user,
+		Token:   token,
+		Expires: c.Expires,
+	}, nil
+}
+
+func (s *Sessions) sign(payload []byte) []byte {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+// Authenticate returns the Identity of the user whose session token
+// req carries, whose roles are those of the session.
+func (s *Sessions) Authenticate(req *http.Request) (*kubetoken.Identity, error) {
+	prefix := kubetoken.SessionScheme + " "
+	auth := req.Header.Get("Authorization")
+	if len(auth) < len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+		return nil, kubetoken.ErrNoCredentials
+	}
+	c, err := s.verify(auth[len(prefix):])
+	if err != nil {
+		return nil, err
+	}
+	return &kubetoken.Identity{
+		User:          c.User,
+		RoleProvider:  c,
+		RoleValidator: c,
+	}, nil
+}
+
+// verify returns the claims of token if it was signed with s's key, and
+// has neither expired nor been revoked.
+func (s *Sessions) verify(token string) (*sessionClaims, error) {
+	enc := base64.RawURLEncoding
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return nil, kubetoken.ErrInvalidCredentials
+	}
+	payload, err := enc.DecodeString(parts[0])
+	if err != nil {
+		return nil, kubetoken.ErrInvalidCredentials
+	}
+	sig, err := enc.DecodeString(parts[1])
+	if err != nil || !hmac.Equal(sig, s.sign(payload)) {
+		return nil, kubetoken.ErrInvalidCredentials
+	}
+	var c sessionClaims
+	if err := json.Unmarshal(payload, &c); err != nil {
+		return nil, kubetoken.ErrInvalidCredentials
+	}
+	if !s.clock().Before(c.Expires) {
+		return nil, kubetoken.ErrInvalidCredentials
+	}
+	var revoked bool
+	err = s.j.read(func() error {
+		_, revoked = s.revoked[c.ID]
+		if t, ok := s.before[c.User]; ok && c.Issued.Before(t) {
+			revoked = true
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if revoked {
+		return nil, kubetoken.ErrInvalidCredentials
+	}
+	return &c, nil
+}
+
+// Revoke revokes the session of user identified by id, or if id is
+// empty, all of user's sessions. by is the administrator revoking
+// them, if not user themselves.
+func (s *Sessions) Revoke(user, id, by string) error {
+	now := s.clock().UTC()
+	return s.j.write(func() error {
+		return s.j.append(sessionRecord{Revoked: &sessionRevocation{
+			ID:      id,
+			User:    user,
+			Time:    now,
+			By:      by,
+			Expires: now.Add(s.TTL),
+		}})
+	})
+}
+
+// apply applies a record read from the sessions file, forgetting
+// revocations which have expired.
+func (s *Sessions) apply(line []byte) error {
+	var rec sessionRecord
+	if err := json.Unmarshal(line, &rec); err != nil {
+		return err
+	}
+	r := rec.Revoked
+	if r == nil || s.clock().After(r.Expires) {
+		return nil
+	}
+	switch {
+	case r.ID != "":
+		s.revoked[r.ID] = r.Expires
+	case r.Time.After(s.before[r.User]):
+		s.before[r.User] = r.Time
+	}
+	return nil
+}
+
+// sessionOf returns the claims of the session with which req was
+// authenticated, or nil if it was not authenticated with a session.
+func sessionOf(req *http.Request) *sessionClaims {
+	id := identity(req)
+	if id == nil {
+		return nil
+	}
+	c, _ := id.RoleValidator.(*sessionClaims)
+	return c
+}
+
+// SessionHandler starts sessions with POST, once the user has answered
+// any MFA challenge, and revokes them with DELETE.
+type SessionHandler struct {
+	Sessions *Sessions
+	Config   configSource
+
+	// MFA, if not nil, verifies the second factor of users starting a
+	// session.
+	MFA *MFAChallenger
+
+	Audit *Auditor
+}
+
+func (h *SessionHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	id := identity(req)
+	if id == nil {
+		http.Error(w, "Forbidden", 403)
+		return
+	}
+	ev := AuditEvent{Event: auditSession, User: id.User}
+	deny := func(code int, reason string) {
+		ev.Outcome, ev.Reason = outcomeDenied, reason
+		h.Audit.Record(req, ev)
+		http.Error(w, reason, code)
+	}
+	switch req.Method {
+	case "POST":
+		h.start(w, req, id, ev, deny)
+	case "DELETE":
+		h.revoke(w, req, id, ev, deny)
+	default:
+		http.Error(w, "method not allowed", 405)
+	}
+}
+
+// start starts a session for the user making req.
+func (h *SessionHandler) start(w http.ResponseWriter, req *http.Request, id *kubetoken.Identity, ev AuditEvent, deny func(int, string)) {
+	// a session lasts as long as the password and second factor which
+	// started it, and no longer.
+	if sessionOf(req) != nil {
+		deny(403, "a session cannot be started with another session")
+		return
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, 4096))
+	if err != nil {
+		deny(400, err.Error())
+		return
+	}
+	// the session records the provider which verified the user, so
+	// that environments which name another provider challenge them
+	// again.
+	var mfa string
+	if h.MFA != nil {
+		r := mfaRequest{User: id.User, ClientIP: clientIP(req)}
+		if !h.MFA.verify(w, req, r, h.MFA.Provider, body, deny) {
+			return
+		}
+		mfa = h.MFA.Provider
+	}
+	roles, err := id.FetchRolesForUser(id.User)
+	if err != nil {
+		deny(500, err.Error())
+		return
+	}
+	// admin groups need not match the directory's role pattern, so
+	// they are validated separately.
+	var admin []string
+	for _, group := range h.Config.Current().AdminGroups {
+		if id.ValidateRoleForUser(id.User, group) == nil {
+			admin = append(admin, group)
+		}
+	}
+	session, err := h.Sessions.Issue(id.User, roles, admin, mfa)
+	if err != nil {
+		deny(500, err.Error())
+		return
+	}
+	ev.Outcome = outcomeAllowed
+	h.Audit.Record(req, ev)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(session)
+}
+
+// revoke revokes the sessions described by the
+// kubetoken.SessionRevokeRequest in req.
+func (h *SessionHandler) revoke(w http.ResponseWriter, req *http.Request, id *kubetoken.Identity, ev AuditEvent, deny func(int, string)) {
+	var r kubetoken.SessionRevokeRequest
+	if err := json.NewDecoder(io.LimitReader(req.Body, 4096)).Decode(&r); err != nil && err != io.EOF {
+		deny(400, err.Error())
+		return
+	}
+	var sessionID, by string
+	switch {
+	case r.User != "" && r.User != id.User:
+		if err := requireAdmin(h.Config.Current(), id, id.User); err != nil {
+			deny(403, err.Error())
+			return
+		}
+		ev.User, by = r.User, id.User
+	case r.User == "":
+		if c := sessionOf(req); c != nil {
+			sessionID = c.ID
+		}
+	}
+	if err := h.Sessions.Revoke(ev.User, sessionID, by); err != nil {
+		deny(500, err.Error())
+		return
+	}
+	ev.Outcome = outcomeRevoked
+	if by != "" {
+		ev.Reason = "revoked by " + by
+	}
+	h.Audit.Record(req, ev)
+	w.WriteHeader(204)
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/atlassian/kubetoken"
+)
+
+func TestSessions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "session_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	key, err := loadSessionKey(filepath.Join(dir, "session.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, err := loadSessionKey(filepath.Join(dir, "session.key")); err != nil || !bytes.Equal(again, key) {
+		t.Fatalf("reloading key: got %x %v, want %x", again, err, key)
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "*.tmp*")); len(files) != 0 {
+		t.Errorf("temporary key files left behind: %v", files)
+	}
+	short := filepath.Join(dir, "short.key")
+	if err := ioutil.WriteFile(short, key[:sessionKeySize-1], 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadSessionKey(short); err == nil {
+		t.Errorf("expected short session key to be rejected")
+	}
+	path := filepath.Join(dir, "sessions.json")
+	s, err := openSessions(path, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	now := time.Now()
+	s.now = func() time.Time { return now }
+
+	authenticate := func(s *Sessions, token string) (*kubetoken.Identity, error) {
+		req := httptest.NewRequest("GET", "/api/v1/roles", nil)
+		req.Header.Set("Authorization", kubetoken.SessionScheme+" "+token)
+		return s.Authenticate(req)
+	}
+
+	session, err := s.Issue("dcheney", []string{"kube-example-web-prod-dl-dev"}, nil, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := authenticate(s, session.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id.User != "dcheney" {
+		t.Errorf("got user %q, want dcheney", id.User)
+	}
+	if err := id.ValidateRoleForUser("dcheney", "kube-example-web-prod-dl-dev"); err != nil {
+		t.Errorf("role of session: %v", err)
+	}
+	if err := id.ValidateRoleForUser("dcheney", "kube-example-web-prod-dl-admin"); err == nil {
+		t.Errorf("expected role not in session to be rejected")
+	}
+	if err := id.ValidateRoleForUser("jdoe", "kube-example-web-prod-dl-dev"); err == nil {
+		t.Errorf("expected session to be scoped to its user")
+	}
+
+	// tokens are rejected if tampered with, or signed with another key.
+	parts := strings.Split(session.Token, ".")
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload = bytes.Replace(payload, []byte(`"dcheney"`), []byte(`"jdoe"`), 1)
+	forged := base64.RawURLEncoding.EncodeToString(payload) + "." + parts[1]
+	if _, err := authenticate(s, forged); err != kubetoken.ErrInvalidCredentials {
+		t.Errorf("tampered token: got %v, want %v", err, kubetoken.ErrInvalidCredentials)
+	}
+	other := &Sessions{TTL: time.Hour, key: make([]byte, sessionKeySize)}
+	otherSession, err := other.Issue("dcheney", nil, nil, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := authenticate(s, otherSession.Token); err != kubetoken.ErrInvalidCredentials {
+		t.Errorf("token signed with another key: got %v, want %v", err, kubetoken.ErrInvalidCredentials)
+	}
+	req := httptest.NewRequest("GET", "/api/v1/roles", nil)
+	req.SetBasicAuth("dcheney", "secret")
+	if _, err := s.Authenticate(req); err != kubetoken.ErrNoCredentials {
+		t.Errorf("basic auth: got %v, want %v", err, kubetoken.ErrNoCredentials)
+	}
+
+	// sessions expire.
+	s.now = func() time.Time { return now.Add(s.TTL) }
+	if _, err := authenticate(s, session.Token); err != kubetoken.ErrInvalidCredentials {
+		t.Errorf("expired session: got %v, want %v", err, kubetoken.ErrInvalidCredentials)
+	}
+	s.now = func() time.Time { return now }
+
+	// revoking one session leaves the user's others, and another
+	// process sharing the file sees the revocation.
+	second, err := s.Issue("dcheney", nil, nil, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := s.verify(session.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Revoke("dcheney", c.ID, ""); err != nil {
+		t.Fatal(err)
+	}
+	q, err := openSessions(path, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	q.now = s.now
+	if _, err := authenticate(q, session.Token); err != kubetoken.ErrInvalidCredentials {
+		t.Errorf("revoked session: got %v, want %v", err, kubetoken.ErrInvalidCredentials)
+	}
+	if _, err := authenticate(q, second.Token); err != nil {
+		t.Errorf("other session: %v", err)
+	}
+
+	// revoking all of a user's sessions leaves those started later.
+	now = now.Add(time.Second)
+	if err := q.Revoke("dcheney", "", "admin"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := authenticate(s, second.Token); err != kubetoken.ErrInvalidCredentials {
+		t.Errorf("session started before revocation: got %v, want %v", err, kubetoken.ErrInvalidCredentials)
+	}
+	now = now.Add(time.Second)
+	third, err := s.Issue("dcheney", nil, nil, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := authenticate(q, third.Token); err != nil {
+		t.Errorf("session started after revocation: %v", err)
+	}
+}
+
+func TestSessionHandler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "session_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sessions, err := openSessions(filepath.Join(dir, "sessions.json"), make([]byte, sessionKeySize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sessions.Close()
+	m, cleanup := testMFAChallenger(t, map[string]MFAProvider{"test": &testMFAProvider{
+		methods: []string{kubetoken.MFAPasscode},
+		verify: func(r *mfaRequest, method, passcode string) error {
+			return nil
+		},
+	}})
+	defer cleanup()
+	h := &SessionHandler{
+		Sessions: sessions,
+		Config:   &Config{AdminGroups: []string{"kube-admins"}},
+		MFA:      m,
+		Audit:    m.Audit,
+	}
+	roles := &kubetoken.GroupRoles{
+		Groups:    []string{"kube-example-web-prod-dl-dev"},
+		Directory: kubetoken.Directory{}.WithDefaults(),
+	}
+	password := &kubetoken.Identity{User: "dcheney", RoleProvider: roles, RoleValidator: roles}
+	do := func(method string, id *kubetoken.Identity, header string, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/api/v1/session", strings.NewReader(body))
+		req.Header.Set(kubetoken.MFAHeader, header)
+		req = req.WithContext(context.WithValue(req.Context(), identityKey{}, id))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	// a session is started once the user has answered a challenge.
+	w := do("POST", password, kubetoken.MFARequestChallenge, "")
+	if w.Code != 401 {
+		t.Fatalf("challenge: got %d, want 401", w.Code)
+	}
+	var c kubetoken.MFAChallenge
+	if err := json.NewDecoder(w.Body).Decode(&c); err != nil {
+		t.Fatal(err)
+	}
+	if w := do("POST", password, c.Transaction, ""); w.Code != 403 {
+		t.Errorf("unanswered challenge: got %d, want 403", w.Code)
+	}
+	m.answer(httptest.NewRecorder(), httptest.NewRequest("POST", "/", nil), c.Transaction, kubetoken.MFAAnswer{Method: kubetoken.MFAPasscode, Passcode: "123456"})
+	w = do("POST", password, c.Transaction, "")
+	if w.Code != 200 {
+		t.Fatalf("start: got %d, want 200: %s", w.Code, w.Body)
+	}
+	var session kubetoken.Session
+	if err := json.NewDecoder(w.Body).Decode(&session); err != nil {
+		t.Fatal(err)
+	}
+	claims, err := sessions.verify(session.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.MFA != "test" || len(claims.Roles) != 1 || claims.Roles[0] != "kube-example-web-prod-dl-dev" {
+		t.Errorf("got claims %+v", claims)
+	}
+
+	// requests authenticated by the session count as having given a
+	// second factor, but cannot start another session.
+	id := &kubetoken.Identity{User: "dcheney", RoleProvider: claims, RoleValidator: claims}
+	req := httptest.NewRequest("POST", "/api/v1/signcsr", nil)
+	req = req.WithContext(context.WithValue(req.Context(), identityKey{}, id))
+	if !mfaVerified(req, "test") {
+		t.Errorf("expected session to have given a second factor")
+	}
+	if mfaVerified(req, "totp") {
+		t.Errorf("expected session to have given a second factor to test only")
+	}
+	if w := do("POST", id, "", ""); w.Code != 403 {
+		t.Errorf("start from session: got %d, want 403", w.Code)
+	}
+
+	// only administrators revoke the sessions of others.
+	if w := do("DELETE", id, "", `{"user": "jdoe"}`); w.Code != 403 {
+		t.Errorf("revoke other user: got %d, want 403", w.Code)
+	}
+	if w := do("DELETE", id, "", ""); w.Code != 204 {
+		t.Fatalf("revoke: got %d, want 204", w.Code)
+	}
+	if _, err := sessions.verify(session.Token); err == nil {
+		t.Errorf("expected revoked session to be rejected")
+	}
+
+	// administrators may use their sessions to revoke those of others.
+	adminRoles := &kubetoken.GroupRoles{
+		Groups:    []string{"kube-admins", "kube-example-web-prod-dl-dev"},
+		Directory: kubetoken.Directory{}.WithDefaults(),
+	}
+	admin := &kubetoken.Identity{User: "jsmith", RoleProvider: adminRoles, RoleValidator: adminRoles}
+	if err := json.NewDecoder(do("POST", admin, kubetoken.MFARequestChallenge, "").Body).Decode(&c); err != nil {
+		t.Fatal(err)
+	}
+	m.answer(httptest.NewRecorder(), httptest.NewRequest("POST", "/", nil), c.Transaction, kubetoken.MFAAnswer{Method: kubetoken.MFAPasscode, Passcode: "123456"})
+	w = do("POST", admin, c.Transaction, "")
+	if err := json.NewDecoder(w.Body).Decode(&session); err != nil {
+		t.Fatal(err)
+	}
+	if claims, err = sessions.verify(session.Token); err != nil {
+		t.Fatal(err)
+	}
+	if len(claims.Roles) != 1 || len(claims.Admin) != 1 || claims.Admin[0] != "kube-admins" {
+		t.Errorf("got admin claims %+v", claims)
+	}
+	id = &kubetoken.Identity{User: "jsmith", RoleProvider: claims, RoleValidator: claims}
+	if w := do("DELETE", id, "", `{"user": "jdoe"}`); w.Code != 204 {
+		t.Errorf("admin revoke other user: got %d, want 204: %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/atlassian/kubetoken"
+	"github.com/pkg/errors"
+)
+
+const (
+	totpStep   = 30 * time.Second // RFC 6238 time step
+	totpDigits = 6
+	totpSkew   = 1 // steps either side of now accepted, for clock drift
+)
+
+// errNotEnrolled is returned by TOTPProvider.Verify for users without a
+// secret.
+var errNotEnrolled = errors.New("not enrolled for TOTP")
+
+// totpRecord is a single line in the TOTP file.
+type totpRecord struct {
+	Enrolled *totpEnrollment `json:"enrolled,omitempty"`
+	Used     *totpUse        `json:"used,omitempty"`
+}
+
+// totpEnrollment records the secret of a user, replacing any previous
+// secret.
+type totpEnrollment struct {
+	User   string    `json:"user"`
+	Secret []byte    `json:"secret"`
+	Time   time.Time `json:"time"`
+	By     string    `json:"by,omitempty"` // the administrator who enrolled the user
+}
+
+// totpUse records the time step of a passcode which has been accepted,
+// so that it cannot be used again.
+type totpUse struct {
+	User string `json:"user"`
+	Step int64  `json:"step"`
+}
+
+// TOTPProvider is an MFAProvider which verifies RFC 6238 time-based one
+// time passcodes, generated by an authenticator app from a secret
+// enrolled with kubetokend. Secrets, and the passcodes used, are stored
+// as a journal, which may be shared by several kubetokend processes.
+type TOTPProvider struct {
+	// Issuer names kubetokend in authenticator apps.
+	Issuer string
+
+	j       *journal
+	secrets map[string][]byte
+	used    map[string]int64 // last step used by each user
+	now     func() time.Time // for testing
+}
+
+// openTOTP opens, creating if necessary, the TOTP file stored at path.
+func openTOTP(path string) (*TOTPProvider, error) {
+	p := &TOTPProvider{
+		Issuer:  "kubetoken",
+		secrets: make(map[string][]byte),
+		used:    make(map[string]int64),
+	}
+	j, err := openJournal(path, "totp", p.apply)
+	if err != nil {
+		return nil, err
+	}
+	p.j = j
+	return p, nil
+}
+
+// Close closes the underlying TOTP file.
+func (p *TOTPProvider) Close() error {
+	return p.j.Close()
+}
+
+func (p *TOTPProvider) clock() time.Time {
+	if p.now != nil {
+		return p.now()
+	}
+	return time.Now()
+}
+
+// Methods returns the methods supported by TOTP, which are passcodes.
+func (p *TOTPProvider) Methods() []string {
+	return []string{kubetoken.MFAPasscode}
+}
+
+// Verify verifies passcode was generated from the secret of the user
+// making r, within totpSkew steps of now. Each passcode is accepted
+// once, as is any passcode older than one accepted.
+func (p *TOTPProvider) Verify(r *mfaRequest, method, passcode string) error {
+	if method != kubetoken.MFAPasscode {
+		return fmt.Errorf("unsupported TOTP method %q", method)
+	}
+	return p.j.write(func() error {
+		secret, ok := p.secrets[r.User]
+		if !ok {
+			return errNotEnrolled
+		}
+		now := p.clock().Unix() / int64(totpStep/time.Second)
+		for step := now - totpSkew; step <= now+totpSkew; step++ {
+			if subtle.ConstantTimeCompare([]byte(totpCode(secret, step)), []byte(passcode)) != 1 {
+				continue
+			}
+			if last, ok := p.used[r.User]; ok && step <= last {
+				return errors.New("passcode has already been used")
+			}
+			return p.j.append(totpRecord{Used: &totpUse{User: r.User, Step: step}})
+		}
+		return errors.New("incorrect passcode")
+	})
+}
+
+// Enrolled reports whether user has a secret.
+func (p *TOTPProvider) Enrolled(user string) (bool, error) {
+	var ok bool
+	err := p.j.read(func() error {
+		_, ok = p.secrets[user]
+		return nil
+	})
+	return ok, err
+}
+
+// Enroll generates and records a new secret for user, replacing any
+// previous secret, and returns the enrollment to give to the user. by
+// is the administrator enrolling user, if not user themselves.
+func (p *TOTPProvider) Enroll(user, by string) (*kubetoken.TOTPEnrollment, error) {
+	secret := make([]byte, 20)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	err := p.j.write(func() error {
+		return p.j.append(totpRecord{Enrolled: &totpEnrollment{
+			User:   user,
+			Secret: secret,
+			Time:   p.clock().UTC(),
+			By:     by,
+		}})
+	})
+	if err != nil {
+		return nil, err
+	}
+	encoded := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(secret)
+	uri := url.URL{
+		Scheme: "otpauth",
+		Host:   "totp",
+		Path:   "/" + p.Issuer + ":" + user,
+		RawQuery: url.Values{
+			"secret":    {encoded},
+			"issuer":    {p.Issuer},
+			"algorithm": {"SHA1"},
+			"digits":    {fmt.Sprint(totpDigits)},
+			"period":    {fmt.Sprint(int(totpStep / time.Second))},
+		}.Encode(),
+	}
+	return &kubetoken.TOTPEnrollment{
+		User:   user,
+		Secret: encoded,
+		URI:    uri.String(),
+	}, nil
+}
+
+// auditEnroll is the audit event recorded when a user is enrolled for
+// TOTP.
+const auditEnroll = "enroll"
+
+// TOTPEnrollHandler enrolls users for TOTP. Administrators may enroll
+// any user. Users may replace their own secret given a passcode from
+// it, and enroll themselves for the first time if SelfEnroll is set.
+type TOTPEnrollHandler struct {
+	TOTP       *TOTPProvider
+	Config     configSource
+	SelfEnroll bool
+
+	// Limiter, if not nil, counts incorrect passcodes as failed
+	// attempts by the user.
+	Limiter *Limiter
+
+	Audit *Auditor
+}
+
+func (h *TOTPEnrollHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	id := identity(req)
+	if id == nil {
+		http.Error(w, "Forbidden", 403)
+		return
+	}
+	var r kubetoken.TOTPEnrollRequest
+	if err := json.NewDecoder(io.LimitReader(req.Body, 4096)).Decode(&r); err != nil && err != io.EOF {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	user := id.User
+	if r.User == "" {
+		r.User = user
+	}
+	ev := AuditEvent{Event: auditEnroll, User: r.User}
+	deny := func(code int, reason string) {
+		ev.Outcome, ev.Reason = outcomeDenied, reason
+		h.Audit.Record(req, ev)
+		http.Error(w, reason, code)
+	}
+
+	var by string
+	if r.User != user {
+		if err := requireAdmin(h.Config.Current(), id, user); err != nil {
+			deny(403, err.Error())
+			return
+		}
+		by = user
+	} else {
+		enrolled, err := h.TOTP.Enrolled(user)
+		if err != nil {
+			deny(500, err.Error())
+			return
+		}
+		switch {
+		case enrolled:
+			if err := h.TOTP.Verify(&mfaRequest{User: user}, kubetoken.MFAPasscode, r.Passcode); err != nil {
+				if h.Limiter != nil {
+					h.Limiter.Failure(user, clientIP(req))
+				}
+				deny(403, fmt.Sprintf("a passcode from your current secret is required: %v", err))
+				return
+			}
+		case !h.SelfEnroll:
+			deny(403, "ask an administrator to enroll you for TOTP")
+			return
+		}
+	}
+
+	enrollment, err := h.TOTP.Enroll(r.User, by)
+	if err != nil {
+		deny(500, err.Error())
+		return
+	}
+	ev.Outcome = outcomeAllowed
+	if by != "" {
+		ev.Reason = "enrolled by " + by
+	}
+	h.Audit.Record(req, ev)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(enrollment)
+}
+
+// totpCode returns the RFC 4226 HOTP value of secret for counter step.
+func totpCode(secret []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	off := sum[len(sum)-1] & 0xf
+	code := binary.BigEndian.Uint32(sum[off:off+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, code%1000000)
+}
+
+// apply applies a record read from the TOTP file.
+func (p *TOTPProvider) apply(line []byte) error {
+	var rec totpRecord
+	if err := json.Unmarshal(line, &rec); err != nil {
+		return err
+	}
+	if e := rec.Enrolled; e != nil {
+		p.secrets[e.User] = e.Secret
+		delete(p.used, e.User)
+	}
+	if u := rec.Used; u != nil && u.Step > p.used[u.User] {
+		p.used[u.User] = u.Step
+	}
+	return nil
+}
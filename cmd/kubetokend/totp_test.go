@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/base32"
+	"encoding/json"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/atlassian/kubetoken"
+)
+
+func TestTOTPCode(t *testing.T) {
+	// RFC 6238 appendix B, truncated to six digits.
+	secret := []byte("12345678901234567890")
+	tests := []struct {
+		time int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1234567890, "005924"},
+		{20000000000, "353130"},
+	}
+	for _, tt := range tests {
+		if got := totpCode(secret, tt.time/30); got != tt.want {
+			t.Errorf("%d: got %s, want %s", tt.time, got, tt.want)
+		}
+	}
+}
+
+func TestTOTPProvider(t *testing.T) {
+	dir, err := ioutil.TempDir("", "totp_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "totp.json")
+	p, err := openTOTP(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	now := time.Unix(1500000000, 0)
+	p.now = func() time.Time { return now }
+
+	r := &mfaRequest{User: "dcheney"}
+	if err := p.Verify(r, kubetoken.MFAPasscode, "123456"); err != errNotEnrolled {
+		t.Fatalf("before enrollment: got %v, want %v", err, errNotEnrolled)
+	}
+	e, err := p.Enroll("dcheney", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the enrollment is recorded at the provider's time.
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rec totpRecord
+	if err := json.Unmarshal(b, &rec); err != nil || rec.Enrolled == nil || !rec.Enrolled.Time.Equal(now) {
+		t.Fatalf("got enrollment record %s: %v, want time %v", b, err, now)
+	}
+	secret, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(e.Secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(e.URI)
+	if err != nil || u.Scheme != "otpauth" || u.Query().Get("secret") != e.Secret {
+		t.Fatalf("unexpected uri %q: %v", e.URI, err)
+	}
+
+	step := now.Unix() / 30
+	if err := p.Verify(r, kubetoken.MFAPasscode, totpCode(secret, step-5)); err == nil {
+		t.Errorf("expected stale passcode to be rejected")
+	}
+	if err := p.Verify(r, kubetoken.MFAPasscode, totpCode(secret, step)); err != nil {
+		t.Fatalf("current passcode: %v", err)
+	}
+	if err := p.Verify(r, kubetoken.MFAPasscode, totpCode(secret, step)); err == nil {
+		t.Errorf("expected reused passcode to be rejected")
+	}
+	if err := p.Verify(r, kubetoken.MFAPasscode, totpCode(secret, step-1)); err == nil {
+		t.Errorf("expected passcode older than a used one to be rejected")
+	}
+	if err := p.Verify(r, kubetoken.MFAPush, ""); err == nil {
+		t.Errorf("expected push to be rejected")
+	}
+
+	// another process sharing the file sees the enrollment, and the
+	// passcodes used.
+	q, err := openTOTP(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	q.now = p.now
+	if err := q.Verify(r, kubetoken.MFAPasscode, totpCode(secret, step)); err == nil {
+		t.Errorf("expected passcode used by another process to be rejected")
+	}
+	now = now.Add(30 * time.Second)
+	if err := q.Verify(r, kubetoken.MFAPasscode, totpCode(secret, step+1)); err != nil {
+		t.Errorf("next passcode: %v", err)
+	}
+}
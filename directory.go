@@ -0,0 +1,110 @@
+package kubetoken
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	ldap "gopkg.in/ldap.v2"
+)
+
+// Directory describes where users and groups are found in the
+// directory, and how roles are named. Empty fields default to the
+// package variables of the same name, which may be set at build time
+// with -ldflags -X.
+type Directory struct {
+	SearchBase     string `json:"searchbase,omitempty"`
+	SearchGroups   string `json:"searchgroups,omitempty"`
+	NamespaceRegex string `json:"namespaceregex,omitempty"`
+	UserOU         string `json:"userou,omitempty"`
+	BotOU          string `json:"botou,omitempty"`
+	GroupOU        string `json:"groupou,omitempty"`
+}
+
+// WithDefaults returns d with its empty fields set from the package
+// variables.
+func (d Directory) WithDefaults() Directory {
+	set := func(v *string, def string) {
+		if *v == "" {
+			*v = def
+		}
+	}
+	set(&d.SearchBase, SearchBase)
+	set(&d.SearchGroups, SearchGroups)
+	set(&d.NamespaceRegex, NamespaceRegex)
+	set(&d.UserOU, UserOU)
+	set(&d.BotOU, BotOU)
+	set(&d.GroupOU, GroupOU)
+	return d
+}
+
+// Override returns d with the fields set in o replacing its own.
+func (d Directory) Override(o Directory) Directory {
+	set := func(v *string, o string) {
+		if o != "" {
+			*v = o
+		}
+	}
+	set(&d.SearchBase, o.SearchBase)
+	set(&d.SearchGroups, o.SearchGroups)
+	set(&d.NamespaceRegex, o.NamespaceRegex)
+	set(&d.UserOU, o.UserOU)
+	set(&d.BotOU, o.BotOU)
+	set(&d.GroupOU, o.GroupOU)
+	return d
+}
+
+func (d Directory) userdn(user string) string {
+	return fmt.Sprintf(d.binddn(user), escapeDN(user))
+}
+
+func (d Directory) binddn(user string) string {
+	return "CN=%s," + d.userOU(user) + "," + d.SearchBase
+}
+
+// userOU returns the OU, relative to SearchBase, under which user is
+// found; bots are distinguished by a -bot suffix.
+func (d Directory) userOU(user string) string {
+	if strings.HasSuffix(user, "-bot") {
+		return d.BotOU
+	}
+	return d.UserOU
+}
+
+// groupBase returns the DN under which role groups are found.
+func (d Directory) groupBase() string {
+	return d.GroupOU + "," + d.SearchBase
+}
+
+func (d Directory) groupName() string {
+	groups := strings.Split(d.SearchGroups, ",")
+	var resultGroups []string
+	for _, group := range groups {
+		if group == "" {
+			continue
+		}
+		escapedPrefix := ldap.EscapeFilter(group)
+		expanded := fmt.Sprintf("cn=%s-*-*-*-dl-*", escapedPrefix)
+		resultGroups = append(resultGroups, expanded)
+	}
+
+	if len(resultGroups) == 1 {
+		return resultGroups[0]
+	}
+	return "|(" + strings.Join(resultGroups, ")(") + ")"
+}
+
+// isRoleGroup reports whether the group name matches one of the
+// SearchGroups role patterns; see groupName.
+func (d Directory) isRoleGroup(name string) bool {
+	for _, group := range strings.Split(d.SearchGroups, ",") {
+		if group == "" {
+			continue
+		}
+		re := regexp.MustCompile("^" + regexp.QuoteMeta(group) + "-.*-.*-.*-dl-")
+		if re.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
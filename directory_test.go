@@ -0,0 +1,29 @@
+package kubetoken
+
+import "testing"
+
+func TestDirectory(t *testing.T) {
+	defer func(base string) { SearchBase = base }(SearchBase)
+	SearchBase = "DC=example,DC=com"
+
+	config := Directory{SearchBase: "DC=config,DC=com", UserOU: "OU=staff"}
+	flags := Directory{UserOU: "OU=flags"}
+	got := config.Override(flags).WithDefaults()
+	want := Directory{
+		SearchBase:     "DC=config,DC=com",
+		SearchGroups:   SearchGroups,
+		NamespaceRegex: NamespaceRegex,
+		UserOU:         "OU=flags",
+		BotOU:          BotOU,
+		GroupOU:        GroupOU,
+	}
+	if got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	if got := (Directory{}).WithDefaults().SearchBase; got != "DC=example,DC=com" {
+		t.Errorf("expected the SearchBase variable as default, got %q", got)
+	}
+	if got := got.userdn("dcheney"); got != "CN=dcheney,OU=flags,DC=config,DC=com" {
+		t.Errorf("userdn: got %q", got)
+	}
+}
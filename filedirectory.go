@@ -0,0 +1,233 @@
+package kubetoken
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/ghodss/yaml"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// FileDirectory authenticates requests carrying HTTP Basic credentials
+// against the users and bots listed in a JSON or YAML file, for
+// development and small installations without Active Directory. A
+// user's roles are the groups they are a member of, directly or through
+// nested groups, as they would be in Active Directory.
+//
+// The file has the form
+//
+//	users:
+//	  dcheney: $2a$10$...   # bcrypt hash of the user's password
+//	bots:
+//	  deploy-bot: $2a$10$...
+//	groups:
+//	  kube-example-web-dev-dl-dev: [engineering, deploy-bot]
+//	  engineering: [dcheney]
+//
+// where the members of a group may be users, bots, or other groups.
+type FileDirectory struct {
+	Path string
+
+	// Directory describes how roles are named.
+	Directory Directory
+
+	dir atomic.Value // *fileDirectory
+}
+
+// directoryFile is the format of a FileDirectory's file.
+type directoryFile struct {
+	Users  map[string]string   `json:"users"`
+	Bots   map[string]string   `json:"bots"`
+	Groups map[string][]string `json:"groups"`
+}
+
+// OpenFileDirectory returns a FileDirectory which has loaded the file at
+// path.
+func OpenFileDirectory(path string) (*FileDirectory, error) {
+	d := &FileDirectory{Path: path}
+	return d, d.Reload()
+}
+
+// Reload loads and validates the file at d.Path. If it is invalid, the
+// previously loaded directory is kept. Requests authenticated before a
+// reload continue to see the directory they were authenticated against.
+func (d *FileDirectory) Reload() error {
+	buf, err := ioutil.ReadFile(d.Path)
+	if err != nil {
+		return err
+	}
+	var f directoryFile
+	if err := yaml.Unmarshal(buf, &f); err != nil {
+		return fmt.Errorf("%s: %v", d.Path, err)
+	}
+	dir, err := newFileDirectory(&f)
+	if err != nil {
+		return fmt.Errorf("%s: %v", d.Path, err)
+	}
+	d.dir.Store(dir)
+	return nil
+}
+
+// dummyHash is the bcrypt hash, at the default cost, of a password no
+// user has, with which the passwords of unknown users are compared.
+var dummyHash = []byte("$2a$10$blQG0Sc6vZKyjqwxCMBq/u42ptGAh06yw8R/e/AMRYl2wZA5tTIv.")
+
+func (d *FileDirectory) Authenticate(req *http.Request) (*Identity, error) {
+	user, pass, ok := req.BasicAuth()
+	if !ok {
+		return nil, ErrNoCredentials
+	}
+	if user == "" || pass == "" {
+		return nil, ErrInvalidCredentials
+	}
+	dir, _ := d.dir.Load().(*fileDirectory)
+	if dir == nil {
+		return nil, fmt.Errorf("%s: not loaded", d.Path)
+	}
+	hash, ok := dir.passwords[user]
+	if !ok {
+		// compare against a hash anyway, so unknown users take as
+		// long to reject as a wrong password.
+		hash = dummyHash
+	}
+	if err := bcrypt.CompareHashAndPassword(hash, []byte(pass)); err != nil || !ok {
+		return nil, ErrInvalidCredentials
+	}
+	roles := &fileRoles{fileDirectory: dir, layout: d.Directory.WithDefaults()}
+	return &Identity{
+		User:          user,
+		RoleProvider:  roles,
+		RoleValidator: roles,
+	}, nil
+}
+
+// FindUser returns the Identity of user.
+func (d *FileDirectory) FindUser(user string) (*Identity, error) {
+	dir, _ := d.dir.Load().(*fileDirectory)
+	if dir == nil {
+		return nil, fmt.Errorf("%s: not loaded", d.Path)
+	}
+	if _, ok := dir.passwords[user]; !ok {
+		return nil, ErrInvalidCredentials
+	}
+	roles := &fileRoles{fileDirectory: dir, layout: d.Directory.WithDefaults()}
+	return &Identity{
+		User:          user,
+		RoleProvider:  roles,
+		RoleValidator: roles,
+	}, nil
+}
+
+// fileDirectory is the content of a FileDirectory's file at one point
+// in time.
+type fileDirectory struct {
+	passwords map[string][]byte   // bcrypt hashes of users and bots
+	memberOf  map[string][]string // groups each user, bot, or group is a direct member of
+}
+
+func newFileDirectory(f *directoryFile) (*fileDirectory, error) {
+	dir := &fileDirectory{
+		passwords: make(map[string][]byte),
+		memberOf:  make(map[string][]string),
+	}
+	add := func(name, hash string) error {
+		if name == "" {
+			return fmt.Errorf("empty username")
+		}
+		if _, ok := dir.passwords[name]; ok {
+			return fmt.Errorf("%q is listed more than once", name)
+		}
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return fmt.Errorf("%q: password is not a bcrypt hash: %v", name, err)
+		}
+		dir.passwords[name] = []byte(hash)
+		return nil
+	}
+	for name, hash := range f.Users {
+		if strings.HasSuffix(name, "-bot") {
+			return nil, fmt.Errorf("user %q must be listed in bots", name)
+		}
+		if err := add(name, hash); err != nil {
+			return nil, err
+		}
+	}
+	for name, hash := range f.Bots {
+		if !strings.HasSuffix(name, "-bot") {
+			return nil, fmt.Errorf("bot %q must end in -bot", name)
+		}
+		if err := add(name, hash); err != nil {
+			return nil, err
+		}
+	}
+	for group, members := range f.Groups {
+		if _, ok := dir.passwords[group]; ok {
+			return nil, fmt.Errorf("%q is both a user and a group", group)
+		}
+		for _, member := range members {
+			_, isUser := dir.passwords[member]
+			_, isGroup := f.Groups[member]
+			if !isUser && !isGroup {
+				return nil, fmt.Errorf("group %q: unknown member %q", group, member)
+			}
+		}
+	}
+	for group, members := range f.Groups {
+		for _, member := range members {
+			dir.memberOf[member] = append(dir.memberOf[member], group)
+		}
+	}
+	return dir, nil
+}
+
+// groups returns every group user is a member of, directly or through
+// nested groups. Cycles of nested groups are followed once.
+func (d *fileDirectory) groups(user string) map[string]bool {
+	seen := make(map[string]bool)
+	next := d.memberOf[user]
+	for len(next) > 0 {
+		group := next[len(next)-1]
+		next = next[:len(next)-1]
+		if seen[group] {
+			continue
+		}
+		seen[group] = true
+		next = append(next, d.memberOf[group]...)
+	}
+	return seen
+}
+
+// fileRoles is a RoleProvider and RoleValidator for the users of a
+// fileDirectory.
+type fileRoles struct {
+	*fileDirectory
+	layout Directory
+}
+
+// FetchRolesForUser returns the groups user is a member of which match
+// SearchGroups.
+func (d *fileRoles) FetchRolesForUser(user string) ([]string, error) {
+	var roles []string
+	for group := range d.groups(user) {
+		if d.layout.isRoleGroup(group) {
+			roles = append(roles, group)
+		}
+	}
+	sort.Strings(roles)
+	return roles, nil
+}
+
+// ValidateRoleForUser validates user is a member of role, directly or
+// through nested groups.
+func (d *fileRoles) ValidateRoleForUser(user, role string) error {
+	if _, ok := d.passwords[user]; !ok {
+		return fmt.Errorf("%q: no such user", user)
+	}
+	if !d.groups(user)[role] {
+		return fmt.Errorf("%q is not a member of %q", user, role)
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+package kubetoken
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestDummyHash(t *testing.T) {
+	// unknown users must cost as much to reject as known ones.
+	cost, err := bcrypt.Cost(dummyHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cost != bcrypt.DefaultCost {
+		t.Errorf("got cost %d, want %d", cost, bcrypt.DefaultCost)
+	}
+}
+
+func TestFileDirectory(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "kubetoken")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "users.yaml")
+	write := func(s string) {
+		if err := ioutil.WriteFile(path, []byte(s), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(`
+users:
+  dcheney: ` + string(hash) + `
+  jdoe: ` + string(hash) + `
+bots:
+  deploy-bot: ` + string(hash) + `
+groups:
+  kube-example-web-dev-dl-dev: [engineering, deploy-bot]
+  kube-example-web-prod-dl-prod: [sre]
+  engineering: [dcheney, platform]
+  platform: [engineering]
+  sre: [jdoe]
+`)
+
+	d, err := OpenFileDirectory(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Directory = Directory{SearchGroups: "kube"}
+
+	tests := []struct {
+		user, pass string
+		err        error
+		roles      []string
+	}{
+		{user: "dcheney", pass: "secret", roles: []string{"kube-example-web-dev-dl-dev"}},
+		{user: "deploy-bot", pass: "secret", roles: []string{"kube-example-web-dev-dl-dev"}},
+		{user: "jdoe", pass: "secret", roles: []string{"kube-example-web-prod-dl-prod"}},
+		{user: "dcheney", pass: "wrong", err: ErrInvalidCredentials},
+		{user: "dcheney", pass: "", err: ErrInvalidCredentials},
+		{user: "nobody", pass: "secret", err: ErrInvalidCredentials},
+		{user: "nobody", pass: "kubetoken-dummy-password", err: ErrInvalidCredentials},
+		{user: "engineering", pass: "secret", err: ErrInvalidCredentials},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/api/v1/roles", nil)
+		req.SetBasicAuth(tt.user, tt.pass)
+		id, err := d.Authenticate(req)
+		if err != tt.err {
+			t.Errorf("%s/%s: got err %v, want %v", tt.user, tt.pass, err, tt.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		roles, err := id.FetchRolesForUser(id.User)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(roles, tt.roles) {
+			t.Errorf("%s: got roles %v, want %v", tt.user, roles, tt.roles)
+		}
+	}
+
+	req := httptest.NewRequest("GET", "/api/v1/roles", nil)
+	if _, err := d.Authenticate(req); err != ErrNoCredentials {
+		t.Errorf("no credentials: got err %v, want %v", err, ErrNoCredentials)
+	}
+
+	req.SetBasicAuth("dcheney", "secret")
+	id, err := d.Authenticate(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := id.ValidateRoleForUser("dcheney", "platform"); err != nil {
+		t.Errorf("expected nested platform membership to validate: %v", err)
+	}
+	if err := id.ValidateRoleForUser("dcheney", "kube-example-web-prod-dl-prod"); err == nil {
+		t.Errorf("expected kube-example-web-prod-dl-prod membership not to validate")
+	}
+
+	// a reload applies to later requests only.
+	write(`
+users:
+  dcheney: ` + string(hash) + `
+groups:
+  kube-example-web-prod-dl-prod: [dcheney]
+`)
+	if err := d.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if err := id.ValidateRoleForUser("dcheney", "kube-example-web-dev-dl-dev"); err != nil {
+		t.Errorf("expected existing identity to keep its memberships: %v", err)
+	}
+	id, err = d.Authenticate(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := id.ValidateRoleForUser("dcheney", "kube-example-web-prod-dl-prod"); err != nil {
+		t.Errorf("expected reloaded membership to validate: %v", err)
+	}
+
+	// users are found without their password.
+	id, err = d.FindUser("dcheney")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := id.ValidateRoleForUser("dcheney", "kube-example-web-prod-dl-prod"); err != nil {
+		t.Errorf("expected membership of found user to validate: %v", err)
+	}
+	if _, err := d.FindUser("nobody"); err != ErrInvalidCredentials {
+		t.Errorf("unknown user: got err %v, want %v", err, ErrInvalidCredentials)
+	}
+
+	// an invalid file is rejected, keeping the previous directory.
+	for _, s := range []string{
+		`users: {dcheney: plaintext}`,
+		`users: {deploy-bot: ` + string(hash) + `}`,
+		`bots: {deploy: ` + string(hash) + `}`,
+		`groups: {kube-example-web-dev-dl-dev: [nobody]}`,
+		`{users: {dcheney: ` + string(hash) + `}, groups: {dcheney: []}}`,
+	} {
+		write(s)
+		if err := d.Reload(); err == nil {
+			t.Errorf("%s: expected error", s)
+		}
+	}
+	if _, err := d.Authenticate(req); err != nil {
+		t.Errorf("after failed reload: got err %v", err)
+	}
+}
@@ -2,12 +2,17 @@
 package cert
 
 import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha1"
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/asn1"
 	"encoding/pem"
 	"fmt"
 	"io"
@@ -19,6 +24,71 @@ import (
 
 const keySize = 2048
 
+// Key types, as named in the kubetoken discovery document.
+const (
+	RSA     = "rsa"
+	ECDSA   = "ecdsa" // on the P-256 curve
+	Ed25519 = "ed25519"
+)
+
+// GenerateKey generates a private key of keyType, reading randomness
+// from r.
+func GenerateKey(r io.Reader, keyType string) (crypto.Signer, error) {
+	switch keyType {
+	case RSA:
+		return rsa.GenerateKey(r, keySize)
+	case ECDSA:
+		return ecdsa.GenerateKey(elliptic.P256(), r)
+	case Ed25519:
+		_, key, err := ed25519.GenerateKey(r)
+		return key, err
+	default:
+		return nil, errors.Errorf("unsupported key type %q", keyType)
+	}
+}
+
+// MarshalPrivateKey returns key PEM encoded; RSA keys in PKCS#1 form,
+// ECDSA keys in SEC 1 form, and Ed25519 keys in PKCS#8 form.
+func MarshalPrivateKey(key crypto.Signer) ([]byte, error) {
+	var block *pem.Block
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		block = &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}
+	case *ecdsa.PrivateKey:
+		der, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		block = &pem.Block{Type: "EC PRIVATE KEY", Bytes: der}
+	default:
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		block = &pem.Block{Type: "PRIVATE KEY", Bytes: der}
+	}
+	return pem.EncodeToMemory(block), nil
+}
+
+// ParsePrivateKey parses an RSA, ECDSA or Ed25519 private key in
+// PKCS#1, PKCS#8 or SEC 1 DER form.
+func ParsePrivateKey(der []byte) (crypto.Signer, error) {
+	if key, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParsePKCS8PrivateKey(der); err == nil {
+		signer, ok := key.(crypto.Signer)
+		if !ok {
+			return nil, errors.Errorf("unsupported private key type %T", key)
+		}
+		return signer, nil
+	}
+	if key, err := x509.ParseECPrivateKey(der); err == nil {
+		return key, nil
+	}
+	return nil, errors.New("private key is not an RSA, ECDSA or Ed25519 key in PKCS#1, PKCS#8 or SEC 1 form")
+}
+
 // NewCert generates a certificate/key pair.
 func NewCert(caCertPEM, caKeyPEM []byte, expiry time.Time, cn string, extKeyUsage []x509.ExtKeyUsage) ([]byte, []byte, error) {
 	cert, key, err := newCert(rand.Reader, caCertPEM, caKeyPEM, expiry, cn, extKeyUsage)
@@ -53,7 +123,7 @@ func newCert(r io.Reader, caCertPEM, caKeyPEM []byte, expiry time.Time, cn strin
 		return nil, nil, errors.New("CA certificate is not a valid CA")
 	}
 
-	caKey, ok := tlsCert.PrivateKey.(*rsa.PrivateKey)
+	caKey, ok := tlsCert.PrivateKey.(crypto.Signer)
 	if !ok {
 		return nil, nil, fmt.Errorf("CA private key has unexpected type %T", tlsCert.PrivateKey)
 	}
@@ -62,18 +132,22 @@ func newCert(r io.Reader, caCertPEM, caKeyPEM []byte, expiry time.Time, cn strin
 		return nil, nil, fmt.Errorf("cannot generate key: %v", err)
 	}
 
+	serial, err := newSerial(r)
+	if err != nil {
+		return nil, nil, err
+	}
 	now := time.Now()
 	template := &x509.Certificate{
-		SerialNumber: newSerial(now),
+		SerialNumber: serial,
 		Subject: pkix.Name{
 			CommonName: cn,
 		},
 		NotBefore: now.UTC().AddDate(0, 0, -1),
 		NotAfter:  expiry.UTC(),
 
-		SubjectKeyId: bigIntHash(key.N),
+		SubjectKeyId: keyID(&key.PublicKey),
 		ExtKeyUsage:  []x509.ExtKeyUsage{
-		//	x509.ExtKeyUsageAny,
+			//	x509.ExtKeyUsageAny,
 		},
 	}
 	cert, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, caKey)
@@ -91,19 +165,22 @@ func newCA(r io.Reader, cn string, expiry time.Time) ([]byte, []byte, error) {
 		return nil, nil, err
 	}
 
+	serial, err := newSerial(r)
+	if err != nil {
+		return nil, nil, err
+	}
 	now := time.Now()
-	serial := newSerial(now)
 	template := &x509.Certificate{
 		SerialNumber: serial,
 		Subject: pkix.Name{
 			CommonName:   cn,
 			SerialNumber: serial.String(),
 		},
-		NotBefore:    now.UTC().AddDate(0, 0, -1),
-		NotAfter:     expiry.UTC(),
-		SubjectKeyId: bigIntHash(key.N),
-		KeyUsage:     x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
-		IsCA:         true,
+		NotBefore:             now.UTC().AddDate(0, 0, -1),
+		NotAfter:              expiry.UTC(),
+		SubjectKeyId:          keyID(&key.PublicKey),
+		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		IsCA:                  true,
 		BasicConstraintsValid: true,
 	}
 	certDER, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
@@ -121,8 +198,10 @@ func newCA(r io.Reader, cn string, expiry time.Time) ([]byte, []byte, error) {
 	return certPEMData, keyPEMData, nil
 }
 
-func SignCSR(csr *x509.CertificateRequest, parent *x509.Certificate, privKey *rsa.PrivateKey) ([]byte, error) {
-	certDER, err := signCSR(rand.Reader, csr, parent, privKey)
+// SignCSR signs csr with parent and privKey, returning a PEM encoded
+// certificate which is valid until expiry.
+func SignCSR(csr *x509.CertificateRequest, parent *x509.Certificate, privKey crypto.Signer, expiry time.Time) ([]byte, error) {
+	certDER, err := signCSR(rand.Reader, csr, parent, privKey, expiry)
 	if err != nil {
 		return nil, err
 	}
@@ -134,26 +213,30 @@ func SignCSR(csr *x509.CertificateRequest, parent *x509.Certificate, privKey *rs
 
 }
 
-func signCSR(r io.Reader, csr *x509.CertificateRequest, parent *x509.Certificate, privKey *rsa.PrivateKey) ([]byte, error) {
+func signCSR(r io.Reader, csr *x509.CertificateRequest, parent *x509.Certificate, privKey crypto.Signer, expiry time.Time) ([]byte, error) {
+	serial, err := newSerial(r)
+	if err != nil {
+		return nil, err
+	}
 	now := time.Now()
 	template := &x509.Certificate{
-		SerialNumber: newSerial(now),
+		SerialNumber: serial,
 		Subject:      csr.Subject,
 		NotBefore:    now.UTC().AddDate(0, 0, -1),
-		NotAfter:     time.Now().UTC().Add(6 * time.Hour),
-		SubjectKeyId: bigIntHash(privKey.N),
+		NotAfter:     expiry.UTC(),
+		SubjectKeyId: keyID(csr.PublicKey),
 	}
 	return x509.CreateCertificate(rand.Reader, template, parent, csr.PublicKey, privKey)
 }
 
-// NewCSR generates a CSR for CN=user,O=role
+// NewCSR generates a CSR for CN=user,O=role with a new key of keyType.
 // It returns the CSR and private key in PEM format.
-func NewCSR(user string, role string) ([]byte, []byte, error) {
-	return newCSR(rand.Reader, user, role)
+func NewCSR(user string, role string, keyType string) ([]byte, []byte, error) {
+	return newCSR(rand.Reader, keyType, user, role)
 }
 
-func newCSR(r io.Reader, user string, roles ...string) ([]byte, []byte, error) {
-	key, err := rsa.GenerateKey(r, keySize)
+func newCSR(r io.Reader, keyType string, user string, roles ...string) ([]byte, []byte, error) {
+	key, err := GenerateKey(r, keyType)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -166,23 +249,61 @@ func newCSR(r io.Reader, user string, roles ...string) ([]byte, []byte, error) {
 	}
 
 	csrDER, err := x509.CreateCertificateRequest(r, template, key)
+	if err != nil {
+		return nil, nil, err
+	}
 	csrPEM := pem.EncodeToMemory(&pem.Block{
 		Type:  "CERTIFICATE REQUEST",
 		Bytes: csrDER,
 	})
-	keyPEM := pem.EncodeToMemory(&pem.Block{
-		Type:  "RSA PRIVATE KEY",
-		Bytes: x509.MarshalPKCS1PrivateKey(key),
-	})
-	return csrPEM, keyPEM, nil
+	keyPEM, err := MarshalPrivateKey(key)
+	return csrPEM, keyPEM, err
+}
+
+// serialLimit is the exclusive upper bound of certificate serial numbers.
+var serialLimit = new(big.Int).Lsh(big.NewInt(1), 128)
+
+// newSerial returns a random, positive, 128 bit certificate serial number
+// read from r.
+func newSerial(r io.Reader) (*big.Int, error) {
+	for {
+		serial, err := rand.Int(r, serialLimit)
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot generate serial number")
+		}
+		if serial.Sign() > 0 {
+			return serial, nil
+		}
+	}
 }
 
-func newSerial(now time.Time) *big.Int {
-	return big.NewInt(int64(now.Nanosecond()))
+// publicKeyHash returns the SHA-1 hash of the subject public key of c
+// as described in RFC 5280, section 4.2.1.2.
+func publicKeyHash(c *x509.Certificate) []byte {
+	h := sha1.Sum(SubjectPublicKey(c))
+	return h[:]
 }
 
-func bigIntHash(n *big.Int) []byte {
-	h := sha1.New()
-	h.Write(n.Bytes())
-	return h.Sum(nil)
+// SubjectPublicKey returns the contents of the subjectPublicKey field of c,
+// the value from which key identifiers and OCSP issuer key hashes are derived.
+// If c was not produced by parsing a certificate, SubjectPublicKey returns nil.
+func SubjectPublicKey(c *x509.Certificate) []byte {
+	var spki struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+	if _, err := asn1.Unmarshal(c.RawSubjectPublicKeyInfo, &spki); err != nil {
+		return nil
+	}
+	return spki.PublicKey.Bytes
+}
+
+// keyID returns the key identifier of pub, the SHA-1 hash of its
+// subject public key as described in RFC 5280, section 4.2.1.2.
+func keyID(pub crypto.PublicKey) []byte {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil
+	}
+	return publicKeyHash(&x509.Certificate{RawSubjectPublicKeyInfo: der})
 }
@@ -1,9 +1,17 @@
 package cert
 
 import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
 	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/pem"
 	"io/ioutil"
+	"math/big"
+	"reflect"
 	"testing"
 	"time"
 )
@@ -25,6 +33,163 @@ func TestNewLeaf(t *testing.T) {
 	}
 }
 
+func TestSignCSR(t *testing.T) {
+	keyTypes := []string{RSA, ECDSA, Ed25519}
+	for _, caKeyType := range keyTypes {
+		ca, caKey := testCA(t, caKeyType)
+		for _, keyType := range keyTypes {
+			csrPEM, keyPEM, err := NewCSR("dcheney", "kube-example-web-dev-dl-dev", keyType)
+			if err != nil {
+				t.Fatal(err)
+			}
+			block, _ := pem.Decode(csrPEM)
+			csr, err := x509.ParseCertificateRequest(block.Bytes)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			expiry := time.Now().Add(90 * time.Minute).Truncate(time.Second)
+			certPEM, err := SignCSR(csr, ca, caKey, expiry)
+			if err != nil {
+				t.Fatalf("%s CA, %s key: %v", caKeyType, keyType, err)
+			}
+			cert := parseCertificate(t, certPEM)
+			if err := cert.CheckSignatureFrom(ca); err != nil {
+				t.Fatalf("%s CA, %s key: cert %v not signed by %v: %v", caKeyType, keyType, cert.Subject, ca.Subject, err)
+			}
+			if !cert.NotAfter.Equal(expiry) {
+				t.Errorf("%s CA, %s key: NotAfter: got %v, want %v", caKeyType, keyType, cert.NotAfter, expiry)
+			}
+			if _, err := tls.X509KeyPair(certPEM, keyPEM); err != nil {
+				t.Errorf("%s CA, %s key: %v", caKeyType, keyType, err)
+			}
+		}
+	}
+}
+
+func TestParsePrivateKey(t *testing.T) {
+	pkcs8 := func(key crypto.Signer) ([]byte, error) { return x509.MarshalPKCS8PrivateKey(key) }
+	tests := []struct {
+		keyType string
+		marshal func(crypto.Signer) ([]byte, error)
+	}{
+		{RSA, func(key crypto.Signer) ([]byte, error) {
+			return x509.MarshalPKCS1PrivateKey(key.(*rsa.PrivateKey)), nil
+		}},
+		{RSA, pkcs8},
+		{ECDSA, func(key crypto.Signer) ([]byte, error) { return x509.MarshalECPrivateKey(key.(*ecdsa.PrivateKey)) }},
+		{ECDSA, pkcs8},
+		{Ed25519, pkcs8},
+	}
+	for i, tt := range tests {
+		key, err := GenerateKey(rand.Reader, tt.keyType)
+		if err != nil {
+			t.Fatal(err)
+		}
+		der, err := tt.marshal(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ParsePrivateKey(der)
+		if err != nil {
+			t.Errorf("%d: %s: %v", i, tt.keyType, err)
+			continue
+		}
+		if !reflect.DeepEqual(got.Public(), key.Public()) {
+			t.Errorf("%d: %s: parsed a different key", i, tt.keyType)
+		}
+	}
+	if _, err := ParsePrivateKey([]byte("garbage")); err == nil {
+		t.Errorf("expected garbage to be rejected")
+	}
+}
+
+// testCA returns a self signed CA certificate with a key of keyType.
+func testCA(t *testing.T, keyType string) (*x509.Certificate, crypto.Signer) {
+	key, err := GenerateKey(rand.Reader, keyType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: keyType + "-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ca, key
+}
+
+func TestNewSerial(t *testing.T) {
+	seen := make(map[string]bool)
+	for i := 0; i < 1000; i++ {
+		serial, err := newSerial(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if serial.Sign() <= 0 || serial.BitLen() > 128 {
+			t.Fatalf("serial %v out of range", serial)
+		}
+		if seen[serial.String()] {
+			t.Fatalf("duplicate serial %v", serial)
+		}
+		seen[serial.String()] = true
+	}
+}
+
+func TestCreateCRL(t *testing.T) {
+	// the test CA has no key usage extension, so is permitted to sign CRLs.
+	ca := parseCertificate(t, readFile(t, "_testdata/ssl/ca.pem"))
+	block, _ := pem.Decode(readFile(t, "_testdata/ssl/ca-key.pem"))
+	caKey, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().Truncate(time.Second)
+	revoked := []x509.RevocationListEntry{{
+		SerialNumber:   big.NewInt(1234),
+		RevocationTime: now,
+		ReasonCode:     1,
+	}}
+	der, err := CreateCRL(ca, caKey, revoked, big.NewInt(1), now, now.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	crl, err := x509.ParseRevocationList(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := crl.CheckSignatureFrom(ca); err != nil {
+		t.Fatal("crl not signed by", ca.Subject, err)
+	}
+	if len(crl.RevokedCertificateEntries) != 1 || crl.RevokedCertificateEntries[0].SerialNumber.Int64() != 1234 {
+		t.Fatalf("unexpected revoked certificates: %v", crl.RevokedCertificateEntries)
+	}
+	if !crl.NextUpdate.Equal(now.Add(time.Hour)) {
+		t.Errorf("NextUpdate: got %v, want %v", crl.NextUpdate, now.Add(time.Hour))
+	}
+
+	// a CA whose key usage does not include CRL signing is refused.
+	ca.KeyUsage = x509.KeyUsageCertSign
+	if CanSignCRLs(ca) {
+		t.Error("CanSignCRLs: got true for a CA without crlSign key usage")
+	}
+	if _, err := CreateCRL(ca, caKey, revoked, big.NewInt(2), now, now.Add(time.Hour)); err == nil {
+		t.Fatal("expected error signing CRL without crlSign key usage")
+	}
+}
+
 func TestNewCA(t *testing.T) {
 	cn := "kube-ca"
 	expiry := time.Now().Add(time.Hour)
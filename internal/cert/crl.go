@@ -0,0 +1,46 @@
+package cert
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"io"
+	"math/big"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// CreateCRL returns a DER encoded X.509 v2 CRL signed by parent and key
+// which lists the revoked certificates.
+func CreateCRL(parent *x509.Certificate, key crypto.Signer, revoked []x509.RevocationListEntry, number *big.Int, thisUpdate, nextUpdate time.Time) ([]byte, error) {
+	return createCRL(rand.Reader, parent, key, revoked, number, thisUpdate, nextUpdate)
+}
+
+// CanSignCRLs reports whether the key usage of ca permits it to sign
+// CRLs. CAs made by kubetoken before CRLs were published do not.
+func CanSignCRLs(ca *x509.Certificate) bool {
+	// RFC 5280, section 4.2.1.3; a CA certificate without a key usage
+	// extension is not restricted in the keys it may sign.
+	return ca.KeyUsage == 0 || ca.KeyUsage&x509.KeyUsageCRLSign != 0
+}
+
+func createCRL(r io.Reader, parent *x509.Certificate, key crypto.Signer, revoked []x509.RevocationListEntry, number *big.Int, thisUpdate, nextUpdate time.Time) ([]byte, error) {
+	if !CanSignCRLs(parent) {
+		return nil, errors.Errorf("CA %v is not permitted to sign CRLs", parent.Subject)
+	}
+	issuer := *parent
+	if issuer.KeyUsage == 0 {
+		issuer.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+	}
+	if len(issuer.SubjectKeyId) == 0 {
+		issuer.SubjectKeyId = publicKeyHash(parent)
+	}
+	template := &x509.RevocationList{
+		RevokedCertificateEntries: revoked,
+		Number:                    number,
+		ThisUpdate:                thisUpdate.UTC(),
+		NextUpdate:                nextUpdate.UTC(),
+	}
+	return x509.CreateRevocationList(r, template, &issuer, key)
+}
@@ -4,6 +4,9 @@ package kubetoken
 // Version is populated by the release process.
 var Version string = "unknown"
 
+// The following variables are the defaults for the fields of Directory
+// of the same name, and may be set at build time with -ldflags -X.
+
 // SearchBase is the LDAP search base.
 var SearchBase string = "DC=example,DC=com"
 
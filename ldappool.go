@@ -0,0 +1,272 @@
+package kubetoken
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	ldap "gopkg.in/ldap.v2"
+)
+
+// LDAPPool connects to one of a set of equivalent directory servers,
+// failing over to the next when a server cannot be reached, and keeps a
+// pool of connections bound as a service account for searches.
+//
+// The embedded LDAPCreds supplies the port, security mode, timeouts,
+// and the service account's BindDN and Password; its Host and Context
+// are ignored. If BindDN is empty, no service account is used and
+// searches are made as the user.
+type LDAPPool struct {
+	// Hosts are the directory servers, tried in order. A host may
+	// include a port, otherwise LDAPCreds.Port is used.
+	Hosts []string
+
+	LDAPCreds
+
+	// MaxIdle is the maximum number of idle service account
+	// connections kept open.
+	MaxIdle int
+
+	// IdleTimeout is how long an idle connection is kept open. If
+	// zero, idle connections are kept until the server closes them.
+	IdleTimeout time.Duration
+
+	// RetryAfter is how long a host which could not be reached is
+	// tried only after every healthy host.
+	RetryAfter time.Duration
+
+	mu   sync.Mutex
+	idle []idleConn
+	down map[string]time.Time // hosts which failed, and when
+}
+
+type idleConn struct {
+	conn  *ldap.Conn
+	since time.Time
+}
+
+// BindAs verifies password by binding to the directory as bindDN,
+// abandoning the attempt if ctx is done. It returns a connection for
+// searches, bound as the service account if one is configured,
+// otherwise as bindDN.
+func (p *LDAPPool) BindAs(ctx context.Context, bindDN, password string) (LDAPConn, error) {
+	if p.BindDN != "" {
+		if err := p.Verify(ctx, bindDN, password); err != nil {
+			return nil, err
+		}
+		return p.Conn()
+	}
+	conn, err := p.bind(p.userCreds(ctx, bindDN, password))
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// Verify verifies password by binding to the directory as bindDN,
+// abandoning the attempt if ctx is done.
+func (p *LDAPPool) Verify(ctx context.Context, bindDN, password string) error {
+	conn, err := p.bind(p.userCreds(ctx, bindDN, password))
+	if err != nil {
+		return err
+	}
+	conn.Close()
+	return nil
+}
+
+func (p *LDAPPool) userCreds(ctx context.Context, bindDN, password string) LDAPCreds {
+	creds := p.LDAPCreds
+	creds.BindDN = bindDN
+	creds.Password = password
+	creds.Context = ctx
+	return creds
+}
+
+// Conn returns a connection bound as the service account. Closing the
+// connection returns it to the pool.
+func (p *LDAPPool) Conn() (LDAPConn, error) {
+	if conn := p.get(); conn != nil {
+		return &pooledConn{pool: p, conn: conn, reused: true}, nil
+	}
+	conn, err := p.bind(p.LDAPCreds)
+	if err != nil {
+		return nil, err
+	}
+	return &pooledConn{pool: p, conn: conn}, nil
+}
+
+// Close closes the idle connections in the pool.
+func (p *LDAPPool) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, c := range p.idle {
+		c.conn.Close()
+	}
+	p.idle = nil
+}
+
+// bind connects to the first host which can be reached and binds with
+// creds. A failure to bind does not cause failover, as it is likely to
+// be the fault of the credentials rather than the host.
+func (p *LDAPPool) bind(creds LDAPCreds) (*ldap.Conn, error) {
+	if len(p.Hosts) == 0 {
+		return nil, fmt.Errorf("no LDAP hosts configured")
+	}
+	start := time.Now()
+	var err error
+	for _, host := range p.hosts(start) {
+		creds.Host, creds.Port = splitHostPort(host, p.Port)
+		var conn *ldap.Conn
+		conn, err = creds.dial()
+		if err != nil {
+			if creds.Context != nil && creds.Context.Err() != nil {
+				break
+			}
+			p.markDown(host)
+			continue
+		}
+		p.markUp(host)
+		err = conn.Bind(creds.BindDN, creds.Password)
+		observeLDAP("bind", start, err)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+	observeLDAP("bind", start, err)
+	return nil, err
+}
+
+// hosts returns p.Hosts in the order they should be tried; healthy
+// hosts first, then hosts which have failed within RetryAfter, least
+// recently failed first.
+func (p *LDAPPool) hosts(now time.Time) []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var up, down []string
+	for _, host := range p.Hosts {
+		if t, ok := p.down[host]; ok && now.Sub(t) < p.RetryAfter {
+			down = append(down, host)
+			continue
+		}
+		up = append(up, host)
+	}
+	for i := 1; i < len(down); i++ {
+		for j := i; j > 0 && p.down[down[j]].Before(p.down[down[j-1]]); j-- {
+			down[j], down[j-1] = down[j-1], down[j]
+		}
+	}
+	return append(up, down...)
+}
+
+func (p *LDAPPool) markDown(host string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.down == nil {
+		p.down = make(map[string]time.Time)
+	}
+	p.down[host] = time.Now()
+}
+
+func (p *LDAPPool) markUp(host string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.down, host)
+}
+
+// get returns an idle connection, or nil if there are none.
+func (p *LDAPPool) get() *ldap.Conn {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for len(p.idle) > 0 {
+		c := p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+		if p.IdleTimeout > 0 && time.Since(c.since) > p.IdleTimeout {
+			c.conn.Close()
+			continue
+		}
+		return c.conn
+	}
+	return nil
+}
+
+// put returns conn to the pool, or closes it if the pool is full.
+func (p *LDAPPool) put(conn *ldap.Conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.idle) >= p.MaxIdle {
+		conn.Close()
+		return
+	}
+	p.idle = append(p.idle, idleConn{conn: conn, since: time.Now()})
+}
+
+// pooledConn is a service account connection which is returned to its
+// pool when closed, unless it has failed.
+type pooledConn struct {
+	pool   *LDAPPool
+	conn   *ldap.Conn
+	reused bool // conn was taken from the idle pool
+	broken bool
+}
+
+func (c *pooledConn) Search(req *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	if c.conn == nil {
+		return nil, fmt.Errorf("ldap: connection closed")
+	}
+	sr, err := c.conn.Search(req)
+	if err != nil && c.reused && isNetworkError(err) {
+		// the server may have closed the connection while it was
+		// idle; retry once with a new connection.
+		c.conn.Close()
+		c.reused = false
+		c.conn, err = c.pool.bind(c.pool.LDAPCreds)
+		if err != nil {
+			c.broken = true
+			return nil, err
+		}
+		sr, err = c.conn.Search(req)
+	}
+	if err != nil && isNetworkError(err) {
+		c.broken = true
+	}
+	return sr, err
+}
+
+func (c *pooledConn) Close() {
+	if c.conn == nil {
+		return
+	}
+	if c.broken {
+		c.conn.Close()
+	} else {
+		c.pool.put(c.conn)
+	}
+	c.conn = nil
+}
+
+func isNetworkError(err error) bool {
+	return ldap.IsErrorWithCode(err, ldap.ErrorNetwork)
+}
+
+func isInvalidCredentials(err error) bool {
+	return ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials)
+}
+
+// splitHostPort splits host into a host and port, using port if host
+// does not include one.
+func splitHostPort(host string, port int) (string, int) {
+	h, p, err := net.SplitHostPort(host)
+	if err != nil {
+		return host, port
+	}
+	n, err := strconv.Atoi(p)
+	if err != nil {
+		return host, port
+	}
+	return h, n
+}
@@ -0,0 +1,195 @@
+package kubetoken
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	ber "gopkg.in/asn1-ber.v1"
+	ldap "gopkg.in/ldap.v2"
+)
+
+// fakeDirectory is a minimal LDAP server which accepts simple binds
+// with the password "secret", and answers every search with no entries.
+type fakeDirectory struct {
+	l net.Listener
+
+	mu    sync.Mutex
+	conns int
+	binds map[string]int // successful binds by DN
+}
+
+func newFakeDirectory(t *testing.T) *fakeDirectory {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &fakeDirectory{l: l, binds: make(map[string]int)}
+	go d.serve()
+	return d
+}
+
+func (d *fakeDirectory) Addr() string { return d.l.Addr().String() }
+
+func (d *fakeDirectory) Close() { d.l.Close() }
+
+func (d *fakeDirectory) serve() {
+	for {
+		c, err := d.l.Accept()
+		if err != nil {
+			return
+		}
+		d.mu.Lock()
+		d.conns++
+		d.mu.Unlock()
+		go d.handle(c)
+	}
+}
+
+func (d *fakeDirectory) handle(c net.Conn) {
+	defer c.Close()
+	for {
+		p, err := ber.ReadPacket(c)
+		if err != nil || len(p.Children) < 2 {
+			return
+		}
+		id := p.Children[0].Value
+		op := p.Children[1]
+		switch op.Tag {
+		case ldap.ApplicationBindRequest:
+			dn, password := op.Children[1].Data.String(), op.Children[2].Data.String()
+			code := ldap.LDAPResultSuccess
+			if password != "secret" {
+				code = ldap.LDAPResultInvalidCredentials
+			} else {
+				d.mu.Lock()
+				d.binds[dn]++
+				d.mu.Unlock()
+			}
+			d.respond(c, id, ldap.ApplicationBindResponse, code)
+		case ldap.ApplicationSearchRequest:
+			d.respond(c, id, ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess)
+		default:
+			return
+		}
+	}
+}
+
+func (d *fakeDirectory) respond(c net.Conn, id interface{}, tag int, code int) {
+	envelope := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+	envelope.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, "MessageID"))
+	resp := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ber.Tag(tag), nil, "Response")
+	resp.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, code, "resultCode"))
+	resp.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "matchedDN"))
+	resp.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "diagnosticMessage"))
+	envelope.AppendChild(resp)
+	c.Write(envelope.Bytes())
+}
+
+func (d *fakeDirectory) stats() (int, map[string]int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	binds := make(map[string]int)
+	for dn, n := range d.binds {
+		binds[dn] = n
+	}
+	return d.conns, binds
+}
+
+// unreachableHost returns the address of a port on which nothing listens.
+func unreachableHost(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	return addr
+}
+
+func search(t *testing.T, conn LDAPConn) {
+	req := ldap.NewSearchRequest("DC=example,DC=com", ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false, "(cn=*)", nil, nil)
+	if _, err := conn.Search(req); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLDAPPoolFailover(t *testing.T) {
+	d := newFakeDirectory(t)
+	defer d.Close()
+	dead := unreachableHost(t)
+
+	p := &LDAPPool{
+		Hosts:      []string{dead, d.Addr()},
+		LDAPCreds:  LDAPCreds{Mode: Plain, DialTimeout: time.Second},
+		RetryAfter: time.Minute,
+	}
+	defer p.Close()
+
+	conn, err := p.BindAs(context.Background(), "CN=dcheney", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	search(t, conn)
+	conn.Close()
+
+	if got := p.hosts(time.Now()); got[0] != d.Addr() || got[1] != dead {
+		t.Fatalf("expected unreachable host to be tried last, got %v", got)
+	}
+	if got := p.hosts(time.Now().Add(2 * time.Minute)); got[0] != dead {
+		t.Fatalf("expected unreachable host to be retried after RetryAfter, got %v", got)
+	}
+
+	// a rejected password does not mark the host down.
+	if _, err := p.BindAs(context.Background(), "CN=dcheney", "wrong"); !ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+		t.Fatalf("expected invalid credentials, got %v", err)
+	}
+	if got := p.hosts(time.Now()); got[0] != d.Addr() {
+		t.Fatalf("expected %s to remain healthy, got %v", d.Addr(), got)
+	}
+}
+
+func TestLDAPPoolServiceAccount(t *testing.T) {
+	d := newFakeDirectory(t)
+	defer d.Close()
+	host, port, _ := net.SplitHostPort(d.Addr())
+	n, _ := strconv.Atoi(port)
+
+	p := &LDAPPool{
+		Hosts: []string{host},
+		LDAPCreds: LDAPCreds{
+			Port:     n,
+			Mode:     Plain,
+			BindDN:   "CN=kubetoken-svc",
+			Password: "secret",
+		},
+		MaxIdle: 1,
+	}
+	defer p.Close()
+
+	for i := 0; i < 3; i++ {
+		conn, err := p.BindAs(context.Background(), "CN=dcheney", "secret")
+		if err != nil {
+			t.Fatal(err)
+		}
+		search(t, conn)
+		conn.Close()
+	}
+	if _, err := p.BindAs(context.Background(), "CN=dcheney", "wrong"); err == nil {
+		t.Fatal("expected invalid password to be rejected")
+	}
+
+	conns, binds := d.stats()
+	if binds["CN=dcheney"] != 3 {
+		t.Errorf("expected the user to bind 3 times, got %d", binds["CN=dcheney"])
+	}
+	if binds["CN=kubetoken-svc"] != 1 {
+		t.Errorf("expected the service account to bind once, got %d", binds["CN=kubetoken-svc"])
+	}
+	if conns != 5 {
+		t.Errorf("expected 5 connections, got %d", conns)
+	}
+}
@@ -0,0 +1,308 @@
+package kubetoken
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	ldap "gopkg.in/ldap.v2"
+)
+
+// LDAPSchema describes how a directory other than Active Directory, such
+// as OpenLDAP or 389 Directory Server, stores users and groups.
+type LDAPSchema struct {
+	// UserClass is the object class of users. If empty,
+	// "inetOrgPerson" is used.
+	UserClass string
+
+	// UserAttr is the attribute naming a user in their DN. If empty,
+	// "uid" is used.
+	UserAttr string
+
+	// GroupClass is the object class of groups. If empty,
+	// "groupOfNames" is used.
+	GroupClass string
+
+	// GroupAttr is the attribute holding a group's name. If empty, "cn"
+	// is used.
+	GroupAttr string
+
+	// MemberAttr is the attribute of a group listing the DNs of its
+	// members. If empty, "member" is used; groupOfUniqueNames groups
+	// use "uniqueMember".
+	MemberAttr string
+
+	// MemberOfAttr, if set, is the attribute of a user or group
+	// listing the DNs of the groups it is a direct member of, as
+	// maintained by a memberOf overlay. It is read in place of
+	// searching the groups' MemberAttr.
+	MemberOfAttr string
+}
+
+func (s LDAPSchema) withDefaults() LDAPSchema {
+	if s.UserClass == "" {
+		s.UserClass = "inetOrgPerson"
+	}
+	if s.UserAttr == "" {
+		s.UserAttr = "uid"
+	}
+	if s.GroupClass == "" {
+		s.GroupClass = "groupOfNames"
+	}
+	if s.GroupAttr == "" {
+		s.GroupAttr = "cn"
+	}
+	if s.MemberAttr == "" {
+		s.MemberAttr = "member"
+		if strings.EqualFold(s.GroupClass, "groupOfUniqueNames") {
+			s.MemberAttr = "uniqueMember"
+		}
+	}
+	return s
+}
+
+func (s LDAPSchema) userDN(dir Directory, user string) string {
+	return fmt.Sprintf("%s=%s,%s,%s", s.UserAttr, escapeDN(user), dir.userOU(user), dir.SearchBase)
+}
+
+// LDAPAuthenticator authenticates requests carrying HTTP Basic
+// credentials by binding to a generic LDAP directory as the user. The
+// user's roles are read from the directory.
+type LDAPAuthenticator struct {
+	Pool   *LDAPPool
+	Schema LDAPSchema
+
+	// Search, if not nil, is used to find users' DNs in place of
+	// constructing them from their username.
+	Search *UserSearch
+
+	// Directory is the layout of the directory.
+	Directory Directory
+}
+
+func (a *LDAPAuthenticator) Authenticate(req *http.Request) (*Identity, error) {
+	s := a.Schema.withDefaults()
+	dir := a.Directory.WithDefaults()
+	userdn := func(user string) string { return s.userDN(dir, user) }
+	lookup := a.Search.lookup(a.Pool, dir, userdn, s.UserAttr, fmt.Sprintf("(objectClass=%s)", ldap.EscapeFilter(s.UserClass)))
+	user, dn, bind, err := authenticateBind(a.Pool, req, lookup)
+	if err != nil {
+		return nil, err
+	}
+	r := &LDAPRoleProvider{Schema: a.Schema, Bind: bind, UserDN: dn, Directory: dir}
+	return &Identity{
+		User:          user,
+		RoleProvider:  r,
+		RoleValidator: r,
+	}, nil
+}
+
+// FindUser returns the Identity of user, whose roles are read as the
+// LDAPPool's service account.
+func (a *LDAPAuthenticator) FindUser(user string) (*Identity, error) {
+	s := a.Schema.withDefaults()
+	dir := a.Directory.WithDefaults()
+	userdn := func(user string) string { return s.userDN(dir, user) }
+	lookup := a.Search.byName().lookup(a.Pool, dir, userdn, s.UserAttr, fmt.Sprintf("(objectClass=%s)", ldap.EscapeFilter(s.UserClass)))
+	dn, user, err := findUser(a.Pool, lookup, user)
+	if err != nil {
+		return nil, err
+	}
+	r := &LDAPRoleProvider{Schema: a.Schema, Bind: a.Pool.Conn, UserDN: dn, Directory: dir}
+	return &Identity{
+		User:          user,
+		RoleProvider:  r,
+		RoleValidator: r,
+	}, nil
+}
+
+// LDAPRoleProvider retrieves and validates the roles available to a user
+// from a generic LDAP directory. Group membership is expanded through
+// nested groups by the client, as only Active Directory can do so in a
+// single search.
+type LDAPRoleProvider struct {
+	Schema LDAPSchema
+	Bind   func() (LDAPConn, error)
+
+	// UserDN, if set, is the DN of the user, in place of one
+	// constructed from their username.
+	UserDN string
+
+	// Directory is the layout of the directory.
+	Directory Directory
+}
+
+// ldapGroup is a group found in the directory.
+type ldapGroup struct {
+	dn, name string
+}
+
+// FetchRolesForUser returns the groups under GroupOU which user is a
+// member of, directly or through nested groups, and which match
+// SearchGroups.
+func (r *LDAPRoleProvider) FetchRolesForUser(user string) ([]string, error) {
+	groups, err := r.groups(user)
+	if err != nil {
+		return nil, err
+	}
+	dir := r.Directory.WithDefaults()
+	var roles []string
+	for _, g := range groups {
+		if dir.isRoleGroup(g.name) {
+			roles = append(roles, g.name)
+		}
+	}
+	sort.Strings(roles)
+	return roles, nil
+}
+
+// ValidateRoleForUser validates user is a member of the group named role
+// under GroupOU, directly or through nested groups.
+func (r *LDAPRoleProvider) ValidateRoleForUser(user, role string) error {
+	groups, err := r.groups(user)
+	if err != nil {
+		return err
+	}
+	for _, g := range groups {
+		if g.name == role {
+			return nil
+		}
+	}
+	return fmt.Errorf("%q is not a member of %q", user, role)
+}
+
+// groups returns the groups under GroupOU which user is a member of,
+// directly or through nested groups.
+func (r *LDAPRoleProvider) groups(user string) ([]ldapGroup, error) {
+	conn, err := r.Bind()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	s := r.Schema.withDefaults()
+	dir := r.Directory.WithDefaults()
+	dn := r.UserDN
+	if dn == "" {
+		dn = s.userDN(dir, user)
+	}
+	var groups []ldapGroup
+	if s.MemberOfAttr != "" {
+		groups, err = memberOfGroups(conn, s, dn)
+	} else {
+		groups, err = memberGroups(conn, s, dir.SearchBase, dn)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	base, err := ldap.ParseDN(dir.groupBase())
+	if err != nil {
+		return nil, err
+	}
+	var roles []ldapGroup
+	for _, g := range groups {
+		dn, err := ldap.ParseDN(g.dn)
+		if err == nil && withinDN(base, dn) {
+			roles = append(roles, g)
+		}
+	}
+	return roles, nil
+}
+
+// memberGroups returns the groups userdn is a member of by searching
+// searchBase for groups listing it, and then each group found, as a
+// member. Each group is searched for once, so cycles of nested groups
+// terminate.
+func memberGroups(conn LDAPConn, s LDAPSchema, searchBase, userdn string) ([]ldapGroup, error) {
+	var groups []ldapGroup
+	seen := map[string]bool{strings.ToLower(userdn): true}
+	for next := []string{userdn}; len(next) > 0; next = next[1:] {
+		filter := fmt.Sprintf("(&(objectClass=%s)(%s=%s))", ldap.EscapeFilter(s.GroupClass), ldap.EscapeFilter(s.MemberAttr), ldap.EscapeFilter(next[0]))
+		sr, err := searchLDAP(conn, searchBase, ldap.ScopeWholeSubtree, filter, []string{s.GroupAttr})
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range sr.Entries {
+			if seen[strings.ToLower(e.DN)] {
+				continue
+			}
+			seen[strings.ToLower(e.DN)] = true
+			groups = append(groups, ldapGroup{dn: e.DN, name: e.GetAttributeValue(s.GroupAttr)})
+			next = append(next, e.DN)
+		}
+	}
+	return groups, nil
+}
+
+// memberOfGroups returns the groups userdn is a member of by reading
+// its MemberOfAttr, and then that of each group found. Each group is
+// read once, so cycles of nested groups terminate.
+func memberOfGroups(conn LDAPConn, s LDAPSchema, userdn string) ([]ldapGroup, error) {
+	sr, err := searchLDAP(conn, userdn, ldap.ScopeBaseObject, fmt.Sprintf("(objectClass=%s)", ldap.EscapeFilter(s.UserClass)), []string{s.MemberOfAttr})
+	if err != nil {
+		return nil, err
+	}
+	if len(sr.Entries) != 1 {
+		return nil, fmt.Errorf("%s: no such user", userdn)
+	}
+
+	var groups []ldapGroup
+	seen := map[string]bool{strings.ToLower(userdn): true}
+	for next := sr.Entries[0].GetAttributeValues(s.MemberOfAttr); len(next) > 0; next = next[1:] {
+		if seen[strings.ToLower(next[0])] {
+			continue
+		}
+		seen[strings.ToLower(next[0])] = true
+		sr, err := searchLDAP(conn, next[0], ldap.ScopeBaseObject, fmt.Sprintf("(objectClass=%s)", ldap.EscapeFilter(s.GroupClass)), []string{s.GroupAttr, s.MemberOfAttr})
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+			// a dangling reference to a deleted group.
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range sr.Entries {
+			groups = append(groups, ldapGroup{dn: e.DN, name: e.GetAttributeValue(s.GroupAttr)})
+			next = append(next, e.GetAttributeValues(s.MemberOfAttr)...)
+		}
+	}
+	return groups, nil
+}
+
+// withinDN reports whether dn is below base, ignoring case as
+// directories do.
+func withinDN(base, dn *ldap.DN) bool {
+	if len(dn.RDNs) <= len(base.RDNs) {
+		return false
+	}
+	rdns := dn.RDNs[len(dn.RDNs)-len(base.RDNs):]
+	for i, rdn := range base.RDNs {
+		if len(rdn.Attributes) != len(rdns[i].Attributes) {
+			return false
+		}
+		for j, a := range rdn.Attributes {
+			b := rdns[i].Attributes[j]
+			if !strings.EqualFold(a.Type, b.Type) || !strings.EqualFold(a.Value, b.Value) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func searchLDAP(conn LDAPConn, base string, scope int, filter string, attrs []string) (*ldap.SearchResult, error) {
+	req := ldap.NewSearchRequest(
+		base,
+		scope, ldap.NeverDerefAliases, 0, 0, false,
+		filter,
+		attrs,
+		nil,
+	)
+	start := time.Now()
+	sr, err := conn.Search(req)
+	observeLDAP("search", start, err)
+	return sr, err
+}
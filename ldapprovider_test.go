@@ -0,0 +1,189 @@
+package kubetoken
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	ber "gopkg.in/asn1-ber.v1"
+	ldap "gopkg.in/ldap.v2"
+)
+
+// memDirectory is an LDAPConn which searches entries held in memory.
+// It supports filters composed of &, |, = and =*, compared ignoring
+// case.
+type memDirectory []*ldap.Entry
+
+func entry(dn string, attrs map[string][]string) *ldap.Entry {
+	e := &ldap.Entry{DN: dn}
+	for name, values := range attrs {
+		e.Attributes = append(e.Attributes, &ldap.EntryAttribute{Name: name, Values: values})
+	}
+	return e
+}
+
+func (d memDirectory) Search(req *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	filter, err := ldap.CompileFilter(req.Filter)
+	if err != nil {
+		return nil, err
+	}
+	base, err := ldap.ParseDN(req.BaseDN)
+	if err != nil {
+		return nil, err
+	}
+	var sr ldap.SearchResult
+	for _, e := range d {
+		dn, err := ldap.ParseDN(e.DN)
+		if err != nil {
+			return nil, err
+		}
+		if req.Scope == ldap.ScopeBaseObject {
+			if !strings.EqualFold(e.DN, req.BaseDN) {
+				continue
+			}
+			if !matchFilter(filter, e) {
+				return &sr, nil
+			}
+			sr.Entries = append(sr.Entries, e)
+			return &sr, nil
+		}
+		if withinDN(base, dn) && matchFilter(filter, e) {
+			sr.Entries = append(sr.Entries, e)
+		}
+	}
+	if req.Scope == ldap.ScopeBaseObject {
+		return nil, ldap.NewError(ldap.LDAPResultNoSuchObject, errors.New("no such object"))
+	}
+	return &sr, nil
+}
+
+func (d memDirectory) Close() {}
+
+func matchFilter(f *ber.Packet, e *ldap.Entry) bool {
+	switch f.Tag {
+	case ldap.FilterAnd:
+		for _, c := range f.Children {
+			if !matchFilter(c, e) {
+				return false
+			}
+		}
+		return true
+	case ldap.FilterOr:
+		for _, c := range f.Children {
+			if matchFilter(c, e) {
+				return true
+			}
+		}
+		return false
+	case ldap.FilterPresent:
+		return len(e.GetAttributeValues(f.Data.String())) > 0
+	case ldap.FilterEqualityMatch:
+		for _, v := range e.GetAttributeValues(f.Children[0].Data.String()) {
+			if strings.EqualFold(v, f.Children[1].Data.String()) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func TestLDAPRoleProvider(t *testing.T) {
+	layout := Directory{SearchBase: "dc=example,dc=com", SearchGroups: "kube"}
+	const (
+		dcheney = "uid=dcheney,OU=people,dc=example,dc=com"
+		deploy  = "uid=deploy-bot,OU=bots,OU=people,dc=example,dc=com"
+		dev     = "cn=kube-example-web-dev-dl-dev,OU=access,OU=groups,dc=example,dc=com"
+		prod    = "cn=kube-example-web-prod-dl-prod,OU=access,OU=groups,dc=example,dc=com"
+		eng     = "cn=engineering,ou=teams,dc=example,dc=com"
+		loop    = "cn=loop,OU=access,OU=groups,dc=example,dc=com"
+	)
+	// dcheney is a member of dev through engineering, which is in a
+	// cycle with loop; deploy-bot is a member of prod directly.
+	groups := map[string][]string{
+		dev:  {eng},
+		prod: {deploy},
+		eng:  {dcheney, loop},
+		loop: {eng},
+	}
+	memberOf := make(map[string][]string)
+	for group, members := range groups {
+		for _, m := range members {
+			memberOf[m] = append(memberOf[m], group)
+		}
+	}
+
+	var member, unique, overlay memDirectory
+	for _, user := range []string{dcheney, deploy} {
+		member = append(member, entry(user, map[string][]string{"objectClass": {"inetOrgPerson"}}))
+		unique = append(unique, entry(user, map[string][]string{"objectClass": {"inetOrgPerson"}}))
+		overlay = append(overlay, entry(user, map[string][]string{"objectClass": {"inetOrgPerson"}, "memberOf": memberOf[user]}))
+	}
+	for group, members := range groups {
+		cn := strings.TrimPrefix(strings.SplitN(group, ",", 2)[0], "cn=")
+		member = append(member, entry(group, map[string][]string{"objectClass": {"groupOfNames"}, "cn": {cn}, "member": members}))
+		unique = append(unique, entry(group, map[string][]string{"objectClass": {"groupOfUniqueNames"}, "cn": {cn}, "uniqueMember": members}))
+		overlay = append(overlay, entry(group, map[string][]string{"objectClass": {"groupOfNames"}, "cn": {cn}, "memberOf": memberOf[group]}))
+	}
+	// a dangling reference to a deleted group is ignored.
+	overlay[0].Attributes = append(overlay[0].Attributes, &ldap.EntryAttribute{Name: "memberOf", Values: []string{"cn=deleted,dc=example,dc=com"}})
+
+	tests := []struct {
+		name   string
+		dir    memDirectory
+		schema LDAPSchema
+	}{
+		{"groupOfNames", member, LDAPSchema{}},
+		{"groupOfUniqueNames", unique, LDAPSchema{GroupClass: "groupOfUniqueNames", MemberAttr: "uniqueMember"}},
+		{"memberOf", overlay, LDAPSchema{MemberOfAttr: "memberOf"}},
+	}
+	for _, tt := range tests {
+		dir := tt.dir
+		r := &LDAPRoleProvider{
+			Schema:    tt.schema,
+			Bind:      func() (LDAPConn, error) { return dir, nil },
+			Directory: layout,
+		}
+		for user, want := range map[string][]string{
+			"dcheney":    {"kube-example-web-dev-dl-dev"},
+			"deploy-bot": {"kube-example-web-prod-dl-prod"},
+		} {
+			roles, err := r.FetchRolesForUser(user)
+			if err != nil {
+				t.Fatalf("%s: %s: %v", tt.name, user, err)
+			}
+			if !reflect.DeepEqual(roles, want) {
+				t.Errorf("%s: %s: got roles %v, want %v", tt.name, user, roles, want)
+			}
+		}
+		if err := r.ValidateRoleForUser("dcheney", "loop"); err != nil {
+			t.Errorf("%s: expected nested loop membership to validate: %v", tt.name, err)
+		}
+		if err := r.ValidateRoleForUser("dcheney", "kube-example-web-prod-dl-prod"); err == nil {
+			t.Errorf("%s: expected kube-example-web-prod-dl-prod membership not to validate", tt.name)
+		}
+		// engineering is not under GroupOU.
+		if err := r.ValidateRoleForUser("dcheney", "engineering"); err == nil {
+			t.Errorf("%s: expected engineering membership not to validate", tt.name)
+		}
+	}
+}
+
+func TestLDAPSchemaDefaults(t *testing.T) {
+	tests := []struct {
+		schema LDAPSchema
+		want   string // MemberAttr
+	}{
+		{LDAPSchema{}, "member"},
+		{LDAPSchema{GroupClass: "groupOfNames"}, "member"},
+		{LDAPSchema{GroupClass: "groupOfUniqueNames"}, "uniqueMember"},
+		{LDAPSchema{GroupClass: "groupofuniquenames"}, "uniqueMember"},
+		{LDAPSchema{GroupClass: "groupOfUniqueNames", MemberAttr: "member"}, "member"},
+		{LDAPSchema{GroupClass: "posixGroup", MemberAttr: "memberUid"}, "memberUid"},
+	}
+	for _, tt := range tests {
+		if got := tt.schema.withDefaults().MemberAttr; got != tt.want {
+			t.Errorf("%+v: got MemberAttr %q, want %q", tt.schema, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package kubetoken
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	oidc "github.com/coreos/go-oidc"
+)
+
+// OIDCAuthenticator authenticates requests carrying an OpenID Connect
+// ID token as a bearer token. The user's roles are those groups in the
+// token's groups claim which match the Directory's SearchGroups.
+type OIDCAuthenticator struct {
+	Verifier *oidc.IDTokenVerifier
+
+	// UsernameClaim is the claim holding the username. If empty, "sub"
+	// is used.
+	UsernameClaim string
+
+	// GroupsClaim is the claim holding the user's groups. If empty,
+	// "groups" is used.
+	GroupsClaim string
+
+	// Directory describes how roles are named.
+	Directory Directory
+}
+
+// NewOIDCAuthenticator returns an OIDCAuthenticator which accepts ID
+// tokens issued by issuer for clientID. If jwksURL is empty, the
+// issuer's signing keys are found by OpenID Connect discovery.
+func NewOIDCAuthenticator(ctx context.Context, issuer, clientID, jwksURL string) (*OIDCAuthenticator, error) {
+	config := &oidc.Config{ClientID: clientID}
+	if jwksURL != "" {
+		keys := oidc.NewRemoteKeySet(ctx, jwksURL)
+		return &OIDCAuthenticator{Verifier: oidc.NewVerifier(issuer, keys, config)}, nil
+	}
+	provider, err := oidc.NewProvider(ctx, issuer)
+	if err != nil {
+		return nil, err
+	}
+	return &OIDCAuthenticator{Verifier: provider.Verifier(config)}, nil
+}
+
+func (a *OIDCAuthenticator) Authenticate(req *http.Request) (*Identity, error) {
+	const prefix = "Bearer "
+	auth := req.Header.Get("Authorization")
+	if len(auth) < len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+		return nil, ErrNoCredentials
+	}
+	token, err := a.Verifier.Verify(req.Context(), auth[len(prefix):])
+	if err != nil {
+		return nil, ErrInvalidCredentials
+	}
+	var claims map[string]interface{}
+	if err := token.Claims(&claims); err != nil {
+		return nil, err
+	}
+
+	usernameClaim := a.UsernameClaim
+	if usernameClaim == "" {
+		usernameClaim = "sub"
+	}
+	user, _ := claims[usernameClaim].(string)
+	if user == "" {
+		return nil, fmt.Errorf("ID token has no %q claim", usernameClaim)
+	}
+
+	groupsClaim := a.GroupsClaim
+	if groupsClaim == "" {
+		groupsClaim = "groups"
+	}
+	groups := &GroupRoles{Directory: a.Directory}
+	switch v := claims[groupsClaim].(type) {
+	case string:
+		groups.Groups = []string{v}
+	case []interface{}:
+		for _, g := range v {
+			if g, ok := g.(string); ok {
+				groups.Groups = append(groups.Groups, g)
+			}
+		}
+	}
+	return &Identity{
+		User:          user,
+		RoleProvider:  groups,
+		RoleValidator: groups,
+	}, nil
+}
+
+// GroupRoles is a RoleProvider and RoleValidator for a user who is a
+// member of Groups.
+type GroupRoles struct {
+	Groups []string
+
+	// Directory describes how roles are named.
+	Directory Directory
+}
+
+// FetchRolesForUser returns the groups which match SearchGroups.
+func (g *GroupRoles) FetchRolesForUser(user string) ([]string, error) {
+	dir := g.Directory.WithDefaults()
+	var roles []string
+	for _, group := range g.Groups {
+		if dir.isRoleGroup(group) {
+			roles = append(roles, group)
+		}
+	}
+	return roles, nil
+}
+
+// ValidateRoleForUser validates role is one of the groups.
+func (g *GroupRoles) ValidateRoleForUser(user, role string) error {
+	for _, group := range g.Groups {
+		if group == role {
+			return nil
+		}
+	}
+	return fmt.Errorf("%q is not a member of %q", user, role)
+}
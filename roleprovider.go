@@ -3,7 +3,7 @@ package kubetoken
 import (
 	"bytes"
 	"fmt"
-	"strings"
+	"time"
 
 	ldap "gopkg.in/ldap.v2"
 )
@@ -12,58 +12,53 @@ import (
 // roles available to a specific user.
 type ADRoleProvider struct {
 	LDAPCreds
-}
 
-func userdn(user string) string {
-	return fmt.Sprintf(binddn(user), escapeDN(user))
-}
+	// Bind, if not nil, is used to connect to the directory in place
+	// of LDAPCreds, for example to use an LDAPPool.
+	Bind func() (LDAPConn, error)
 
-func binddn(user string) string {
-	if strings.HasSuffix(user, "-bot") {
-		return "CN=%s," + BotOU + "," + SearchBase
-	}
-	return "CN=%s," + UserOU + "," + SearchBase
+	// UserDN, if set, is the DN of the user, in place of one
+	// constructed from their username.
+	UserDN string
+
+	// Directory is the layout of the directory.
+	Directory Directory
 }
 
-func groupName() string {
-	groups := strings.Split(SearchGroups, ",")
-	var resultGroups []string
-	for _, group := range groups {
-		if group == "" {
-			continue
+func (r *ADRoleProvider) FetchRolesForUser(user string) ([]string, error) {
+	bind := r.Bind
+	if bind == nil {
+		bind = func() (LDAPConn, error) {
+			return r.LDAPCreds.Bind()
 		}
-		escapedPrefix := ldap.EscapeFilter(group)
-		expanded := fmt.Sprintf("cn=%s-*-*-*-dl-*", escapedPrefix)
-		resultGroups = append(resultGroups, expanded)
 	}
-
-	if len(resultGroups) == 1 {
-		return resultGroups[0]
+	dir := r.Directory.WithDefaults()
+	dn := r.UserDN
+	if dn == "" {
+		dn = dir.userdn(user)
 	}
-	return "|(" + strings.Join(resultGroups,")(") + ")"
-}
-
-func (r *ADRoleProvider) FetchRolesForUser(user string) ([]string, error) {
-	return fetchRolesForUser(&r.LDAPCreds, userdn(user))
+	return fetchRolesForUser(bind, dir, dn)
 }
 
-func fetchRolesForUser(creds *LDAPCreds, userdn string) ([]string, error) {
-	conn, err := creds.Bind()
+func fetchRolesForUser(bind func() (LDAPConn, error), dir Directory, userdn string) ([]string, error) {
+	conn, err := bind()
 	if err != nil {
 		return nil, err
 	}
 	defer conn.Close()
 
 	// find all the SearchGroups roles
-	filter := fmt.Sprintf("(&(%s)(member:1.2.840.113556.1.4.1941:=%s))", groupName(), userdn)
+	filter := fmt.Sprintf("(&(%s)(member:1.2.840.113556.1.4.1941:=%s))", dir.groupName(), ldap.EscapeFilter(userdn))
 	kubeRoles := ldap.NewSearchRequest(
-		GroupOU + "," + SearchBase,
+		dir.groupBase(),
 		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
 		filter,
 		[]string{"cn"},
 		nil,
 	)
+	start := time.Now()
 	sr, err := conn.Search(kubeRoles)
+	observeLDAP("search", start, err)
 	if err != nil {
 		return nil, err
 	}
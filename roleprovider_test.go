@@ -17,9 +17,9 @@ func TestBinddn(t *testing.T) {
 		want: "CN=%s,OU=bots,OU=people,DC=office,DC=atlassian,DC=com",
 	}}
 
-	SearchBase = "DC=office,DC=atlassian,DC=com"
+	dir := Directory{SearchBase: "DC=office,DC=atlassian,DC=com"}.WithDefaults()
 	for _, tt := range tests {
-		got := binddn(tt.role)
+		got := dir.binddn(tt.role)
 		if got != tt.want {
 			t.Errorf("binddn(%q): got: %q, want: %q", tt.role, got, tt.want)
 		}
@@ -42,8 +42,7 @@ func TestGroupName(t *testing.T) {
 	}}
 
 	for _, tt := range tests {
-		SearchGroups = tt.group
-		got := groupName()
+		got := Directory{SearchGroups: tt.group}.groupName()
 		if got != tt.want {
 			t.Errorf("binddn(%q): got: %q, want: %q", tt.group, got, tt.want)
 		}
@@ -2,6 +2,8 @@ package kubetoken
 
 import (
 	"fmt"
+	"strings"
+	"time"
 
 	ldap "gopkg.in/ldap.v2"
 )
@@ -20,13 +22,25 @@ type LDAPConn interface {
 // as specified in Active Directory flavoured LDAP.
 type ADRoleValidater struct {
 	Bind func() (LDAPConn, error)
+
+	// UserDN, if set, is the DN of the user, in place of one
+	// constructed from their username.
+	UserDN string
+
+	// Directory is the layout of the directory.
+	Directory Directory
 }
 
 func (r *ADRoleValidater) ValidateRoleForUser(user, role string) error {
-	roledn := fmt.Sprintf("cn=%s,%s,%s", escapeDN(role), GroupOU, SearchBase)
-	filter := fmt.Sprintf("(&(objectCategory=Person)(sAMAccountName=*)(memberOf:1.2.840.113556.1.4.1941:=%s))", roledn)
+	dir := r.Directory.WithDefaults()
+	dn := r.UserDN
+	if dn == "" {
+		dn = dir.userdn(user)
+	}
+	roledn := fmt.Sprintf("cn=%s,%s", escapeDN(role), dir.groupBase())
+	filter := fmt.Sprintf("(&(objectCategory=Person)(sAMAccountName=*)(memberOf:1.2.840.113556.1.4.1941:=%s))", ldap.EscapeFilter(roledn))
 	kubeRoles := ldap.NewSearchRequest(
-		userdn(user),
+		dn,
 		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
 		filter,
 		[]string{"cn"},
@@ -38,21 +52,31 @@ func (r *ADRoleValidater) ValidateRoleForUser(user, role string) error {
 	}
 	defer conn.Close()
 
+	start := time.Now()
 	sr, err := conn.Search(kubeRoles)
+	observeLDAP("search", start, err)
 	if err != nil {
 		return err
 	}
 	switch len(sr.Entries) {
 	case 0:
-		return fmt.Errorf("%s is not a member of %s", userdn(user), roledn)
+		return fmt.Errorf("%s is not a member of %s", dn, roledn)
 	case 1:
+		if r.UserDN != "" {
+			// the user was found by search, their CN need not
+			// be their username.
+			if !strings.EqualFold(sr.Entries[0].DN, r.UserDN) {
+				return fmt.Errorf("%q is not a member of %q; search returned %q", user, role, sr.Entries[0].DN)
+			}
+			return nil
+		}
 		usercn := sr.Entries[0].GetAttributeValue("cn")
 		if user != usercn {
 			return fmt.Errorf("%q is not a member of %q; search returned %q", user, role, usercn)
 		}
 		return nil
 	default:
-		return fmt.Errorf("got %d entires for query %s: %s", len(sr.Entries), filter, sr.Entries)
+		return fmt.Errorf("got %d entires for query %s: %v", len(sr.Entries), filter, sr.Entries)
 	}
 
 }
@@ -1,6 +1,11 @@
 package kubetoken
 
-import "testing"
+import (
+	"strings"
+	"testing"
+
+	ldap "gopkg.in/ldap.v2"
+)
 
 func TestEscapeDN(t *testing.T) {
 	tests := []struct {
@@ -25,3 +30,52 @@ func TestEscapeDN(t *testing.T) {
 		}
 	}
 }
+
+// filterConn is an LDAPConn which records the filters searched for.
+type filterConn struct {
+	filters []string
+}
+
+func (c *filterConn) Search(req *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	c.filters = append(c.filters, req.Filter)
+	return &ldap.SearchResult{}, nil
+}
+
+func (c *filterConn) Close() {}
+
+func TestSearchFiltersEscapeDNs(t *testing.T) {
+	// DNs found by search may hold characters special in filters.
+	const userdn = `CN=Smith\, John (Contractor),OU=people,DC=example,DC=com`
+	conn := &filterConn{}
+	bind := func() (LDAPConn, error) { return conn, nil }
+	dir := Directory{GroupOU: "OU=groups (kube)"}.WithDefaults()
+
+	p := &ADRoleProvider{Bind: bind, UserDN: userdn, Directory: dir}
+	if _, err := p.FetchRolesForUser("jsmith"); err != nil {
+		t.Fatal(err)
+	}
+	v := &ADRoleValidater{Bind: bind, UserDN: userdn, Directory: dir}
+	if err := v.ValidateRoleForUser("jsmith", "kube-example-web-dev-dl-dev"); err == nil {
+		t.Fatal("expected validation to fail without a matching entry")
+	}
+	if len(conn.filters) != 2 {
+		t.Fatalf("got %d searches, want 2", len(conn.filters))
+	}
+	for _, filter := range conn.filters {
+		f, err := ldap.CompileFilter(filter)
+		if err != nil {
+			t.Errorf("%q: %v", filter, err)
+			continue
+		}
+		// the DN must compare as a single value, not extend the filter.
+		if f.Tag != ldap.FilterAnd {
+			t.Errorf("%q: got filter tag %d, want and", filter, f.Tag)
+		}
+	}
+	if want := ldap.EscapeFilter(userdn); !strings.Contains(conn.filters[0], want) {
+		t.Errorf("roles filter %q does not contain escaped DN %q", conn.filters[0], want)
+	}
+	if strings.Contains(conn.filters[1], "(kube)") {
+		t.Errorf("validation filter %q does not escape the role DN", conn.filters[1])
+	}
+}
@@ -1,43 +1,145 @@
 package kubetoken
 
 import (
-	"crypto/rsa"
+	"context"
+	"crypto"
 	"crypto/tls"
 	"crypto/x509"
 	"fmt"
+	"net"
+	"strconv"
+	"time"
 
 	"github.com/atlassian/kubetoken/internal/cert"
 
 	ldap "gopkg.in/ldap.v2"
 )
 
+// LDAPObserver, if not nil, is called after each LDAP operation with
+// the name of the operation, "bind" or "search", its duration, and the
+// error, if any, it returned.
+var LDAPObserver func(op string, d time.Duration, err error)
+
+func observeLDAP(op string, start time.Time, err error) {
+	if LDAPObserver != nil {
+		LDAPObserver(op, time.Since(start), err)
+	}
+}
+
+// LDAP connection security modes.
+const (
+	LDAPS    = "ldaps"    // TLS from the outset, the default
+	StartTLS = "starttls" // upgrade a plain connection with StartTLS
+	Plain    = "plain"    // no TLS; for test environments only
+)
+
 type LDAPCreds struct {
 	Host     string
 	Port     int
 	BindDN   string
 	Password string
+
+	// Mode is one of LDAPS, StartTLS or Plain. If empty, LDAPS is used.
+	Mode string
+
+	// RootCAs verifies the directory's certificate. If nil, the
+	// system roots are used.
+	RootCAs *x509.CertPool
+
+	// DialTimeout bounds establishing the connection, including the
+	// TLS handshake. If zero, there is no timeout.
+	DialTimeout time.Duration
+
+	// Timeout bounds each LDAP operation. If zero, there is no timeout.
+	Timeout time.Duration
+
+	// Context, if not nil, cancels dialing when done, and closes the
+	// connection, abandoning any outstanding operation.
+	Context context.Context
 }
 
 func (l *LDAPCreds) Bind() (*ldap.Conn, error) {
-	addr := fmt.Sprintf("%s:%d", l.Host, l.Port)
-	config := tls.Config{
-		ServerName: l.Host,
-	}
-	// TODO(dfc) should construct a net.Conn explicitly
-	// to set the Dial and Read/Write Deadlines
-	conn, err := ldap.DialTLS("tcp", addr, &config)
+	start := time.Now()
+	conn, err := l.dial()
 	if err != nil {
+		observeLDAP("bind", start, err)
 		return nil, err
 	}
 	err = conn.Bind(l.BindDN, l.Password)
+	observeLDAP("bind", start, err)
 	return conn, err
 }
 
+// dial returns a connection to the directory, secured according to l.Mode.
+func (l *LDAPCreds) dial() (*ldap.Conn, error) {
+	ctx := l.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if l.DialTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, l.DialTimeout)
+		defer cancel()
+	}
+	config := &tls.Config{
+		ServerName: l.Host,
+		RootCAs:    l.RootCAs,
+	}
+	addr := net.JoinHostPort(l.Host, strconv.Itoa(l.Port))
+	var d net.Dialer
+	c, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	var conn *ldap.Conn
+	switch l.Mode {
+	case LDAPS, "":
+		// bound the handshake by the dial deadline.
+		if deadline, ok := ctx.Deadline(); ok {
+			c.SetDeadline(deadline)
+		}
+		tc := tls.Client(c, config)
+		if err := tc.Handshake(); err != nil {
+			c.Close()
+			return nil, err
+		}
+		tc.SetDeadline(time.Time{})
+		conn = ldap.NewConn(tc, true)
+		conn.Start()
+	case StartTLS, Plain:
+		conn = ldap.NewConn(c, false)
+		conn.Start()
+	default:
+		c.Close()
+		return nil, fmt.Errorf("unknown LDAP mode %q", l.Mode)
+	}
+	if l.Timeout > 0 {
+		conn.SetTimeout(l.Timeout)
+	}
+	if l.Mode == StartTLS {
+		if err := conn.StartTLS(config); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if l.Context != nil && l.Context.Done() != nil {
+		go func() {
+			<-l.Context.Done()
+			conn.Close()
+		}()
+	}
+	return conn, nil
+}
+
+// Signer signs certificates with a CA's certificate and its RSA, ECDSA
+// or Ed25519 private key.
 type Signer struct {
 	Cert    *x509.Certificate
-	PrivKey *rsa.PrivateKey
+	PrivKey crypto.Signer
 }
 
-func (s *Signer) Sign(csr *x509.CertificateRequest) ([]byte, error) {
-	return cert.SignCSR(csr, s.Cert, s.PrivKey)
+// Sign signs csr, returning a PEM encoded certificate valid until expiry.
+func (s *Signer) Sign(csr *x509.CertificateRequest, expiry time.Time) ([]byte, error) {
+	return cert.SignCSR(csr, s.Cert, s.PrivKey, expiry)
 }
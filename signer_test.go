@@ -0,0 +1,109 @@
+package kubetoken
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// unresponsiveServer returns the address of a server which accepts
+// connections but never responds, and a function to stop it.
+func unresponsiveServer(t *testing.T) (string, int, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var conns []net.Conn
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				for _, c := range conns {
+					c.Close()
+				}
+				return
+			}
+			conns = append(conns, c)
+		}
+	}()
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+	p, _ := strconv.Atoi(port)
+	return host, p, func() {
+		l.Close()
+		<-done
+	}
+}
+
+func TestLDAPCredsDialTimeout(t *testing.T) {
+	host, port, stop := unresponsiveServer(t)
+	defer stop()
+
+	creds := LDAPCreds{
+		Host:        host,
+		Port:        port,
+		DialTimeout: 100 * time.Millisecond,
+	}
+	start := time.Now()
+	if _, err := creds.Bind(); err == nil {
+		t.Fatal("expected TLS handshake to time out")
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Fatalf("Bind took %v, expected it to time out after %v", d, creds.DialTimeout)
+	}
+}
+
+func TestLDAPCredsTimeout(t *testing.T) {
+	host, port, stop := unresponsiveServer(t)
+	defer stop()
+
+	creds := LDAPCreds{
+		Host:    host,
+		Port:    port,
+		Mode:    Plain,
+		Timeout: 100 * time.Millisecond,
+	}
+	if _, err := creds.Bind(); err == nil {
+		t.Fatal("expected bind to time out")
+	}
+}
+
+func TestLDAPCredsContext(t *testing.T) {
+	host, port, stop := unresponsiveServer(t)
+	defer stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	creds := LDAPCreds{
+		Host:    host,
+		Port:    port,
+		Mode:    Plain,
+		Context: ctx,
+	}
+	time.AfterFunc(100*time.Millisecond, cancel)
+	errc := make(chan error, 1)
+	go func() {
+		_, err := creds.Bind()
+		errc <- err
+	}()
+	select {
+	case err := <-errc:
+		if err == nil {
+			t.Fatal("expected bind to be abandoned")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("bind not abandoned when context was cancelled")
+	}
+}
+
+func TestLDAPCredsUnknownMode(t *testing.T) {
+	host, port, stop := unresponsiveServer(t)
+	defer stop()
+
+	creds := LDAPCreds{Host: host, Port: port, Mode: "ldapx"}
+	if _, err := creds.Bind(); err == nil {
+		t.Fatal("expected error for unknown mode")
+	}
+}
@@ -0,0 +1,103 @@
+package kubetoken
+
+import (
+	"fmt"
+	"strings"
+
+	ldap "gopkg.in/ldap.v2"
+)
+
+// UserSearch finds a user's DN by searching the directory for the name
+// they log in with, rather than constructing it from that name. This
+// allows users whose CN differs from their login, or who are found
+// outside UserOU and BotOU, to log in, and users to log in with any of
+// several names, such as their email address.
+//
+// Searches are made as the LDAPPool's service account.
+type UserSearch struct {
+	// Bases are the DNs under which users are searched for. If empty,
+	// the Directory's SearchBase is used.
+	Bases []string
+
+	// LoginAttrs are the attributes which are matched against the name
+	// a user logs in with, for example sAMAccountName,
+	// userPrincipalName, mail, or uid. If empty, the attribute holding
+	// the username is used.
+	LoginAttrs []string
+}
+
+// find searches conn for the user who logs in as login, and returns
+// their DN and username, read from nameAttr. Only entries matching
+// filter are considered. If no user is found, ErrInvalidCredentials is
+// returned, as for an incorrect password.
+func (s *UserSearch) find(conn LDAPConn, dir Directory, login, nameAttr, filter string) (string, string, error) {
+	attrs := s.LoginAttrs
+	if len(attrs) == 0 {
+		attrs = []string{nameAttr}
+	}
+	var match []string
+	for _, attr := range attrs {
+		match = append(match, fmt.Sprintf("(%s=%s)", ldap.EscapeFilter(attr), ldap.EscapeFilter(login)))
+	}
+	filter = fmt.Sprintf("(&%s(|%s))", filter, strings.Join(match, ""))
+
+	bases := s.Bases
+	if len(bases) == 0 {
+		bases = []string{dir.SearchBase}
+	}
+	var found []*ldap.Entry
+	for _, base := range bases {
+		sr, err := searchLDAP(conn, base, ldap.ScopeWholeSubtree, filter, []string{nameAttr})
+		if err != nil {
+			return "", "", err
+		}
+		found = append(found, sr.Entries...)
+	}
+	switch len(found) {
+	case 0:
+		return "", "", ErrInvalidCredentials
+	case 1:
+		name := found[0].GetAttributeValue(nameAttr)
+		if name == "" {
+			return "", "", fmt.Errorf("%s has no %s", found[0].DN, nameAttr)
+		}
+		return found[0].DN, name, nil
+	default:
+		var dns []string
+		for _, e := range found {
+			dns = append(dns, e.DN)
+		}
+		return "", "", fmt.Errorf("%q matches %d users: %s", login, len(found), strings.Join(dns, "; "))
+	}
+}
+
+// byName returns a UserSearch which finds users by their username,
+// rather than any of the names they log in with, or nil if s is nil.
+func (s *UserSearch) byName() *UserSearch {
+	if s == nil {
+		return nil
+	}
+	return &UserSearch{Bases: s.Bases}
+}
+
+// lookup returns a function which finds the DN and username of the
+// user who logs in as login, by searching with s if it is not nil,
+// otherwise by constructing the DN with userdn.
+func (s *UserSearch) lookup(pool *LDAPPool, dir Directory, userdn func(string) string, nameAttr, filter string) func(string) (string, string, error) {
+	if s == nil {
+		return func(login string) (string, string, error) {
+			return userdn(login), login, nil
+		}
+	}
+	return func(login string) (string, string, error) {
+		if pool.BindDN == "" {
+			return "", "", fmt.Errorf("searching for users requires a service account")
+		}
+		conn, err := pool.Conn()
+		if err != nil {
+			return "", "", err
+		}
+		defer conn.Close()
+		return s.find(conn, dir, login, nameAttr, filter)
+	}
+}
@@ -0,0 +1,55 @@
+package kubetoken
+
+import "testing"
+
+func TestUserSearch(t *testing.T) {
+	layout := Directory{SearchBase: "DC=example,DC=com"}
+	person := func(sam, upn, mail string) map[string][]string {
+		return map[string][]string{
+			"objectCategory":    {"Person"},
+			"sAMAccountName":    {sam},
+			"userPrincipalName": {upn},
+			"mail":              {mail},
+		}
+	}
+	dir := memDirectory{
+		entry("CN=Dave Cheney,OU=staff,DC=example,DC=com", person("dcheney", "dcheney@corp.example.com", "dave@example.com")),
+		entry("CN=deploy-bot,OU=bots,DC=example,DC=com", person("deploy-bot", "deploy-bot@corp.example.com", "")),
+		entry("CN=Jo Doe,OU=contractors,DC=example,DC=com", person("jdoe", "jdoe@corp.example.com", "shared@example.com")),
+		entry("CN=Jo Smith,OU=contractors,DC=example,DC=com", person("jsmith", "jsmith@corp.example.com", "shared@example.com")),
+		entry("CN=printer,OU=staff,DC=example,DC=com", map[string][]string{"objectCategory": {"Computer"}, "sAMAccountName": {"printer"}}),
+	}
+
+	tests := []struct {
+		search         UserSearch
+		login          string
+		wantDN, wantID string
+		err            bool
+	}{
+		{search: UserSearch{}, login: "dcheney", wantDN: "CN=Dave Cheney,OU=staff,DC=example,DC=com", wantID: "dcheney"},
+		{search: UserSearch{}, login: "dave@example.com", err: true},
+		{search: UserSearch{LoginAttrs: []string{"sAMAccountName", "userPrincipalName", "mail"}}, login: "dave@example.com", wantDN: "CN=Dave Cheney,OU=staff,DC=example,DC=com", wantID: "dcheney"},
+		{search: UserSearch{LoginAttrs: []string{"userPrincipalName"}}, login: "deploy-bot@corp.example.com", wantDN: "CN=deploy-bot,OU=bots,DC=example,DC=com", wantID: "deploy-bot"},
+		{search: UserSearch{Bases: []string{"OU=staff,DC=example,DC=com"}}, login: "jdoe", err: true},
+		{search: UserSearch{Bases: []string{"OU=staff,DC=example,DC=com", "OU=contractors,DC=example,DC=com"}}, login: "jdoe", wantDN: "CN=Jo Doe,OU=contractors,DC=example,DC=com", wantID: "jdoe"},
+		{search: UserSearch{LoginAttrs: []string{"mail"}}, login: "shared@example.com", err: true},
+		{search: UserSearch{LoginAttrs: []string{"mail"}}, login: "*", err: true},
+		{search: UserSearch{}, login: "printer", err: true},
+	}
+	for _, tt := range tests {
+		dn, id, err := tt.search.find(dir, layout, tt.login, "sAMAccountName", "(objectCategory=Person)")
+		if tt.err {
+			if err == nil {
+				t.Errorf("%+v: %s: expected error, got %q, %q", tt.search, tt.login, dn, id)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%+v: %s: %v", tt.search, tt.login, err)
+			continue
+		}
+		if dn != tt.wantDN || id != tt.wantID {
+			t.Errorf("%+v: %s: got %q, %q, want %q, %q", tt.search, tt.login, dn, id, tt.wantDN, tt.wantID)
+		}
+	}
+}